@@ -0,0 +1,290 @@
+package consumer
+
+import (
+	"encoding/json"
+	"github.com/kgara/cmdhandler/pkg/shared"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// PauseGate holds the workers back between the deliveries while paused.
+// The nil gate is never paused, so the workers may call Wait without checking.
+type PauseGate struct {
+	mu sync.Mutex
+	// Closed on resume, nil while not paused
+	resumed chan struct{}
+}
+
+// Pause makes the following Wait calls block until Resume.
+func (g *PauseGate) Pause() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.resumed == nil {
+		g.resumed = make(chan struct{})
+	}
+}
+
+// Resume releases the waiting workers.
+func (g *PauseGate) Resume() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.resumed != nil {
+		close(g.resumed)
+		g.resumed = nil
+	}
+}
+
+// Paused reports if the gate is paused.
+func (g *PauseGate) Paused() bool {
+	if g == nil {
+		return false
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.resumed != nil
+}
+
+// Wait blocks while the gate is paused.
+func (g *PauseGate) Wait() {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	resumed := g.resumed
+	g.mu.Unlock()
+	if resumed != nil {
+		<-resumed
+	}
+}
+
+// Item is a single key-value pair returned by the admin API.
+type Item struct {
+	Key   string
+	Value string
+}
+
+// ItemsResponse is the body of GET /items.
+type ItemsResponse struct {
+	Namespace string
+	// Version of the map the items were read at
+	Version uint64
+	Items   []Item
+}
+
+// PauseResponse is the body of the pause and resume operations.
+type PauseResponse struct {
+	Paused bool
+}
+
+// SnapshotResponse is the body of the forced snapshot operation.
+type SnapshotResponse struct {
+	FileName   string
+	Namespaces int
+	Items      int
+}
+
+// SnapshotFile is the content of the file written by the forced snapshot.
+// The maps are copied one by one, so it is not a single point in time across the namespaces.
+type SnapshotFile struct {
+	Timestamp time.Time
+	Maps      []ItemsResponse
+}
+
+// PromoteResponse is the body of the promote operation.
+type PromoteResponse struct {
+	Role string
+}
+
+type errorResponse struct {
+	Error string
+}
+
+// AdminServer is the HTTP API for inspecting and operating the running consumer:
+//
+//	GET  /healthz          the process is alive
+//	GET  /readyz           the broker connection is ready
+//	GET  /items            all the items of the map in the insertion order
+//	GET  /items/{key}      a single item
+//	POST /admin/pause      stop taking new deliveries
+//	POST /admin/resume     continue taking deliveries
+//	POST /admin/snapshot   write all the maps out to the snapshot file
+//	POST /admin/promote    turn the standby into the primary
+//	GET  /metrics          Prometheus metrics
+//
+// The items endpoints take the optional namespace query parameter, the default map is used without it.
+type AdminServer struct {
+	registry         *MapRegistry
+	ready            func() bool
+	gate             *PauseGate
+	snapshotFileName string
+	// See SetPromoter
+	promote func() error
+	logger  *slog.Logger
+	mux     *http.ServeMux
+}
+
+// NewAdminServer creates a new instance of AdminServer. The ready func reports the broker readiness,
+// the gate is paused and resumed by the admin operations.
+func NewAdminServer(registry *MapRegistry, ready func() bool, gate *PauseGate, snapshotFileName string, logger *slog.Logger) *AdminServer {
+	server := &AdminServer{
+		registry:         registry,
+		ready:            ready,
+		gate:             gate,
+		snapshotFileName: snapshotFileName,
+		logger:           logger,
+		mux:              http.NewServeMux(),
+	}
+	server.mux.HandleFunc("GET /healthz", server.healthz)
+	server.mux.HandleFunc("GET /readyz", server.readyz)
+	server.mux.HandleFunc("GET /items", server.items)
+	server.mux.HandleFunc("GET /items/{key}", server.item)
+	server.mux.HandleFunc("POST /admin/pause", server.pause)
+	server.mux.HandleFunc("POST /admin/resume", server.resume)
+	server.mux.HandleFunc("POST /admin/snapshot", server.snapshot)
+	server.mux.HandleFunc("POST /admin/promote", server.promoteStandby)
+	server.mux.Handle("GET /metrics", shared.MetricsHandler())
+	return server
+}
+
+// SetPromoter sets the func turning the standby into the primary, the consumers which are not standbys have none.
+// Must be called before serving.
+func (s *AdminServer) SetPromoter(promote func() error) {
+	s.promote = promote
+}
+
+func (s *AdminServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+func (s *AdminServer) healthz(w http.ResponseWriter, _ *http.Request) {
+	s.writeText(w, http.StatusOK, "ok")
+}
+
+func (s *AdminServer) readyz(w http.ResponseWriter, _ *http.Request) {
+	if !s.ready() {
+		s.writeText(w, http.StatusServiceUnavailable, "not ready")
+		return
+	}
+	s.writeText(w, http.StatusOK, "ready")
+}
+
+func (s *AdminServer) items(w http.ResponseWriter, r *http.Request) {
+	namespace := r.URL.Query().Get("namespace")
+	om, ok := s.registry.Map(namespace)
+	if !ok {
+		s.writeJSON(w, http.StatusNotFound, errorResponse{Error: "Namespace " + namespace + " not found"})
+		return
+	}
+	s.writeJSON(w, http.StatusOK, readItems(namespace, om))
+}
+
+func (s *AdminServer) item(w http.ResponseWriter, r *http.Request) {
+	namespace := r.URL.Query().Get("namespace")
+	key := r.PathValue("key")
+	om, ok := s.registry.Map(namespace)
+	if !ok {
+		s.writeJSON(w, http.StatusNotFound, errorResponse{Error: "Namespace " + namespace + " not found"})
+		return
+	}
+	value, ok := om.Get(key)
+	if !ok {
+		s.writeJSON(w, http.StatusNotFound, errorResponse{Error: "Key " + key + " not found"})
+		return
+	}
+	s.writeJSON(w, http.StatusOK, Item{Key: key, Value: value})
+}
+
+func (s *AdminServer) pause(w http.ResponseWriter, _ *http.Request) {
+	s.gate.Pause()
+	s.logger.Info("Consuming paused")
+	s.writeJSON(w, http.StatusOK, PauseResponse{Paused: true})
+}
+
+func (s *AdminServer) resume(w http.ResponseWriter, _ *http.Request) {
+	s.gate.Resume()
+	s.logger.Info("Consuming resumed")
+	s.writeJSON(w, http.StatusOK, PauseResponse{Paused: false})
+}
+
+func (s *AdminServer) snapshot(w http.ResponseWriter, _ *http.Request) {
+	file := SnapshotFile{Timestamp: time.Now().UTC()}
+	response := SnapshotResponse{FileName: s.snapshotFileName}
+	for _, namespace := range s.registry.Namespaces() {
+		// Dropped meanwhile
+		om, ok := s.registry.Map(namespace)
+		if !ok {
+			continue
+		}
+		items := readItems(namespace, om)
+		file.Maps = append(file.Maps, items)
+		response.Namespaces++
+		response.Items += len(items.Items)
+	}
+
+	data, err := json.Marshal(file)
+	if err == nil {
+		err = writeFileAtomically(s.snapshotFileName, data)
+	}
+	if err != nil {
+		s.logger.Error("Error writing snapshot", "file", s.snapshotFileName, "error", err)
+		s.writeJSON(w, http.StatusInternalServerError, errorResponse{Error: err.Error()})
+		return
+	}
+	s.logger.Info("Snapshot written", "file", s.snapshotFileName, "namespaces", response.Namespaces, "items", response.Items)
+	s.writeJSON(w, http.StatusOK, response)
+}
+
+func (s *AdminServer) promoteStandby(w http.ResponseWriter, _ *http.Request) {
+	if s.promote == nil {
+		s.writeJSON(w, http.StatusConflict, errorResponse{Error: "Not a standby"})
+		return
+	}
+	if err := s.promote(); err != nil {
+		s.writeJSON(w, http.StatusConflict, errorResponse{Error: err.Error()})
+		return
+	}
+	s.logger.Info("Promoted to primary")
+	s.writeJSON(w, http.StatusOK, PromoteResponse{Role: "primary"})
+}
+
+func readItems(namespace string, om *OrderedMapImpl) ItemsResponse {
+	snapshot := om.Snapshot()
+	defer snapshot.Release()
+	response := ItemsResponse{
+		Namespace: namespace,
+		Version:   snapshot.Version(),
+		Items:     make([]Item, 0, snapshot.Len()),
+	}
+	for key, value := range snapshot.All() {
+		response.Items = append(response.Items, Item{Key: key, Value: value})
+	}
+	return response
+}
+
+// writeFileAtomically replaces the file through the temporary one, so the readers never see it half written.
+func writeFileAtomically(fileName string, data []byte) error {
+	tmpFileName := fileName + ".tmp"
+	if err := os.WriteFile(tmpFileName, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpFileName, fileName)
+}
+
+func (s *AdminServer) writeText(w http.ResponseWriter, status int, text string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	if _, err := w.Write([]byte(text + "\n")); err != nil {
+		s.logger.Error("Error writing admin response", "error", err)
+	}
+}
+
+func (s *AdminServer) writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		s.logger.Error("Error writing admin response", "error", err)
+	}
+}
@@ -0,0 +1,180 @@
+package consumer
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/kgara/cmdhandler/pkg/shared"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func initializeAdmin(t *testing.T, ready bool) (*FileWriterMock, *MapRegistry, *PauseGate, *httptest.Server) {
+	fileWriterMock, registry := initializeRegistry()
+	gate := &PauseGate{}
+	snapshotFileName := filepath.Join(t.TempDir(), "snapshot.json")
+	server := httptest.NewServer(NewAdminServer(registry, func() bool { return ready }, gate, snapshotFileName, slog.New(slog.NewTextHandler(io.Discard, nil))))
+	t.Cleanup(server.Close)
+	return fileWriterMock, registry, gate, server
+}
+
+func getJSON(t *testing.T, url string, body any) int {
+	response, err := http.Get(url)
+	assert.NoError(t, err)
+	defer response.Body.Close()
+	assert.NoError(t, json.NewDecoder(response.Body).Decode(body))
+	return response.StatusCode
+}
+
+func postJSON(t *testing.T, url string, body any) int {
+	response, err := http.Post(url, "application/json", nil)
+	assert.NoError(t, err)
+	defer response.Body.Close()
+	assert.NoError(t, json.NewDecoder(response.Body).Decode(body))
+	return response.StatusCode
+}
+
+func TestAdminHealth(t *testing.T) {
+	_, _, _, server := initializeAdmin(t, false)
+
+	response, err := http.Get(server.URL + "/healthz")
+	assert.NoError(t, err)
+	response.Body.Close()
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+
+	response, err = http.Get(server.URL + "/readyz")
+	assert.NoError(t, err)
+	response.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, response.StatusCode)
+
+	_, _, _, server = initializeAdmin(t, true)
+	response, err = http.Get(server.URL + "/readyz")
+	assert.NoError(t, err)
+	response.Body.Close()
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+}
+
+func TestAdminItems(t *testing.T) {
+	fileWriterMock, registry, _, server := initializeAdmin(t, true)
+	fileWriterMock.On("Write", mock.Anything)
+	registry.ExecuteCommand(&shared.Command{Action: shared.AddItem, Key: "key2", Value: "value2"})
+	registry.ExecuteCommand(&shared.Command{Action: shared.AddItem, Key: "key1", Value: "value1"})
+	registry.ExecuteCommand(&shared.Command{Action: shared.AddItem, Key: "key3", Value: "value3", Namespace: "orders"})
+
+	var items ItemsResponse
+	assert.Equal(t, http.StatusOK, getJSON(t, server.URL+"/items", &items))
+	assert.Equal(t, []Item{{Key: "key2", Value: "value2"}, {Key: "key1", Value: "value1"}}, items.Items)
+	assert.Equal(t, uint64(2), items.Version)
+
+	assert.Equal(t, http.StatusOK, getJSON(t, server.URL+"/items?namespace=orders", &items))
+	assert.Equal(t, "orders", items.Namespace)
+	assert.Equal(t, []Item{{Key: "key3", Value: "value3"}}, items.Items)
+
+	var item Item
+	assert.Equal(t, http.StatusOK, getJSON(t, server.URL+"/items/key1", &item))
+	assert.Equal(t, Item{Key: "key1", Value: "value1"}, item)
+
+	var failure errorResponse
+	assert.Equal(t, http.StatusNotFound, getJSON(t, server.URL+"/items/key3", &failure))
+	assert.Equal(t, "Key key3 not found", failure.Error)
+	assert.Equal(t, http.StatusNotFound, getJSON(t, server.URL+"/items?namespace=missing", &failure))
+	// Looking does not create the map
+	assert.Equal(t, []string{DefaultNamespace, "orders"}, registry.Namespaces())
+}
+
+func TestAdminPauseResume(t *testing.T) {
+	_, _, gate, server := initializeAdmin(t, true)
+
+	var paused PauseResponse
+	assert.Equal(t, http.StatusOK, postJSON(t, server.URL+"/admin/pause", &paused))
+	assert.True(t, paused.Paused)
+	assert.True(t, gate.Paused())
+
+	waited := make(chan struct{})
+	go func() {
+		gate.Wait()
+		close(waited)
+	}()
+	select {
+	case <-waited:
+		t.Fatal("Wait returned while paused")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	assert.Equal(t, http.StatusOK, postJSON(t, server.URL+"/admin/resume", &paused))
+	assert.False(t, paused.Paused)
+	select {
+	case <-waited:
+	case <-time.After(time.Second):
+		t.Fatal("Wait did not return after resume")
+	}
+
+	response, err := http.Get(server.URL + "/admin/pause")
+	assert.NoError(t, err)
+	response.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, response.StatusCode)
+}
+
+func TestAdminSnapshot(t *testing.T) {
+	fileWriterMock, registry, _, server := initializeAdmin(t, true)
+	fileWriterMock.On("Write", mock.Anything)
+	registry.ExecuteCommand(&shared.Command{Action: shared.AddItem, Key: "key1", Value: "value1"})
+	registry.ExecuteCommand(&shared.Command{Action: shared.AddItem, Key: "key2", Value: "value2", Namespace: "orders"})
+
+	var snapshot SnapshotResponse
+	assert.Equal(t, http.StatusOK, postJSON(t, server.URL+"/admin/snapshot", &snapshot))
+	assert.Equal(t, 2, snapshot.Namespaces)
+	assert.Equal(t, 2, snapshot.Items)
+
+	content, err := os.ReadFile(snapshot.FileName)
+	assert.NoError(t, err)
+	var file SnapshotFile
+	assert.NoError(t, json.Unmarshal(content, &file))
+	assert.Len(t, file.Maps, 2)
+	assert.Equal(t, "orders", file.Maps[1].Namespace)
+	assert.Equal(t, []Item{{Key: "key2", Value: "value2"}}, file.Maps[1].Items)
+}
+
+func TestAdminPromote(t *testing.T) {
+	_, registry := initializeRegistry()
+	admin := NewAdminServer(registry, func() bool { return true }, &PauseGate{}, "", slog.New(slog.NewTextHandler(io.Discard, nil)))
+	server := httptest.NewServer(admin)
+	t.Cleanup(server.Close)
+
+	var failure errorResponse
+	assert.Equal(t, http.StatusConflict, postJSON(t, server.URL+"/admin/promote", &failure))
+	assert.Equal(t, "Not a standby", failure.Error)
+
+	promotions := 0
+	admin.SetPromoter(func() error {
+		promotions++
+		if promotions > 1 {
+			return errors.New("already promoted")
+		}
+		return nil
+	})
+	var promoted PromoteResponse
+	assert.Equal(t, http.StatusOK, postJSON(t, server.URL+"/admin/promote", &promoted))
+	assert.Equal(t, "primary", promoted.Role)
+	assert.Equal(t, http.StatusConflict, postJSON(t, server.URL+"/admin/promote", &failure))
+	assert.Equal(t, "already promoted", failure.Error)
+}
+
+func TestAdminMetrics(t *testing.T) {
+	_, _, _, server := initializeAdmin(t, true)
+
+	response, err := http.Get(server.URL + "/metrics")
+	assert.NoError(t, err)
+	content, err := io.ReadAll(response.Body)
+	response.Body.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Contains(t, string(content), "cmdhandler_map_lock_wait_seconds")
+}
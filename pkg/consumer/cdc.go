@@ -0,0 +1,331 @@
+package consumer
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Delay between the attempts to publish the same change event
+	cdcRetryDelay = time.Second
+	// How long Close waits for the queued events to be published
+	cdcDrainTimeout = 10 * time.Second
+	// Sequence numbers reserved in the state file at once
+	cdcSequenceBlock = 1000
+	// Longer spilled line can only be garbage
+	maxSpilledEventSize = 64 << 20
+)
+
+// ChangeEvent is the change data capture record published for every mutation of the ordered maps.
+type ChangeEvent struct {
+	// Sequence grows with every event and never goes back, consumers may use it to drop the redelivered
+	// duplicates. It skips forward after a restart, to the numbers not reserved before
+	Sequence  uint64
+	Op        MutationOp
+	Namespace string
+	Key       string
+	OldValue  string
+	NewValue  string
+	Timestamp time.Time
+}
+
+// Pusher publishes the data and blocks until the broker confirms it, shared.Client is the one we use.
+type Pusher interface {
+	Push(data []byte) error
+}
+
+// CDCPublisher publishes the change events with the at-least-once guarantee.
+// The event is retried until the broker confirms it. The events not fitting the full buffer are spilled
+// to the file next to the state file and published once the buffer is drained, so the map writers are
+// not held back. The spilled events left unpublished survive a restart, the ones still waiting
+// in the buffer when the process dies are lost.
+// The state file keeps the sequence numbers reserved in blocks ahead of the events, so a restart never
+// numbers two events the same.
+// With no state file there is nothing to spill to, the full buffer holds the map writers back.
+type CDCPublisher struct {
+	pusher        Pusher
+	stateFileName string
+	events        chan ChangeEvent
+	sequence      uint64
+	// Sequence numbers up to it are reserved in the state file
+	reserved uint64
+	// Open while the events are spilled, all the new events go there until it is drained
+	spill  *os.File
+	closed bool
+	mu     sync.Mutex
+	// Closed first thing in Close, releases Publish blocked on the full buffer
+	closing chan struct{}
+	// Closed when Close gives up on the unpublished events
+	done   chan struct{}
+	wg     sync.WaitGroup
+	logger *slog.Logger
+}
+
+// NewCDCPublisher creates a new instance of CDCPublisher resuming the sequence from the state file.
+// An empty state file name disables persisting the sequence and spilling the events.
+func NewCDCPublisher(pusher Pusher, stateFileName string, bufferSize int, logger *slog.Logger) (*CDCPublisher, error) {
+	reserved, err := readCDCState(stateFileName)
+	if err != nil {
+		return nil, err
+	}
+	if stateFileName != "" {
+		// Set aside before anything is spilled again, published on Start
+		err := os.Rename(cdcSpillFileName(stateFileName), cdcRecoveredFileName(stateFileName))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+	return &CDCPublisher{
+		pusher:        pusher,
+		stateFileName: stateFileName,
+		events:        make(chan ChangeEvent, bufferSize),
+		sequence:      reserved,
+		reserved:      reserved,
+		closing:       make(chan struct{}),
+		done:          make(chan struct{}),
+		logger:        logger,
+	}, nil
+}
+
+// Publish numbers the mutation and queues it for publishing. It is called under the lock of the map,
+// so the event is spilled to the file rather than waiting for the room in the full buffer, see CDCPublisher.
+func (p *CDCPublisher) Publish(namespace string, mutation Mutation) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		p.logger.Warn("CDC publisher is closed, dropping the change", "op", mutation.Op, "key", mutation.Key)
+		return
+	}
+	if p.sequence == p.reserved {
+		if err := writeCDCState(p.stateFileName, p.reserved+cdcSequenceBlock); err != nil {
+			// The numbers are not reused unless it restarts before the next block is saved
+			p.logger.Error("Error saving CDC state", "error", err)
+		}
+		p.reserved += cdcSequenceBlock
+	}
+	p.sequence++
+	event := ChangeEvent{
+		Sequence:  p.sequence,
+		Op:        mutation.Op,
+		Namespace: namespace,
+		Key:       mutation.Key,
+		OldValue:  mutation.OldValue,
+		NewValue:  mutation.NewValue,
+		Timestamp: time.Now().UTC(),
+	}
+	if p.spill == nil {
+		select {
+		case p.events <- event:
+			return
+		default:
+		}
+		if err := p.startSpill(); err != nil {
+			if p.stateFileName != "" {
+				p.logger.Error("Error spilling change events, waiting for the buffer", "error", err)
+			}
+			select {
+			case p.events <- event:
+			case <-p.closing:
+				p.logger.Warn("CDC publisher is closing, dropping the change", "op", mutation.Op, "key", mutation.Key)
+			}
+			return
+		}
+	}
+	data, err := json.Marshal(event)
+	if err == nil {
+		_, err = p.spill.Write(append(data, '\n'))
+	}
+	if err != nil {
+		p.logger.Error("Error spilling change event, dropping it", "sequence", event.Sequence, "error", err)
+	}
+}
+
+// startSpill opens the spill file, the events go there until it is drained.
+// Must be called with the lock held.
+func (p *CDCPublisher) startSpill() error {
+	if p.stateFileName == "" {
+		return errors.New("no state file to spill next to")
+	}
+	file, err := os.OpenFile(cdcSpillFileName(p.stateFileName), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	p.logger.Warn("CDC buffer is full, spilling the change events", "file", file.Name())
+	p.spill = file
+	return nil
+}
+
+// takeSpill hands the spill file over for publishing, if the events are spilled.
+// Called with the buffer empty, so the spilled events are the next ones, and the new ones go to the buffer again.
+func (p *CDCPublisher) takeSpill() (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.spill == nil {
+		return "", nil
+	}
+	err := p.spill.Close()
+	p.spill = nil
+	if err != nil {
+		return "", err
+	}
+	draining := cdcDrainingFileName(p.stateFileName)
+	return draining, os.Rename(cdcSpillFileName(p.stateFileName), draining)
+}
+
+// Start starts publishing the queued events, the ones spilled before the restart first.
+func (p *CDCPublisher) Start() {
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		if p.stateFileName != "" {
+			// The one being drained is older than the one being spilled
+			if !p.publishSpilled(cdcDrainingFileName(p.stateFileName)) || !p.publishSpilled(cdcRecoveredFileName(p.stateFileName)) {
+				return
+			}
+		}
+		for event := range p.events {
+			if !p.publishEvent(event) {
+				return
+			}
+			if len(p.events) > 0 {
+				continue
+			}
+			draining, err := p.takeSpill()
+			if err != nil {
+				p.logger.Error("Error taking over the spilled change events", "error", err)
+			}
+			if draining != "" && !p.publishSpilled(draining) {
+				return
+			}
+		}
+		// Closed, the events spilled meanwhile are the last ones
+		if draining, err := p.takeSpill(); err != nil {
+			p.logger.Error("Error taking over the spilled change events", "error", err)
+		} else if draining != "" {
+			p.publishSpilled(draining)
+		}
+	}()
+}
+
+// publishSpilled publishes the events of the spill file and removes it, returns false if the publisher
+// got closed meanwhile. The file left behind is published once again after the restart.
+func (p *CDCPublisher) publishSpilled(fileName string) bool {
+	file, err := os.Open(fileName)
+	if errors.Is(err, os.ErrNotExist) {
+		return true
+	}
+	if err != nil {
+		p.logger.Error("Error reading the spilled change events", "file", fileName, "error", err)
+		return true
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, maxSpilledEventSize)
+	for scanner.Scan() {
+		event := ChangeEvent{}
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			// The torn last line of a crash
+			p.logger.Error("Error decoding the spilled change event", "file", fileName, "error", err)
+			continue
+		}
+		if !p.publishEvent(event) {
+			return false
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		p.logger.Error("Error reading the spilled change events", "file", fileName, "error", err)
+		return true
+	}
+	if err := os.Remove(fileName); err != nil {
+		p.logger.Error("Error removing the spilled change events", "file", fileName, "error", err)
+	}
+	return true
+}
+
+// publishEvent retries until the event is confirmed, returns false if the publisher got closed meanwhile.
+func (p *CDCPublisher) publishEvent(event ChangeEvent) bool {
+	data, err := json.Marshal(event)
+	if err != nil {
+		p.logger.Error("Error encoding change event", "sequence", event.Sequence, "error", err)
+		return true
+	}
+	for {
+		err := p.pusher.Push(data)
+		if err == nil {
+			return true
+		}
+		p.logger.Warn("Publishing change event failed. Retrying...", "sequence", event.Sequence, "error", err)
+		select {
+		case <-p.done:
+			return false
+		case <-time.After(cdcRetryDelay):
+		}
+	}
+}
+
+// Close stops accepting new events and waits for the queued and spilled ones to be published.
+// Events still not published after cdcDrainTimeout are abandoned, the spilled ones wait for the restart.
+func (p *CDCPublisher) Close() {
+	close(p.closing)
+	p.mu.Lock()
+	p.closed = true
+	close(p.events)
+	p.mu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(cdcDrainTimeout):
+		p.logger.Warn("Abandoning unpublished change events", "count", len(p.events))
+		close(p.done)
+		<-drained
+	}
+}
+
+// The events not fitting the buffer are appended there
+func cdcSpillFileName(stateFileName string) string {
+	return stateFileName + ".spill"
+}
+
+// The spill file is moved there while its events are published, so the new ones may be spilled meanwhile
+func cdcDrainingFileName(stateFileName string) string {
+	return stateFileName + ".draining"
+}
+
+// The spill file left by the previous run is moved there on start
+func cdcRecoveredFileName(stateFileName string) string {
+	return stateFileName + ".recovered"
+}
+
+func readCDCState(stateFileName string) (uint64, error) {
+	if stateFileName == "" {
+		return 0, nil
+	}
+	content, err := os.ReadFile(stateFileName)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(content)), 10, 64)
+}
+
+// writeCDCState replaces the state file atomically, so a crash never leaves it half written.
+func writeCDCState(stateFileName string, sequence uint64) error {
+	if stateFileName == "" {
+		return nil
+	}
+	return writeFileAtomically(stateFileName, []byte(strconv.FormatUint(sequence, 10)+"\n"))
+}
@@ -0,0 +1,136 @@
+package consumer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+type pusherStub struct {
+	mu       sync.Mutex
+	failures int
+	pushed   []ChangeEvent
+}
+
+func (p *pusherStub) Push(data []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.failures > 0 {
+		p.failures--
+		return errors.New("not connected")
+	}
+	event := ChangeEvent{}
+	if err := json.Unmarshal(data, &event); err != nil {
+		return err
+	}
+	p.pushed = append(p.pushed, event)
+	return nil
+}
+
+func TestCDCPublisherPublishesInOrder(t *testing.T) {
+	stateFileName := filepath.Join(t.TempDir(), "cdc.state")
+	pusher := &pusherStub{failures: 1}
+	publisher, err := NewCDCPublisher(pusher, stateFileName, 10, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	assert.NoError(t, err)
+	publisher.Start()
+
+	publisher.Publish("", Mutation{Op: MutationInsert, Key: "key1", NewValue: "value1"})
+	publisher.Publish("team1", Mutation{Op: MutationUpdate, Key: "key1", OldValue: "value1", NewValue: "value2"})
+	publisher.Publish("team1", Mutation{Op: MutationDelete, Key: "key1", OldValue: "value2"})
+	publisher.Close()
+
+	assert.Len(t, pusher.pushed, 3)
+	for i, event := range pusher.pushed {
+		assert.Equal(t, uint64(i+1), event.Sequence)
+		assert.False(t, event.Timestamp.IsZero())
+	}
+	assert.Equal(t, MutationUpdate, pusher.pushed[1].Op)
+	assert.Equal(t, "team1", pusher.pushed[1].Namespace)
+	assert.Equal(t, "value1", pusher.pushed[1].OldValue)
+	assert.Equal(t, "value2", pusher.pushed[1].NewValue)
+
+	state, err := os.ReadFile(stateFileName)
+	assert.NoError(t, err)
+	// Reserved ahead of the events
+	assert.Equal(t, "1000\n", string(state))
+}
+
+func TestCDCPublisherResumesSequence(t *testing.T) {
+	stateFileName := filepath.Join(t.TempDir(), "cdc.state")
+	assert.NoError(t, os.WriteFile(stateFileName, []byte("41\n"), 0644))
+
+	pusher := &pusherStub{}
+	publisher, err := NewCDCPublisher(pusher, stateFileName, 10, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	assert.NoError(t, err)
+	publisher.Start()
+	publisher.Publish("", Mutation{Op: MutationInsert, Key: "key1", NewValue: "value1"})
+	publisher.Close()
+
+	assert.Len(t, pusher.pushed, 1)
+	assert.Equal(t, uint64(42), pusher.pushed[0].Sequence)
+
+	// Closed publisher drops the events instead of panicking
+	publisher.Publish("", Mutation{Op: MutationDelete, Key: "key1"})
+	assert.Len(t, pusher.pushed, 1)
+}
+
+func TestCDCPublisherSpillsOnFullBuffer(t *testing.T) {
+	stateFileName := filepath.Join(t.TempDir(), "cdc.state")
+	pusher := &pusherStub{}
+	publisher, err := NewCDCPublisher(pusher, stateFileName, 1, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	assert.NoError(t, err)
+
+	// Not started yet, the second and the third ones do not fit, the map writers are not held back
+	publisher.Publish("", Mutation{Op: MutationInsert, Key: "key1", NewValue: "value1"})
+	publisher.Publish("", Mutation{Op: MutationInsert, Key: "key2", NewValue: "value2"})
+	publisher.Publish("", Mutation{Op: MutationInsert, Key: "key3", NewValue: "value3"})
+	_, err = os.Stat(stateFileName + ".spill")
+	assert.NoError(t, err)
+	publisher.Start()
+	assert.Eventually(t, func() bool {
+		pusher.mu.Lock()
+		defer pusher.mu.Unlock()
+		return len(pusher.pushed) == 3
+	}, time.Second, time.Millisecond)
+	publisher.Publish("", Mutation{Op: MutationInsert, Key: "key4", NewValue: "value4"})
+	publisher.Close()
+
+	assert.Len(t, pusher.pushed, 4)
+	for i, event := range pusher.pushed {
+		assert.Equal(t, uint64(i+1), event.Sequence)
+		assert.Equal(t, fmt.Sprintf("key%d", i+1), event.Key)
+	}
+	_, err = os.Stat(stateFileName + ".draining")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestCDCPublisherPublishesSpilledAfterRestart(t *testing.T) {
+	stateFileName := filepath.Join(t.TempDir(), "cdc.state")
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	publisher, err := NewCDCPublisher(&pusherStub{}, stateFileName, 1, logger)
+	assert.NoError(t, err)
+	// Never started, as if it died with the events spilled
+	publisher.Publish("", Mutation{Op: MutationInsert, Key: "key1", NewValue: "value1"})
+	publisher.Publish("", Mutation{Op: MutationInsert, Key: "key2", NewValue: "value2"})
+
+	pusher := &pusherStub{}
+	publisher, err = NewCDCPublisher(pusher, stateFileName, 1, logger)
+	assert.NoError(t, err)
+	publisher.Start()
+	publisher.Publish("", Mutation{Op: MutationInsert, Key: "key3", NewValue: "value3"})
+	publisher.Close()
+
+	// The buffered one is lost, the spilled one is not, the numbers are never reused
+	assert.Len(t, pusher.pushed, 2)
+	assert.Equal(t, uint64(2), pusher.pushed[0].Sequence)
+	assert.Equal(t, "key2", pusher.pushed[0].Key)
+	assert.Equal(t, uint64(cdcSequenceBlock+1), pusher.pushed[1].Sequence)
+}
@@ -0,0 +1,234 @@
+package consumer
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+)
+
+// DedupeStatus tells what to do with the delivery of the message id
+type DedupeStatus int
+
+const (
+	// DedupeNew is the first delivery of the message, it is to be executed
+	DedupeNew DedupeStatus = iota
+	// DedupeDuplicate is a message executed already, it is to be acked without executing it again
+	DedupeDuplicate
+	// DedupeInFlight is a message being executed by another worker right now.
+	// It is to be requeued, as the other worker may still fail on it, best after waiting for it, see Done
+	DedupeInFlight
+)
+
+// Deduplicator remembers the ids of the last executed messages, so the redelivered
+// and re-pushed copies are not executed twice. Only the last size ids are kept.
+//
+// With the file name set, the ids are appended to the file before the delivery is acked,
+// so the window survives restarts. The file is compacted down to the window once it
+// holds twice as many ids.
+//
+// The nil Deduplicator takes every message as new, so the workers may use it without checking.
+type Deduplicator struct {
+	mu   sync.Mutex
+	size int
+	// Ring of the executed ids, next is the slot of the oldest one once it is full
+	window   []string
+	next     int
+	executed map[string]struct{}
+	// Closed once the claimed id is committed or aborted
+	inFlight map[string]chan struct{}
+
+	fileName  string
+	file      *os.File
+	fileLines int
+}
+
+// NewDeduplicator creates a new instance of Deduplicator keeping the last size ids,
+// loading them from the file if the file name is set.
+func NewDeduplicator(size int, fileName string) (*Deduplicator, error) {
+	if size <= 0 {
+		return nil, errors.New("dedupe window size must be positive")
+	}
+	d := &Deduplicator{
+		size:     size,
+		window:   make([]string, 0, size),
+		executed: make(map[string]struct{}, size),
+		inFlight: make(map[string]chan struct{}),
+		fileName: fileName,
+	}
+	if fileName == "" {
+		return d, nil
+	}
+	if err := d.load(); err != nil {
+		return nil, err
+	}
+	if err := d.compact(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Begin claims the message id for execution unless it was executed already or is being executed.
+// The ids which can not be tracked, e.g. the empty one of the messages sent without it, are always new.
+func (d *Deduplicator) Begin(id string) DedupeStatus {
+	if d == nil || !trackable(id) {
+		return DedupeNew
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.executed[id]; ok {
+		return DedupeDuplicate
+	}
+	if _, ok := d.inFlight[id]; ok {
+		return DedupeInFlight
+	}
+	d.inFlight[id] = make(chan struct{})
+	return DedupeNew
+}
+
+// Done returns the channel closed once the id being executed is committed or aborted,
+// the closed one if it is not being executed.
+func (d *Deduplicator) Done(id string) <-chan struct{} {
+	if d != nil {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		if done, ok := d.inFlight[id]; ok {
+			return done
+		}
+	}
+	done := make(chan struct{})
+	close(done)
+	return done
+}
+
+// Commit records the claimed id as executed. It is to be called before the delivery is acked,
+// the error means the id may not survive a restart.
+func (d *Deduplicator) Commit(id string) error {
+	if d == nil || !trackable(id) {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.release(id)
+	if _, ok := d.executed[id]; ok {
+		return nil
+	}
+	d.add(id)
+	if d.file == nil {
+		return nil
+	}
+	if _, err := d.file.WriteString(id + "\n"); err != nil {
+		return err
+	}
+	d.fileLines++
+	if d.fileLines >= 2*d.size {
+		return d.compact()
+	}
+	return nil
+}
+
+// Abort releases the claimed id, so the next delivery of the message is executed.
+func (d *Deduplicator) Abort(id string) {
+	if d == nil || !trackable(id) {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.release(id)
+}
+
+// release ends the execution of the claimed id, waking up the ones waiting for it.
+func (d *Deduplicator) release(id string) {
+	if done, ok := d.inFlight[id]; ok {
+		close(done)
+		delete(d.inFlight, id)
+	}
+}
+
+// Len returns the number of the ids in the window.
+func (d *Deduplicator) Len() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.window)
+}
+
+// Close closes the file, if any.
+func (d *Deduplicator) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.file == nil {
+		return nil
+	}
+	err := d.file.Close()
+	d.file = nil
+	return err
+}
+
+// The ids are stored one per line
+func trackable(id string) bool {
+	return id != "" && !strings.ContainsAny(id, "\r\n")
+}
+
+// add puts the id into the window, evicting the oldest one when full.
+func (d *Deduplicator) add(id string) {
+	if len(d.window) < d.size {
+		d.window = append(d.window, id)
+	} else {
+		delete(d.executed, d.window[d.next])
+		d.window[d.next] = id
+		d.next = (d.next + 1) % d.size
+	}
+	d.executed[id] = struct{}{}
+}
+
+// ids returns the ids of the window from the oldest one.
+func (d *Deduplicator) ids() []string {
+	ids := make([]string, 0, len(d.window))
+	ids = append(ids, d.window[d.next:]...)
+	return append(ids, d.window[:d.next]...)
+}
+
+func (d *Deduplicator) load() error {
+	file, err := os.Open(d.fileName)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// A torn last line of a crash is simply a bogus id
+		if id := scanner.Text(); trackable(id) {
+			if _, ok := d.executed[id]; !ok {
+				d.add(id)
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// compact rewrites the file with the ids of the window only and reopens it for appending.
+func (d *Deduplicator) compact() error {
+	ids := d.ids()
+	content := strings.Join(ids, "\n")
+	if len(ids) > 0 {
+		content += "\n"
+	}
+	if err := writeFileAtomically(d.fileName, []byte(content)); err != nil {
+		return err
+	}
+	if d.file != nil {
+		_ = d.file.Close()
+	}
+	file, err := os.OpenFile(d.fileName, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		d.file = nil
+		return err
+	}
+	d.file = file
+	d.fileLines = len(ids)
+	return nil
+}
@@ -0,0 +1,80 @@
+package consumer
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDeduplicator(t *testing.T) {
+	d, err := NewDeduplicator(2, "")
+	assert.NoError(t, err)
+
+	assert.Equal(t, DedupeNew, d.Begin("id1"))
+	// Redelivered while the first delivery is still executed
+	assert.Equal(t, DedupeInFlight, d.Begin("id1"))
+	assert.NoError(t, d.Commit("id1"))
+	assert.Equal(t, DedupeDuplicate, d.Begin("id1"))
+
+	// Failed executions are retried
+	assert.Equal(t, DedupeNew, d.Begin("id2"))
+	d.Abort("id2")
+	assert.Equal(t, DedupeNew, d.Begin("id2"))
+	assert.NoError(t, d.Commit("id2"))
+
+	// The oldest id leaves the window
+	assert.Equal(t, DedupeNew, d.Begin("id3"))
+	assert.NoError(t, d.Commit("id3"))
+	assert.Equal(t, 2, d.Len())
+	assert.Equal(t, DedupeNew, d.Begin("id1"))
+	assert.Equal(t, DedupeDuplicate, d.Begin("id2"))
+
+	// The messages without the id are never deduplicated
+	assert.Equal(t, DedupeNew, d.Begin(""))
+	assert.Equal(t, DedupeNew, d.Begin(""))
+}
+
+func TestDeduplicatorDone(t *testing.T) {
+	d, err := NewDeduplicator(2, "")
+	assert.NoError(t, err)
+
+	assert.Equal(t, DedupeNew, d.Begin("id1"))
+	done := d.Done("id1")
+	select {
+	case <-done:
+		t.Fatal("done before the commit")
+	default:
+	}
+	assert.NoError(t, d.Commit("id1"))
+	<-done
+
+	// Not being executed
+	<-d.Done("id2")
+	var nilDeduplicator *Deduplicator
+	<-nilDeduplicator.Done("id1")
+}
+
+func TestDeduplicatorPersistence(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "dedupe.state")
+	d, err := NewDeduplicator(3, fileName)
+	assert.NoError(t, err)
+	for _, id := range []string{"id1", "id2", "id3", "id4", "id5"} {
+		assert.Equal(t, DedupeNew, d.Begin(id))
+		assert.NoError(t, d.Commit(id))
+	}
+	assert.NoError(t, d.Close())
+
+	d, err = NewDeduplicator(3, fileName)
+	assert.NoError(t, err)
+	defer d.Close()
+	assert.Equal(t, DedupeDuplicate, d.Begin("id5"))
+	assert.Equal(t, DedupeDuplicate, d.Begin("id3"))
+	assert.Equal(t, DedupeNew, d.Begin("id2"))
+
+	// Compacted on open
+	content, err := os.ReadFile(fileName)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"id3", "id4", "id5"}, strings.Fields(string(content)))
+}
@@ -2,113 +2,409 @@ package consumer
 
 import (
 	"fmt"
+	"github.com/kgara/cmdhandler/pkg/orderedmap"
 	"github.com/kgara/cmdhandler/pkg/shared"
+	"math"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
+// Used when the BlockingPopFront command does not carry its own timeout
+const defaultBlockingPopTimeout = 30 * time.Second
+
 type entry struct {
 	key, value string
-	prev, next *entry
+	// Insertion sequence number, restores the insertion order of the entries found through the key index
+	seq uint64
 }
 
+// OrderedMapImpl executes the commands on top of the insertion ordered map, guarding it with a single lock.
 type OrderedMapImpl struct {
-	items      map[string]*entry
-	head, tail *entry
-	mu         sync.RWMutex
+	items   *orderedmap.Map[string, entry]
+	index   *keyIndex
+	nextSeq uint64
+	mu      sync.RWMutex
+	// Closed and replaced on every new entry, so the blocking pops can wait for it
+	itemAdded chan struct{}
+	// Slots of the blocking pops waiting at once, shared by the maps of the registry, nil is unlimited.
+	// See MapRegistry.SetBlockingPopLimit
+	blockingPops chan struct{}
+	// Optional, see OnMutation
+	mutationListener MutationListener
+	// Number of the mutations applied so far, guarded by mu
+	version uint64
+	// Snapshots still referenced by the readers, by version, see Snapshot
+	snapshots   map[uint64]*Snapshot
+	snapshotsMu sync.Mutex
 	// Just the encapsulation for emulating "heavy io operation"
 	fileWriter FileWriter
+	// Turns the results into the output lines, DefaultFormatter if nil
+	formatter *Formatter
+	// Commands of the registry still executing on the map, see MapRegistry.acquire
+	inflight sync.WaitGroup
+	// Closed once the map is dropped from the registry, so the blocking pops stop waiting on it
+	dropped chan struct{}
 }
 
 func NewOrderedMap(fileWriter FileWriter) *OrderedMapImpl {
 	return &OrderedMapImpl{
-		items:      make(map[string]*entry),
+		items:      orderedmap.New[string, entry](),
+		index:      newKeyIndex(),
+		itemAdded:  make(chan struct{}),
+		snapshots:  make(map[uint64]*Snapshot),
 		fileWriter: fileWriter,
+		dropped:    make(chan struct{}),
 	}
 }
 
-func (om *OrderedMapImpl) ExecuteCommand(cmd *shared.Command) {
+// SetFormatter sets the formatter of the output lines, nil restores DefaultFormatter.
+// Must be called before the first command.
+func (om *OrderedMapImpl) SetFormatter(formatter *Formatter) {
+	om.formatter = formatter
+}
+
+// Get returns the value of the key.
+func (om *OrderedMapImpl) Get(key string) (string, bool) {
+	om.rlock()
+	defer om.mu.RUnlock()
+	found, ok := om.items.Get(key)
+	return found.value, ok
+}
+
+// OnMutation sets the listener notified about every change of the map, nil removes it.
+func (om *OrderedMapImpl) OnMutation(listener MutationListener) {
+	om.lock()
+	om.mutationListener = listener
+	om.mu.Unlock()
+}
+
+// ExecuteCommand executes the command and writes out its result.
+// The returned error means the result could not be written, the command itself is executed anyway.
+func (om *OrderedMapImpl) ExecuteCommand(cmd *shared.Command) error {
 	switch cmd.Action {
 	case shared.AddItem:
-		om.mu.Lock()
+		om.lock()
 		// There was no explicit clarification on how do we handle the duplicate keys entries
 		// and how we treat the order in that case, so let's just override the value and keep the initial order
-		existingEntry, ok := om.items[cmd.Key]
+		existingEntry, ok := om.items.Get(cmd.Key)
 		if ok {
-			existingEntry.value = cmd.Value
+			om.replace(existingEntry, cmd.Value)
 		} else {
-			newEntry := &entry{key: cmd.Key, value: cmd.Value}
-			if om.head == nil {
-				// First entry
-				om.head = newEntry
-			} else {
-				om.tail.next = newEntry
-				newEntry.prev = om.tail
-			}
-			om.tail = newEntry
-			om.items[cmd.Key] = newEntry
+			om.append(cmd.Key, cmd.Value)
 		}
 		om.mu.Unlock()
 		if ok {
-			om.fileWriter.Write(fmt.Sprintf("AddItem: Replaced item successfully. Key: %s, Value: %s\n", cmd.Key, cmd.Value))
+			return om.output(Result{Action: "AddItem", Outcome: OutcomeReplaced, Key: cmd.Key, Value: cmd.Value})
 		} else {
-			om.fileWriter.Write(fmt.Sprintf("AddItem: Added item successfully. Key: %s, Value: %s\n", cmd.Key, cmd.Value))
+			return om.output(Result{Action: "AddItem", Outcome: OutcomeAdded, Key: cmd.Key, Value: cmd.Value})
 		}
 	case shared.DeleteItem:
-		om.mu.Lock()
-		entry, ok := om.items[cmd.Key]
-		if ok {
-			if entry.prev != nil {
-				entry.prev.next = entry.next
-			} else {
-				// Head element
-				om.head = entry.next
-			}
-
-			if entry.next != nil {
-				entry.next.prev = entry.prev
-			} else {
-				// Tail element
-				om.tail = entry.prev
-			}
-
-			delete(om.items, cmd.Key)
-		}
+		om.lock()
+		_, ok := om.delete(cmd.Key)
 		om.mu.Unlock()
 		if ok {
-			om.fileWriter.Write(fmt.Sprintf("DeleteItem: Deleted item successfully. Key: %s\n", cmd.Key))
+			return om.output(Result{Action: "DeleteItem", Outcome: OutcomeDeleted, Key: cmd.Key})
 		} else {
-			om.fileWriter.Write(fmt.Sprintf("DeleteItem: Key %s not found\n", cmd.Key))
+			return om.output(Result{Action: "DeleteItem", Outcome: OutcomeNotFound, Key: cmd.Key})
 		}
 	case shared.GetItem:
-		om.mu.RLock()
-		entry, ok := om.items[cmd.Key]
+		om.rlock()
+		entry, ok := om.items.Get(cmd.Key)
 		om.mu.RUnlock()
 		if ok {
 			// Having access to the position here will compromise the O(1) complexity condition
 			// forcing us to iterate over keys or keep the index of position which will have to be updated
 			// on each `add` or `delete` on all entries as well.
-			om.fileWriter.Write(fmt.Sprintf("GetItem: Key: %s, Value: %s\n", cmd.Key, entry.value))
+			return om.output(Result{Action: "GetItem", Outcome: OutcomeFound, Key: cmd.Key, Value: entry.value})
 		} else {
-			om.fileWriter.Write(fmt.Sprintf("GetItem: Key %s not found\n", cmd.Key))
+			return om.output(Result{Action: "GetItem", Outcome: OutcomeNotFound, Key: cmd.Key})
 		}
 	case shared.GetAllItems:
-		om.mu.RLock()
+		// Writing out may take long, the snapshot lets the writers go on meanwhile
+		snapshot := om.Snapshot()
+		defer snapshot.Release()
 		var position int
-		current := om.head
-		for current != nil {
-			om.fileWriter.Write(fmt.Sprintf("GetAllItems: Position: %d, Key: %s, Value: %s\n", position, current.key, current.value))
+		for key, value := range snapshot.All() {
+			if err := om.output(Result{Action: "GetAllItems", Outcome: OutcomeItem, Position: position, Key: key, Value: value}); err != nil {
+				return err
+			}
 			position++
-			current = current.next
 		}
 		if position == 0 {
-			om.fileWriter.Write(fmt.Sprintf("GetAllItems: Empty map\n"))
+			return om.output(Result{Action: "GetAllItems", Outcome: OutcomeEmpty})
+		}
+		return nil
+	case shared.PopFront, shared.PopBack:
+		om.lock()
+		entry := om.pop(cmd.Action == shared.PopFront)
+		om.mu.Unlock()
+		return om.writeEntry(cmd.Action, entry)
+	case shared.PeekFront, shared.PeekBack:
+		om.rlock()
+		element := om.items.Back()
+		if cmd.Action == shared.PeekFront {
+			element = om.items.Front()
+		}
+		// Copy while under the lock, the entry value may be replaced right after
+		var peeked *entry
+		if element != nil {
+			value := element.Value
+			peeked = &value
+		}
+		om.mu.RUnlock()
+		return om.writeEntry(cmd.Action, peeked)
+	case shared.BlockingPopFront:
+		timeout := defaultBlockingPopTimeout
+		if cmd.Timeout != "" {
+			parsed, err := time.ParseDuration(cmd.Timeout)
+			if err != nil {
+				return om.output(Result{Action: "BlockingPopFront", Outcome: OutcomeInvalidTimeout, Timeout: cmd.Timeout})
+			}
+			timeout = parsed
+		}
+		entry, waited := om.blockingPopFront(timeout)
+		if !waited {
+			return om.output(Result{Action: "BlockingPopFront", Outcome: OutcomeFailed, Error: "Too many blocking pops waiting, try again later"})
+		}
+		if entry == nil && om.isDropped() {
+			return om.output(Result{Action: "BlockingPopFront", Outcome: OutcomeFailed, Error: "Map was dropped while waiting"})
+		}
+		if entry == nil {
+			return om.output(Result{Action: "BlockingPopFront", Outcome: OutcomeTimedOut, Timeout: timeout.String()})
+		}
+		return om.writeEntry(cmd.Action, entry)
+	case shared.Increment, shared.Decrement:
+		delta := int64(1)
+		if cmd.Value != "" {
+			parsed, err := strconv.ParseInt(cmd.Value, 10, 64)
+			if err != nil {
+				return om.output(Result{Action: actionName(cmd.Action), Outcome: OutcomeFailed, Key: cmd.Key, Error: fmt.Sprintf("Delta %s is not an integer", cmd.Value)})
+			}
+			delta = parsed
+		}
+		if cmd.Action == shared.Decrement {
+			if delta == math.MinInt64 {
+				return om.output(Result{Action: actionName(cmd.Action), Outcome: OutcomeFailed, Key: cmd.Key, Error: fmt.Sprintf("Delta %s is out of range", cmd.Value)})
+			}
+			delta = -delta
+		}
+		_, _, value, err := om.update(cmd.Key, func(old string, exists bool) (string, error) {
+			// Missing keys start from zero
+			current := int64(0)
+			if exists {
+				parsed, err := strconv.ParseInt(old, 10, 64)
+				if err != nil {
+					return "", fmt.Errorf("Value of key %s is not an integer", cmd.Key)
+				}
+				current = parsed
+			}
+			if (delta > 0 && current > math.MaxInt64-delta) || (delta < 0 && current < math.MinInt64-delta) {
+				return "", fmt.Errorf("Value of key %s would overflow", cmd.Key)
+			}
+			return strconv.FormatInt(current+delta, 10), nil
+		})
+		if err != nil {
+			return om.output(Result{Action: actionName(cmd.Action), Outcome: OutcomeFailed, Key: cmd.Key, Error: err.Error()})
+		}
+		return om.output(Result{Action: actionName(cmd.Action), Outcome: OutcomeUpdated, Key: cmd.Key, Value: value})
+	case shared.Append, shared.Prepend:
+		_, _, value, _ := om.update(cmd.Key, func(old string, _ bool) (string, error) {
+			if cmd.Action == shared.Append {
+				return old + cmd.Value, nil
+			}
+			return cmd.Value + old, nil
+		})
+		return om.output(Result{Action: actionName(cmd.Action), Outcome: OutcomeUpdated, Key: cmd.Key, Value: value})
+	case shared.GetAndSet:
+		old, existed, _, _ := om.update(cmd.Key, func(string, bool) (string, error) {
+			return cmd.Value, nil
+		})
+		if existed {
+			return om.output(Result{Action: "GetAndSet", Outcome: OutcomeReplaced, Key: cmd.Key, OldValue: old, Value: cmd.Value})
+		} else {
+			return om.output(Result{Action: "GetAndSet", Outcome: OutcomeAdded, Key: cmd.Key, Value: cmd.Value})
+		}
+	case shared.GetByPrefix, shared.GetByGlob, shared.GetByRegex, shared.GetByValue:
+		entries, err := om.query(cmd)
+		if err != nil {
+			return om.output(Result{Action: actionName(cmd.Action), Outcome: OutcomeFailed, Key: cmd.Key, Error: err.Error()})
 		}
+		for _, found := range entries {
+			if err := om.output(Result{Action: actionName(cmd.Action), Outcome: OutcomeItem, Key: found.key, Value: found.value}); err != nil {
+				return err
+			}
+		}
+		if len(entries) == 0 {
+			return om.output(Result{Action: actionName(cmd.Action), Outcome: OutcomeNoMatch})
+		}
+		return nil
+	case shared.Count:
+		return om.output(Result{Action: "Count", Outcome: OutcomeResult, Key: cmd.Key, Count: om.count(cmd.Key)})
+	case shared.Exists:
+		om.rlock()
+		_, ok := om.items.Get(cmd.Key)
 		om.mu.RUnlock()
+		return om.output(Result{Action: "Exists", Outcome: OutcomeResult, Key: cmd.Key, Exists: ok})
 	default:
-		om.fileWriter.Write(fmt.Sprintf("Action: %s, is not supported\n", cmd.Action))
+		return om.output(Result{Action: actionName(cmd.Action), Command: cmd.Action.String(), Outcome: OutcomeUnsupported})
 	}
 }
 
+// append adds a new entry to the tail and wakes up the blocking pops.
+// Must be called with the write lock held.
+func (om *OrderedMapImpl) append(key, value string) {
+	om.items.Set(key, entry{key: key, value: value, seq: om.nextSeq})
+	om.nextSeq++
+	om.index.insert(key)
+	close(om.itemAdded)
+	om.itemAdded = make(chan struct{})
+	om.mutated(Mutation{Op: MutationInsert, Key: key, NewValue: value})
+}
+
+// replace sets the new value of the existing entry keeping its position.
+// Must be called with the write lock held.
+func (om *OrderedMapImpl) replace(existingEntry entry, value string) {
+	om.items.Set(existingEntry.key, entry{key: existingEntry.key, value: value, seq: existingEntry.seq})
+	om.mutated(Mutation{Op: MutationUpdate, Key: existingEntry.key, OldValue: existingEntry.value, NewValue: value})
+}
+
+// mutated bumps the version and passes the mutation stamped with it to the listener, if any.
+// The snapshot of the previous version is not shared with the new readers anymore.
+// Must be called with the write lock held.
+func (om *OrderedMapImpl) mutated(mutation Mutation) {
+	om.invalidateSnapshot()
+	om.version++
+	mutation.Version = om.version
+	if om.mutationListener != nil {
+		om.mutationListener(mutation)
+	}
+}
+
+// update atomically replaces the value of the key with the one computed from the current value.
+// Existing keys keep their position, missing ones are added to the tail. Nothing changes if fn fails.
+func (om *OrderedMapImpl) update(key string, fn func(old string, exists bool) (string, error)) (old string, existed bool, value string, err error) {
+	om.lock()
+	defer om.mu.Unlock()
+	existingEntry, existed := om.items.Get(key)
+	if existed {
+		old = existingEntry.value
+	}
+	value, err = fn(old, existed)
+	if err != nil {
+		return old, existed, "", err
+	}
+	if existed {
+		om.replace(existingEntry, value)
+	} else {
+		om.append(key, value)
+	}
+	return old, existed, value, nil
+}
+
+// delete removes the key from both the map and the index.
+// Must be called with the write lock held.
+func (om *OrderedMapImpl) delete(key string) (entry, bool) {
+	deleted, ok := om.items.Delete(key)
+	if ok {
+		om.index.remove(key)
+		om.mutated(Mutation{Op: MutationDelete, Key: key, OldValue: deleted.value})
+	}
+	return deleted, ok
+}
+
+// pop removes and returns the head or the tail entry, nil on empty map.
+// Must be called with the write lock held.
+func (om *OrderedMapImpl) pop(front bool) *entry {
+	element := om.items.Back()
+	if front {
+		element = om.items.Front()
+	}
+	if element == nil {
+		return nil
+	}
+	popped, _ := om.delete(element.Key)
+	return &popped
+}
+
+// count returns the number of the keys with the prefix, all of them if it is empty.
+func (om *OrderedMapImpl) count(prefix string) int {
+	om.rlock()
+	defer om.mu.RUnlock()
+	if prefix == "" {
+		return om.items.Len()
+	}
+	count := 0
+	om.index.ascendPrefix(prefix, func(string) { count++ })
+	return count
+}
+
+// blockingPopFront waits up to timeout for the map to become non-empty and pops its head.
+// Returns nil if nothing showed up in time, and false if the map is empty and too many pops wait already.
+func (om *OrderedMapImpl) blockingPopFront(timeout time.Duration) (*entry, bool) {
+	var timer *time.Timer
+	for {
+		om.lock()
+		entry := om.pop(true)
+		itemAdded := om.itemAdded
+		om.mu.Unlock()
+		if entry != nil {
+			return entry, true
+		}
+		if timer == nil {
+			// The waiting pop holds its worker, so only that many may wait at once
+			select {
+			case om.blockingPops <- struct{}{}:
+				defer func() { <-om.blockingPops }()
+			default:
+				if om.blockingPops != nil {
+					return nil, false
+				}
+			}
+			timer = time.NewTimer(timeout)
+			defer timer.Stop()
+		}
+		// Another waiter may grab the new item first, in that case we just keep waiting
+		select {
+		case <-itemAdded:
+		case <-om.dropped:
+			return nil, true
+		case <-timer.C:
+			return nil, true
+		}
+	}
+}
+
+// isDropped reports if the map was dropped from its registry.
+func (om *OrderedMapImpl) isDropped() bool {
+	select {
+	case <-om.dropped:
+		return true
+	default:
+		return false
+	}
+}
+
+func (om *OrderedMapImpl) output(result Result) error {
+	return writeResult(om.fileWriter, om.formatter, result)
+}
+
+// writeEntry outputs the result of the pop/peek actions.
+func (om *OrderedMapImpl) writeEntry(action shared.ActionType, entry *entry) error {
+	name := actionName(action)
+	if entry != nil {
+		return om.output(Result{Action: name, Outcome: OutcomeFound, Key: entry.key, Value: entry.value})
+	} else {
+		return om.output(Result{Action: name, Outcome: OutcomeEmpty})
+	}
+}
+
+// actionName is the action as it is shown in the output, e.g. PopFront
+func actionName(action shared.ActionType) string {
+	return strings.ToUpper(action.String()[:1]) + action.String()[1:]
+}
+
 type OrderedMap interface {
-	ExecuteCommand(cmd *shared.Command)
+	ExecuteCommand(cmd *shared.Command) error
 }
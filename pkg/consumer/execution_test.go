@@ -1,18 +1,25 @@
 package consumer
 
 import (
+	"errors"
 	rand "github.com/dchest/uniuri"
 	"github.com/kgara/cmdhandler/pkg/shared"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"testing"
+	"time"
 )
 
 type FileWriterMock struct {
 	mock.Mock
 }
 
-func (m *FileWriterMock) Write(content string) {
-	m.Called(content)
+func (m *FileWriterMock) Write(content string) error {
+	args := m.Called(content)
+	if len(args) > 0 {
+		return args.Error(0)
+	}
+	return nil
 }
 
 func initialize() (*FileWriterMock, *OrderedMapImpl) {
@@ -445,10 +452,265 @@ func TestExecuteCommandNotSupported(t *testing.T) {
 	fileWriterMock, om := initialize()
 
 	cmd := &shared.Command{
-		Action: 13,
+		Action: 113,
 		Key:    rand.New(),
 		Value:  rand.New(),
 	}
-	fileWriterMock.On("Write", "Action: unknownAction: 13, is not supported\n").Once()
+	fileWriterMock.On("Write", "Action: unknownAction: 113, is not supported\n").Once()
 	om.ExecuteCommand(cmd)
 }
+
+func TestExecuteCommandPopFrontAndBack(t *testing.T) {
+	fileWriterMock, om := initialize()
+
+	for _, key := range []string{"key1", "key2", "key3"} {
+		fileWriterMock.On("Write", mock.Anything).Once()
+		om.ExecuteCommand(&shared.Command{Action: shared.AddItem, Key: key, Value: "value-" + key})
+	}
+
+	fileWriterMock.On("Write", "PopFront: Key: key1, Value: value-key1\n").Once()
+	om.ExecuteCommand(&shared.Command{Action: shared.PopFront})
+
+	fileWriterMock.On("Write", "PopBack: Key: key3, Value: value-key3\n").Once()
+	om.ExecuteCommand(&shared.Command{Action: shared.PopBack})
+
+	fileWriterMock.On("Write", "GetAllItems: Position: 0, Key: key2, Value: value-key2\n").Once()
+	om.ExecuteCommand(&shared.Command{Action: shared.GetAllItems})
+
+	fileWriterMock.On("Write", "PopBack: Key: key2, Value: value-key2\n").Once()
+	om.ExecuteCommand(&shared.Command{Action: shared.PopBack})
+
+	fileWriterMock.On("Write", "PopFront: Empty map\n").Once()
+	om.ExecuteCommand(&shared.Command{Action: shared.PopFront})
+
+	fileWriterMock.On("Write", "GetAllItems: Empty map\n").Once()
+	om.ExecuteCommand(&shared.Command{Action: shared.GetAllItems})
+
+	fileWriterMock.AssertExpectations(t)
+}
+
+func TestExecuteCommandPeekFrontAndBack(t *testing.T) {
+	fileWriterMock, om := initialize()
+
+	fileWriterMock.On("Write", "PeekFront: Empty map\n").Once()
+	om.ExecuteCommand(&shared.Command{Action: shared.PeekFront})
+
+	for _, key := range []string{"key1", "key2"} {
+		fileWriterMock.On("Write", mock.Anything).Once()
+		om.ExecuteCommand(&shared.Command{Action: shared.AddItem, Key: key, Value: "value-" + key})
+	}
+
+	fileWriterMock.On("Write", "PeekFront: Key: key1, Value: value-key1\n").Twice()
+	om.ExecuteCommand(&shared.Command{Action: shared.PeekFront})
+	om.ExecuteCommand(&shared.Command{Action: shared.PeekFront})
+
+	fileWriterMock.On("Write", "PeekBack: Key: key2, Value: value-key2\n").Once()
+	om.ExecuteCommand(&shared.Command{Action: shared.PeekBack})
+
+	fileWriterMock.AssertExpectations(t)
+}
+
+func TestExecuteCommandBlockingPopFrontWaitsForItem(t *testing.T) {
+	fileWriterMock, om := initialize()
+
+	fileWriterMock.On("Write", "AddItem: Added item successfully. Key: testKey, Value: testValue\n").Once()
+	fileWriterMock.On("Write", "BlockingPopFront: Key: testKey, Value: testValue\n").Once()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		om.ExecuteCommand(&shared.Command{Action: shared.BlockingPopFront, Timeout: "5s"})
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	om.ExecuteCommand(&shared.Command{Action: shared.AddItem, Key: "testKey", Value: "testValue"})
+	<-done
+
+	fileWriterMock.AssertExpectations(t)
+}
+
+func TestExecuteCommandBlockingPopFrontTimeout(t *testing.T) {
+	fileWriterMock, om := initialize()
+
+	fileWriterMock.On("Write", "BlockingPopFront: Timed out after 10ms\n").Once()
+	om.ExecuteCommand(&shared.Command{Action: shared.BlockingPopFront, Timeout: "10ms"})
+
+	fileWriterMock.On("Write", "BlockingPopFront: Invalid timeout soon\n").Once()
+	om.ExecuteCommand(&shared.Command{Action: shared.BlockingPopFront, Timeout: "soon"})
+
+	fileWriterMock.AssertExpectations(t)
+}
+
+func TestExecuteCommandIncrementDecrement(t *testing.T) {
+	fileWriterMock, om := initialize()
+
+	fileWriterMock.On("Write", "Increment: Key: counter, Value: 1\n").Once()
+	om.ExecuteCommand(&shared.Command{Action: shared.Increment, Key: "counter"})
+
+	fileWriterMock.On("Write", "Increment: Key: counter, Value: 11\n").Once()
+	om.ExecuteCommand(&shared.Command{Action: shared.Increment, Key: "counter", Value: "10"})
+
+	fileWriterMock.On("Write", "Decrement: Key: counter, Value: 8\n").Once()
+	om.ExecuteCommand(&shared.Command{Action: shared.Decrement, Key: "counter", Value: "3"})
+
+	fileWriterMock.On("Write", "Decrement: Delta abc is not an integer\n").Once()
+	om.ExecuteCommand(&shared.Command{Action: shared.Decrement, Key: "counter", Value: "abc"})
+
+	fileWriterMock.On("Write", mock.Anything).Once()
+	om.ExecuteCommand(&shared.Command{Action: shared.AddItem, Key: "text", Value: "abc"})
+
+	fileWriterMock.On("Write", "Increment: Value of key text is not an integer\n").Once()
+	om.ExecuteCommand(&shared.Command{Action: shared.Increment, Key: "text"})
+
+	fileWriterMock.On("Write", mock.Anything).Once()
+	om.ExecuteCommand(&shared.Command{Action: shared.AddItem, Key: "big", Value: "9223372036854775807"})
+
+	fileWriterMock.On("Write", "Increment: Value of key big would overflow\n").Once()
+	om.ExecuteCommand(&shared.Command{Action: shared.Increment, Key: "big"})
+
+	// Failed mutations do not touch the values, successful ones keep the position
+	fileWriterMock.On("Write", "GetAllItems: Position: 0, Key: counter, Value: 8\n").Once()
+	fileWriterMock.On("Write", "GetAllItems: Position: 1, Key: text, Value: abc\n").Once()
+	fileWriterMock.On("Write", "GetAllItems: Position: 2, Key: big, Value: 9223372036854775807\n").Once()
+	om.ExecuteCommand(&shared.Command{Action: shared.GetAllItems})
+
+	fileWriterMock.AssertExpectations(t)
+}
+
+func TestExecuteCommandAppendPrepend(t *testing.T) {
+	fileWriterMock, om := initialize()
+
+	fileWriterMock.On("Write", "Append: Key: key1, Value: b\n").Once()
+	om.ExecuteCommand(&shared.Command{Action: shared.Append, Key: "key1", Value: "b"})
+
+	fileWriterMock.On("Write", mock.Anything).Once()
+	om.ExecuteCommand(&shared.Command{Action: shared.AddItem, Key: "key2", Value: "value2"})
+
+	fileWriterMock.On("Write", "Append: Key: key1, Value: bc\n").Once()
+	om.ExecuteCommand(&shared.Command{Action: shared.Append, Key: "key1", Value: "c"})
+
+	fileWriterMock.On("Write", "Prepend: Key: key1, Value: abc\n").Once()
+	om.ExecuteCommand(&shared.Command{Action: shared.Prepend, Key: "key1", Value: "a"})
+
+	fileWriterMock.On("Write", "GetAllItems: Position: 0, Key: key1, Value: abc\n").Once()
+	fileWriterMock.On("Write", "GetAllItems: Position: 1, Key: key2, Value: value2\n").Once()
+	om.ExecuteCommand(&shared.Command{Action: shared.GetAllItems})
+
+	fileWriterMock.AssertExpectations(t)
+}
+
+func TestExecuteCommandGetAndSet(t *testing.T) {
+	fileWriterMock, om := initialize()
+
+	fileWriterMock.On("Write", "GetAndSet: Key testKey not found, added with Value: value1\n").Once()
+	om.ExecuteCommand(&shared.Command{Action: shared.GetAndSet, Key: "testKey", Value: "value1"})
+
+	fileWriterMock.On("Write", "GetAndSet: Key: testKey, Old value: value1, Value: value2\n").Once()
+	om.ExecuteCommand(&shared.Command{Action: shared.GetAndSet, Key: "testKey", Value: "value2"})
+
+	fileWriterMock.On("Write", "GetItem: Key: testKey, Value: value2\n").Once()
+	om.ExecuteCommand(&shared.Command{Action: shared.GetItem, Key: "testKey"})
+
+	fileWriterMock.AssertExpectations(t)
+}
+
+func addItems(fileWriterMock *FileWriterMock, om *OrderedMapImpl, keyValues ...string) {
+	for i := 0; i < len(keyValues); i += 2 {
+		fileWriterMock.On("Write", mock.Anything).Once()
+		om.ExecuteCommand(&shared.Command{Action: shared.AddItem, Key: keyValues[i], Value: keyValues[i+1]})
+	}
+}
+
+func TestExecuteCommandGetByPrefix(t *testing.T) {
+	fileWriterMock, om := initialize()
+	addItems(fileWriterMock, om, "user/2", "bob", "group/1", "admins", "user/1", "alice", "user/3", "carol")
+
+	fileWriterMock.On("Write", mock.Anything).Once()
+	om.ExecuteCommand(&shared.Command{Action: shared.DeleteItem, Key: "user/3"})
+
+	// Insertion order, not the key order
+	fileWriterMock.On("Write", "GetByPrefix: Key: user/2, Value: bob\n").Once()
+	fileWriterMock.On("Write", "GetByPrefix: Key: user/1, Value: alice\n").Once()
+	om.ExecuteCommand(&shared.Command{Action: shared.GetByPrefix, Key: "user/"})
+
+	fileWriterMock.On("Write", "GetByPrefix: No items found\n").Once()
+	om.ExecuteCommand(&shared.Command{Action: shared.GetByPrefix, Key: "host/"})
+
+	fileWriterMock.AssertExpectations(t)
+}
+
+func TestExecuteCommandGetByGlobAndRegex(t *testing.T) {
+	fileWriterMock, om := initialize()
+	addItems(fileWriterMock, om, "key10", "a", "key2", "b", "other1", "c")
+
+	fileWriterMock.On("Write", "GetByGlob: Key: key2, Value: b\n").Once()
+	om.ExecuteCommand(&shared.Command{Action: shared.GetByGlob, Key: "key?"})
+
+	fileWriterMock.On("Write", "GetByGlob: Pattern [ is not valid\n").Once()
+	om.ExecuteCommand(&shared.Command{Action: shared.GetByGlob, Key: "["})
+
+	fileWriterMock.On("Write", "GetByRegex: Key: key10, Value: a\n").Once()
+	fileWriterMock.On("Write", "GetByRegex: Key: other1, Value: c\n").Once()
+	om.ExecuteCommand(&shared.Command{Action: shared.GetByRegex, Key: "^(key1|other)"})
+
+	fileWriterMock.On("Write", "GetByRegex: Pattern ( is not valid\n").Once()
+	om.ExecuteCommand(&shared.Command{Action: shared.GetByRegex, Key: "("})
+
+	fileWriterMock.AssertExpectations(t)
+}
+
+func TestExecuteCommandGetByValue(t *testing.T) {
+	fileWriterMock, om := initialize()
+	addItems(fileWriterMock, om, "price/a", "9", "price/b", "10", "name", "10 apples")
+
+	fileWriterMock.On("Write", "GetByValue: Key: price/b, Value: 10\n").Once()
+	om.ExecuteCommand(&shared.Command{Action: shared.GetByValue, Key: "price/", Value: "> 9"})
+
+	fileWriterMock.On("Write", "GetByValue: Key: name, Value: 10 apples\n").Once()
+	om.ExecuteCommand(&shared.Command{Action: shared.GetByValue, Value: "contains apples"})
+
+	fileWriterMock.On("Write", "GetByValue: Predicate operator ~ is not supported\n").Once()
+	om.ExecuteCommand(&shared.Command{Action: shared.GetByValue, Value: "~ x"})
+
+	fileWriterMock.On("Write", "GetByValue: Predicate empty is not valid\n").Once()
+	om.ExecuteCommand(&shared.Command{Action: shared.GetByValue, Value: "empty"})
+
+	fileWriterMock.AssertExpectations(t)
+}
+
+func TestExecuteCommandCountAndExists(t *testing.T) {
+	fileWriterMock, om := initialize()
+	addItems(fileWriterMock, om, "a/1", "x", "a/2", "y", "b/1", "z")
+
+	fileWriterMock.On("Write", "Count: Prefix: , Count: 3\n").Once()
+	om.ExecuteCommand(&shared.Command{Action: shared.Count})
+
+	fileWriterMock.On("Write", "Count: Prefix: a/, Count: 2\n").Once()
+	om.ExecuteCommand(&shared.Command{Action: shared.Count, Key: "a/"})
+
+	fileWriterMock.On("Write", "Exists: Key: b/1, Exists: true\n").Once()
+	om.ExecuteCommand(&shared.Command{Action: shared.Exists, Key: "b/1"})
+
+	fileWriterMock.On("Write", "Exists: Key: b/2, Exists: false\n").Once()
+	om.ExecuteCommand(&shared.Command{Action: shared.Exists, Key: "b/2"})
+
+	fileWriterMock.AssertExpectations(t)
+}
+
+func TestExecuteCommandReturnsWriteError(t *testing.T) {
+	fileWriterMock, om := initialize()
+	addItems(fileWriterMock, om, "key1", "value1", "key2", "value2")
+
+	diskFull := errors.New("disk full")
+	fileWriterMock.On("Write", "AddItem: Added item successfully. Key: key3, Value: value3\n").Return(diskFull).Once()
+	assert.Equal(t, diskFull, om.ExecuteCommand(&shared.Command{Action: shared.AddItem, Key: "key3", Value: "value3"}))
+
+	// The rest of the listing is not written once a line fails
+	fileWriterMock.On("Write", "GetAllItems: Position: 0, Key: key1, Value: value1\n").Return(diskFull).Once()
+	assert.Equal(t, diskFull, om.ExecuteCommand(&shared.Command{Action: shared.GetAllItems}))
+
+	fileWriterMock.On("Write", "GetItem: Key: key3, Value: value3\n").Once()
+	assert.NoError(t, om.ExecuteCommand(&shared.Command{Action: shared.GetItem, Key: "key3"}))
+
+	fileWriterMock.AssertExpectations(t)
+}
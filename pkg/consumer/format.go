@@ -0,0 +1,293 @@
+package consumer
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Outcomes of the commands, the second part of the template names
+const (
+	OutcomeAdded            = "added"
+	OutcomeReplaced         = "replaced"
+	OutcomeDeleted          = "deleted"
+	OutcomeFound            = "found"
+	OutcomeNotFound         = "notFound"
+	OutcomeItem             = "item"
+	OutcomeEmpty            = "empty"
+	OutcomeNoMatch          = "noMatch"
+	OutcomeUpdated          = "updated"
+	OutcomeResult           = "result"
+	OutcomeTimedOut         = "timedOut"
+	OutcomeInvalidTimeout   = "invalidTimeout"
+	OutcomeFailed           = "failed"
+	OutcomeCreated          = "created"
+	OutcomeExists           = "exists"
+	OutcomeDropped          = "dropped"
+	OutcomeWatched          = "watched"
+	OutcomeUnwatched        = "unwatched"
+	OutcomeUnsupported      = "unsupported"
+	OutcomeInvalidNamespace = "invalidNamespace"
+)
+
+// Result describes a single output line of a command, the output templates are executed with it.
+// Only the fields making sense for the action and outcome are set.
+type Result struct {
+	// Action is the action name, e.g. AddItem
+	Action string
+	// Command is the action as it came in the command, e.g. addItem. Differs from Action for the unknown actions only
+	Command string
+	// Outcome is one of the Outcome constants
+	Outcome string
+	// Namespace is set by the map management commands, the other lines get it from NamespacedWriter
+	Namespace string
+	Key       string
+	Value     string
+	OldValue  string
+	// Position is the position of the item in the listing
+	Position int
+	Count    int
+	Exists   bool
+	Timeout  string
+	ReplyTo  string
+	// Error is the reason of the failed outcomes
+	Error string
+}
+
+// Format presets, the text one is the default
+var formatPresets = map[string]map[string]string{
+	"text": {
+		"AddItem.added":      "AddItem: Added item successfully. Key: {{.Key}}, Value: {{.Value}}",
+		"AddItem.replaced":   "AddItem: Replaced item successfully. Key: {{.Key}}, Value: {{.Value}}",
+		"DeleteItem.deleted": "DeleteItem: Deleted item successfully. Key: {{.Key}}",
+		"GetAllItems.item":   "GetAllItems: Position: {{.Position}}, Key: {{.Key}}, Value: {{.Value}}",
+		"GetAndSet.replaced": "GetAndSet: Key: {{.Key}}, Old value: {{.OldValue}}, Value: {{.Value}}",
+		"GetAndSet.added":    "GetAndSet: Key {{.Key}} not found, added with Value: {{.Value}}",
+		"Count.result":       "Count: Prefix: {{.Key}}, Count: {{.Count}}",
+		"Exists.result":      "Exists: Key: {{.Key}}, Exists: {{.Exists}}",
+		"CreateMap.created":  "CreateMap: Created map successfully. Namespace: {{.Namespace}}",
+		"CreateMap.exists":   "CreateMap: Map already exists. Namespace: {{.Namespace}}",
+		"DropMap.dropped":    "DropMap: Dropped map successfully. Namespace: {{.Namespace}}",
+		"DropMap.notFound":   "DropMap: Namespace {{.Namespace}} not found",
+		"ListMaps.item":      "ListMaps: Position: {{.Position}}, Namespace: {{.Namespace}}",
+		"Watch.watched":      "Watch: Key: {{.Key}}, ReplyTo: {{.ReplyTo}}, Expires in: {{.Timeout}}",
+		"Unwatch.unwatched":  "Unwatch: Key: {{.Key}}, ReplyTo: {{.ReplyTo}}",
+		"Unwatch.notFound":   "Unwatch: Watch of key {{.Key}} for {{.ReplyTo}} not found",
+		"*.found":            "{{.Action}}: Key: {{.Key}}, Value: {{.Value}}",
+		"*.notFound":         "{{.Action}}: Key {{.Key}} not found",
+		"*.item":             "{{.Action}}: Key: {{.Key}}, Value: {{.Value}}",
+		"*.updated":          "{{.Action}}: Key: {{.Key}}, Value: {{.Value}}",
+		"*.empty":            "{{.Action}}: Empty map",
+		"*.noMatch":          "{{.Action}}: No items found",
+		"*.timedOut":         "{{.Action}}: Timed out after {{.Timeout}}",
+		"*.invalidTimeout":   "{{.Action}}: Invalid timeout {{.Timeout}}",
+		"*.failed":           "{{.Action}}: {{.Error}}",
+		"*.unsupported":      "Action: {{.Command}}, is not supported",
+		"*.invalidNamespace": `{{.Command}}: Namespace {{printf "%q" .Namespace}} is not valid`,
+	},
+	"csv": {
+		"*.*": "{{csv .Action .Outcome .Namespace .Key .Value .OldValue .Position .Count .Exists .Timeout .ReplyTo .Error}}",
+	},
+	"logfmt": {
+		"*.*":              `{{logfmt "action" .Action "outcome" .Outcome "namespace" .Namespace "key" .Key "value" .Value "old_value" .OldValue "timeout" .Timeout "reply_to" .ReplyTo "error" .Error}}`,
+		"GetAllItems.item": `{{logfmt "action" .Action "outcome" .Outcome "position" .Position "key" .Key "value" .Value}}`,
+		"ListMaps.item":    `{{logfmt "action" .Action "outcome" .Outcome "position" .Position "namespace" .Namespace}}`,
+		"Count.result":     `{{logfmt "action" .Action "outcome" .Outcome "prefix" .Key "count" .Count}}`,
+		"Exists.result":    `{{logfmt "action" .Action "outcome" .Outcome "key" .Key "exists" .Exists}}`,
+	},
+}
+
+var templateFuncs = template.FuncMap{
+	"csv":    csvLine,
+	"logfmt": logfmtLine,
+}
+
+// FormatPresets returns the names of the built-in presets.
+func FormatPresets() []string {
+	names := make([]string, 0, len(formatPresets))
+	for name := range formatPresets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Formatter turns the results into the output lines using the text/template templates named
+// "Action.outcome", e.g. "AddItem.added". The template is looked up by the exact name first,
+// then by "*.outcome", "Action.*" and finally "*.*". The lines get the trailing newline added.
+type Formatter struct {
+	templates map[string]*template.Template
+	// The text preset lines are human readable, they get the namespace prefix and make the record messages
+	text bool
+	// Namespace sharing the output with the others, prefixing the text lines, see NamespacedWriter
+	namespace string
+}
+
+// DefaultFormatter writes the text preset.
+var DefaultFormatter = mustNewFormatter("text", nil)
+
+// NewFormatter creates the Formatter of the preset, the overrides replace or add the templates by name.
+func NewFormatter(preset string, overrides map[string]string) (*Formatter, error) {
+	presetTemplates, ok := formatPresets[preset]
+	if !ok {
+		return nil, fmt.Errorf("unknown output format %q, use one of %s", preset, strings.Join(FormatPresets(), ", "))
+	}
+	formatter := &Formatter{templates: make(map[string]*template.Template), text: preset == "text"}
+	for _, source := range []map[string]string{presetTemplates, overrides} {
+		for name, text := range source {
+			if _, _, ok := strings.Cut(name, "."); !ok {
+				return nil, fmt.Errorf("template name %q is not in the Action.outcome form", name)
+			}
+			parsed, err := template.New(name).Funcs(templateFuncs).Parse(text)
+			if err != nil {
+				return nil, err
+			}
+			// Catches the unknown fields and the like now rather than on the first matching command
+			if err := parsed.Execute(&bytes.Buffer{}, Result{}); err != nil {
+				return nil, err
+			}
+			formatter.templates[name] = parsed
+		}
+	}
+	return formatter, nil
+}
+
+// LoadFormatter creates the Formatter of the preset with the overrides read from the JSON file
+// mapping the template names to the templates. An empty file name means no overrides.
+func LoadFormatter(preset, templatesFileName string) (*Formatter, error) {
+	var overrides map[string]string
+	if templatesFileName != "" {
+		content, err := os.ReadFile(templatesFileName)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(content, &overrides); err != nil {
+			return nil, fmt.Errorf("templates file %s: %w", templatesFileName, err)
+		}
+	}
+	return NewFormatter(preset, overrides)
+}
+
+func mustNewFormatter(preset string, overrides map[string]string) *Formatter {
+	formatter, err := NewFormatter(preset, overrides)
+	if err != nil {
+		panic(err)
+	}
+	return formatter
+}
+
+// Format returns the output line of the result.
+func (f *Formatter) Format(result Result) (string, error) {
+	if result.Command == "" {
+		result.Command = result.Action
+	}
+	for _, name := range []string{result.Action + "." + result.Outcome, "*." + result.Outcome, result.Action + ".*", "*.*"} {
+		if tmpl, ok := f.templates[name]; ok {
+			var line strings.Builder
+			if err := tmpl.Execute(&line, result); err != nil {
+				return "", err
+			}
+			line.WriteString("\n")
+			if f.text && f.namespace != "" {
+				return fmt.Sprintf("[%s] %s", f.namespace, line.String()), nil
+			}
+			return line.String(), nil
+		}
+	}
+	return "", fmt.Errorf("no output template for %s.%s", result.Action, result.Outcome)
+}
+
+// forNamespace returns the formatter of the lines of the namespace sharing the output with the others.
+func (f *Formatter) forNamespace(namespace string) *Formatter {
+	namespaced := *f
+	namespaced.namespace = namespace
+	return &namespaced
+}
+
+// Record returns the structured form of the result. Its message is the text line without the action,
+// whatever the preset of the formatter.
+func (f *Formatter) Record(result Result) (OutputRecord, error) {
+	text := DefaultFormatter
+	if f.text {
+		text = f.forNamespace("")
+	}
+	message, err := text.Format(result)
+	if err != nil {
+		return OutputRecord{}, err
+	}
+	message = strings.TrimSuffix(message, "\n")
+	for _, action := range []string{result.Action, result.Command} {
+		if trimmed, ok := strings.CutPrefix(message, action+": "); ok && action != "" {
+			message = trimmed
+			break
+		}
+	}
+	return OutputRecord{Timestamp: time.Now().UTC(), Namespace: f.namespace, Action: result.Action, Outcome: result.Outcome, Message: message}, nil
+}
+
+// ResultWriter is implemented by the writers taking the results rather than the lines formatted already,
+// to tell the namespace or to write the structured records.
+type ResultWriter interface {
+	WriteResult(formatter *Formatter, result Result) error
+}
+
+// writeResult formats the result and writes it out, nil formatter means DefaultFormatter.
+func writeResult(writer FileWriter, formatter *Formatter, result Result) error {
+	if formatter == nil {
+		formatter = DefaultFormatter
+	}
+	if resultWriter, ok := writer.(ResultWriter); ok {
+		return resultWriter.WriteResult(formatter, result)
+	}
+	line, err := formatter.Format(result)
+	if err != nil {
+		return err
+	}
+	return writer.Write(line)
+}
+
+// csvLine is the template function writing its arguments as a single CSV record without the line break.
+func csvLine(values ...any) (string, error) {
+	record := make([]string, len(values))
+	for i, value := range values {
+		record[i] = fmt.Sprint(value)
+	}
+	var line strings.Builder
+	writer := csv.NewWriter(&line)
+	if err := writer.Write(record); err != nil {
+		return "", err
+	}
+	writer.Flush()
+	return strings.TrimSuffix(line.String(), "\n"), writer.Error()
+}
+
+// logfmtLine is the template function writing the key-value pairs in the logfmt format.
+// The pairs with the empty string values are skipped.
+func logfmtLine(pairs ...any) (string, error) {
+	if len(pairs)%2 != 0 {
+		return "", fmt.Errorf("logfmt needs key-value pairs, got %d arguments", len(pairs))
+	}
+	var line strings.Builder
+	for i := 0; i < len(pairs); i += 2 {
+		value := fmt.Sprint(pairs[i+1])
+		if value == "" {
+			continue
+		}
+		if line.Len() > 0 {
+			line.WriteString(" ")
+		}
+		line.WriteString(fmt.Sprint(pairs[i]))
+		line.WriteString("=")
+		if strings.ContainsAny(value, " =\"\\\t\n") {
+			value = fmt.Sprintf("%q", value)
+		}
+		line.WriteString(value)
+	}
+	return line.String(), nil
+}
@@ -0,0 +1,104 @@
+package consumer
+
+import (
+	"github.com/kgara/cmdhandler/pkg/shared"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFormatterPresets(t *testing.T) {
+	result := Result{Action: "GetAndSet", Outcome: OutcomeReplaced, Key: "key1", OldValue: "old value", Value: "new,value"}
+
+	line, err := DefaultFormatter.Format(result)
+	assert.NoError(t, err)
+	assert.Equal(t, "GetAndSet: Key: key1, Old value: old value, Value: new,value\n", line)
+
+	csv, err := NewFormatter("csv", nil)
+	assert.NoError(t, err)
+	line, err = csv.Format(result)
+	assert.NoError(t, err)
+	assert.Equal(t, "GetAndSet,replaced,,key1,\"new,value\",old value,0,0,false,,,\n", line)
+
+	logfmt, err := NewFormatter("logfmt", nil)
+	assert.NoError(t, err)
+	line, err = logfmt.Format(result)
+	assert.NoError(t, err)
+	assert.Equal(t, "action=GetAndSet outcome=replaced key=key1 value=new,value old_value=\"old value\"\n", line)
+
+	line, err = logfmt.Format(Result{Action: "Count", Outcome: OutcomeResult, Count: 2})
+	assert.NoError(t, err)
+	assert.Equal(t, "action=Count outcome=result count=2\n", line)
+
+	_, err = NewFormatter("xml", nil)
+	assert.Error(t, err)
+}
+
+func TestFormatterOverrides(t *testing.T) {
+	formatter, err := NewFormatter("text", map[string]string{
+		"AddItem.added": "+ {{.Key}}={{.Value}}",
+		"*.failed":      "ERROR {{.Action}}: {{.Error}}",
+	})
+	assert.NoError(t, err)
+
+	line, err := formatter.Format(Result{Action: "AddItem", Outcome: OutcomeAdded, Key: "key1", Value: "value1"})
+	assert.NoError(t, err)
+	assert.Equal(t, "+ key1=value1\n", line)
+
+	line, err = formatter.Format(Result{Action: "Increment", Outcome: OutcomeFailed, Error: "Delta x is not an integer"})
+	assert.NoError(t, err)
+	assert.Equal(t, "ERROR Increment: Delta x is not an integer\n", line)
+
+	// The rest still comes from the preset
+	line, err = formatter.Format(Result{Action: "AddItem", Outcome: OutcomeReplaced, Key: "key1", Value: "value2"})
+	assert.NoError(t, err)
+	assert.Equal(t, "AddItem: Replaced item successfully. Key: key1, Value: value2\n", line)
+
+	_, err = NewFormatter("text", map[string]string{"AddItem.added": "{{.Missing}}"})
+	assert.Error(t, err)
+	_, err = NewFormatter("text", map[string]string{"AddItem": "{{.Key}}"})
+	assert.Error(t, err)
+}
+
+func TestLoadFormatter(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "templates.json")
+	assert.NoError(t, os.WriteFile(fileName, []byte(`{"*.*": "{{.Action}} {{.Outcome}}"}`), 0644))
+
+	formatter, err := LoadFormatter("csv", fileName)
+	assert.NoError(t, err)
+	line, err := formatter.Format(Result{Action: "GetItem", Outcome: OutcomeNotFound})
+	assert.NoError(t, err)
+	assert.Equal(t, "GetItem notFound\n", line)
+}
+
+func TestExecuteCommandWithFormatter(t *testing.T) {
+	fileWriterMock, om := initialize()
+	formatter, err := NewFormatter("logfmt", nil)
+	assert.NoError(t, err)
+	om.SetFormatter(formatter)
+
+	fileWriterMock.On("Write", "action=AddItem outcome=added key=key1 value=value1\n").Once()
+	om.ExecuteCommand(&shared.Command{Action: shared.AddItem, Key: "key1", Value: "value1"})
+
+	fileWriterMock.On("Write", "action=GetAllItems outcome=item position=0 key=key1 value=value1\n").Once()
+	om.ExecuteCommand(&shared.Command{Action: shared.GetAllItems})
+
+	fileWriterMock.AssertExpectations(t)
+}
+
+func TestNamespacedWriterFormats(t *testing.T) {
+	fileWriterMock := &FileWriterMock{}
+	writer := NewNamespacedWriter("orders", fileWriterMock)
+	result := Result{Action: "AddItem", Outcome: OutcomeAdded, Key: "key1", Value: "value1"}
+
+	// The namespace goes to its column, the line stays valid CSV
+	csv, err := NewFormatter("csv", nil)
+	assert.NoError(t, err)
+	fileWriterMock.On("Write", "AddItem,added,orders,key1,value1,,0,0,false,,,\n").Return(nil).Once()
+	assert.NoError(t, writeResult(writer, csv, result))
+
+	fileWriterMock.On("Write", "[orders] AddItem: Added item successfully. Key: key1, Value: value1\n").Return(nil).Once()
+	assert.NoError(t, writeResult(writer, nil, result))
+	fileWriterMock.AssertExpectations(t)
+}
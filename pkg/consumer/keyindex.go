@@ -0,0 +1,103 @@
+package consumer
+
+import (
+	"math/rand"
+	"strings"
+)
+
+const (
+	keyIndexMaxLevel = 32
+	// Chance of a node to be promoted to the next level, 1/4 gives ~1.33 pointers per node
+	keyIndexPromotion = 4
+)
+
+type keyIndexNode struct {
+	key  string
+	next []*keyIndexNode
+}
+
+// keyIndex is a skip list keeping the keys sorted, so the prefix scans do not have to walk
+// the whole insertion ordered list. Insert and remove are O(log n) on average.
+// It is not safe for concurrent use, the ordered map guards it with its own lock.
+type keyIndex struct {
+	head  *keyIndexNode
+	level int
+}
+
+func newKeyIndex() *keyIndex {
+	return &keyIndex{
+		head:  &keyIndexNode{next: make([]*keyIndexNode, keyIndexMaxLevel)},
+		level: 1,
+	}
+}
+
+// insert adds the key to the index, keys must be unique.
+func (ki *keyIndex) insert(key string) {
+	var update [keyIndexMaxLevel]*keyIndexNode
+	current := ki.head
+	for i := ki.level - 1; i >= 0; i-- {
+		for current.next[i] != nil && current.next[i].key < key {
+			current = current.next[i]
+		}
+		update[i] = current
+	}
+
+	level := randomKeyIndexLevel()
+	if level > ki.level {
+		for i := ki.level; i < level; i++ {
+			update[i] = ki.head
+		}
+		ki.level = level
+	}
+
+	node := &keyIndexNode{key: key, next: make([]*keyIndexNode, level)}
+	for i := 0; i < level; i++ {
+		node.next[i] = update[i].next[i]
+		update[i].next[i] = node
+	}
+}
+
+// remove deletes the key from the index, if it is there.
+func (ki *keyIndex) remove(key string) {
+	var update [keyIndexMaxLevel]*keyIndexNode
+	current := ki.head
+	for i := ki.level - 1; i >= 0; i-- {
+		for current.next[i] != nil && current.next[i].key < key {
+			current = current.next[i]
+		}
+		update[i] = current
+	}
+
+	node := current.next[0]
+	if node == nil || node.key != key {
+		return
+	}
+	for i := 0; i < len(node.next); i++ {
+		update[i].next[i] = node.next[i]
+	}
+	for ki.level > 1 && ki.head.next[ki.level-1] == nil {
+		ki.level--
+	}
+}
+
+// ascendPrefix calls fn for every key starting with the prefix in the ascending order.
+func (ki *keyIndex) ascendPrefix(prefix string, fn func(key string)) {
+	current := ki.head
+	for i := ki.level - 1; i >= 0; i-- {
+		for current.next[i] != nil && current.next[i].key < prefix {
+			current = current.next[i]
+		}
+	}
+
+	for node := current.next[0]; node != nil && strings.HasPrefix(node.key, prefix); node = node.next[0] {
+		fn(node.key)
+	}
+}
+
+func randomKeyIndexLevel() int {
+	level := 1
+	for level < keyIndexMaxLevel && rand.Intn(keyIndexPromotion) == 0 {
+		level++
+	}
+	return level
+}
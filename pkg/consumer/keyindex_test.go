@@ -0,0 +1,48 @@
+package consumer
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"sort"
+	"testing"
+)
+
+func collectPrefix(ki *keyIndex, prefix string) []string {
+	var keys []string
+	ki.ascendPrefix(prefix, func(key string) {
+		keys = append(keys, key)
+	})
+	return keys
+}
+
+func TestKeyIndexAscendPrefix(t *testing.T) {
+	ki := newKeyIndex()
+	for _, key := range []string{"b", "a/2", "c", "a/1", "ab", "a"} {
+		ki.insert(key)
+	}
+
+	assert.Equal(t, []string{"a", "a/1", "a/2", "ab", "b", "c"}, collectPrefix(ki, ""))
+	assert.Equal(t, []string{"a", "a/1", "a/2", "ab"}, collectPrefix(ki, "a"))
+	assert.Equal(t, []string{"a/1", "a/2"}, collectPrefix(ki, "a/"))
+	assert.Nil(t, collectPrefix(ki, "d"))
+}
+
+func TestKeyIndexRemove(t *testing.T) {
+	ki := newKeyIndex()
+	var expected []string
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key%d", i)
+		ki.insert(key)
+		if i%3 != 0 {
+			expected = append(expected, key)
+		}
+	}
+	for i := 0; i < 1000; i += 3 {
+		ki.remove(fmt.Sprintf("key%d", i))
+	}
+	// Removing missing keys is a no-op
+	ki.remove("missing")
+
+	sort.Strings(expected)
+	assert.Equal(t, expected, collectPrefix(ki, ""))
+}
@@ -3,12 +3,23 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/kgara/cmdhandler/pkg/consumer"
 	"github.com/kgara/cmdhandler/pkg/shared"
+	"github.com/prometheus/client_golang/prometheus"
 	amqp "github.com/rabbitmq/amqp091-go"
 	"github.com/urfave/cli/v2"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"log"
+	"log/slog"
+	"net/http"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 )
 
@@ -18,10 +29,52 @@ import (
 //const processingFilename = "/tmp/consumer-output.txt"
 
 type ConsumerConfig struct {
-	ampqUri            string
-	ampqQueueName      string
-	processingFileName string
-	numWorkers         int
+	ampqUri       string
+	ampqQueueName string
+	// Output specs, see consumer.OpenSink. Every line goes to all of them
+	outputs      []string
+	writerConfig consumer.FileWriterConfig
+	// Preset and the JSON file of the output templates overriding it
+	outputFormat        string
+	outputTemplatesFile string
+	formatter           *consumer.Formatter
+	syncPolicy          string
+	// Ack the deliveries only once their output is flushed and synced to the disk
+	ackAfterFlush bool
+	// fmt pattern of the per-namespace output specs, all namespaces share the processing output if empty
+	namespaceFileNamePattern string
+	numWorkers               int
+	// Change data capture is disabled if the exchange name is empty
+	cdcExchangeName  string
+	cdcStateFileName string
+	cdcBufferSize    int
+	// Admin HTTP API is disabled if the address is empty
+	adminAddr        string
+	snapshotFileName string
+	// Prometheus metrics are served on their own only if the address is set, the admin API serves them as well
+	metricsAddr   string
+	traceExporter string
+	logFormat     string
+	logLevel      string
+	// The message bodies are logged only if enabled, with the fields listed in logRedactFields redacted
+	logBody         bool
+	logRedactFields []string
+	// Deduplication by the message id is disabled if the window is 0, the state is kept in memory only if the file name is empty
+	dedupeWindow        int
+	dedupeStateFileName string
+	// Replication role, primary, standby or empty for none. The standby queue is the exchange name suffixed by the host name if empty
+	replicationRole             string
+	replicationExchangeName     string
+	replicationQueueName        string
+	replicationBufferSize       int
+	replicationSnapshotInterval time.Duration
+	// Partitioned mode is disabled if the number of the partitions is 0, the consumer owns the partition of that index then
+	partitions int
+	partition  int
+	// Declare the queue with the single active consumer, the standby takes over once the broker hands the deliveries to it
+	singleActiveConsumer bool
+	// The default map is sharded if the number of the shards is positive, see consumer.ShardedOrderedMapImpl
+	mapShards int
 }
 
 func main() {
@@ -45,11 +98,204 @@ func main() {
 				Usage:       "ampq queue name",
 				Destination: &config.ampqQueueName,
 			},
+			&cli.StringSliceFlag{
+				Name:  "output",
+				Value: cli.NewStringSlice("/tmp/consumer-output.txt"),
+				Usage: "processing output, the file name or the URL: stdout, file:///path, jsonl:///path, store:///path or amqp://host/queue. Repeat it to write to several outputs at once",
+			},
+			&cli.StringFlag{
+				Name:        "output-format",
+				Value:       "text",
+				Usage:       "output lines preset: text, csv or logfmt",
+				Destination: &config.outputFormat,
+			},
+			&cli.StringFlag{
+				Name:        "output-templates",
+				Value:       "",
+				Usage:       "JSON file mapping the Action.outcome names, e.g. AddItem.added or *.failed, to the text/template templates of the output lines, overriding the preset ones",
+				Destination: &config.outputTemplatesFile,
+			},
+			&cli.Int64Flag{
+				Name:        "output-max-size",
+				Value:       0,
+				Usage:       "rotate the output files before they grow over the size in bytes, 0 disables it",
+				Destination: &config.writerConfig.Rotation.MaxSize,
+			},
+			&cli.DurationFlag{
+				Name:        "output-max-age",
+				Value:       0,
+				Usage:       "rotate the output files written to for that long, e.g. 24h, 0 disables it",
+				Destination: &config.writerConfig.Rotation.MaxAge,
+			},
+			&cli.IntFlag{
+				Name:        "output-retention",
+				Value:       0,
+				Usage:       "number of the rotated output files kept, 0 keeps all of them",
+				Destination: &config.writerConfig.Rotation.Retention,
+			},
+			&cli.BoolFlag{
+				Name:        "output-compress",
+				Value:       false,
+				Usage:       "gzip the rotated output files",
+				Destination: &config.writerConfig.Rotation.Compress,
+			},
+			&cli.IntFlag{
+				Name:        "output-channel-size",
+				Value:       0,
+				Usage:       "number of the output lines waiting to be written before the workers block",
+				Destination: &config.writerConfig.ChannelSize,
+			},
+			&cli.DurationFlag{
+				Name:        "output-flush-interval",
+				Value:       0,
+				Usage:       "keep the output lines buffered for up to that long, 0 flushes as soon as no more lines are waiting",
+				Destination: &config.writerConfig.FlushInterval,
+			},
+			&cli.StringFlag{
+				Name:        "output-sync",
+				Value:       string(consumer.SyncNever),
+				Usage:       "when to fsync the output files: never, every-batch or every-write",
+				Destination: &config.syncPolicy,
+			},
+			&cli.BoolFlag{
+				Name:        "ack-after-flush",
+				Value:       false,
+				Usage:       "acknowledge the deliveries only after their output is flushed and synced to the disk",
+				Destination: &config.ackAfterFlush,
+			},
+			&cli.StringFlag{
+				Name:        "namespace-output",
+				Value:       "",
+				Usage:       "per-namespace output pattern, the file name or the URL as in --output, e.g. /tmp/consumer-output-%s.txt or jsonl:///tmp/consumer-output-%s.jsonl. Namespaced output goes to the processing output if empty",
+				Destination: &config.namespaceFileNamePattern,
+			},
+			&cli.StringFlag{
+				Name:        "cdc-exchange",
+				Value:       "",
+				Usage:       "fanout exchange to publish the change events of the ordered maps to, disabled if empty",
+				Destination: &config.cdcExchangeName,
+			},
+			&cli.StringFlag{
+				Name:        "cdc-state",
+				Value:       "/tmp/consumer-cdc.state",
+				Usage:       "file keeping the reserved change event sequence numbers, so they are not reused after restarts",
+				Destination: &config.cdcStateFileName,
+			},
+			&cli.IntFlag{
+				Name:        "cdc-buffer",
+				Value:       1000,
+				Usage:       "number of change events waiting to be published, the ones over it are spilled to the file next to --cdc-state",
+				Destination: &config.cdcBufferSize,
+			},
+			&cli.StringFlag{
+				Name:        "admin-addr",
+				Value:       "",
+				Usage:       "address of the admin HTTP API, e.g. localhost:8080, disabled if empty",
+				Destination: &config.adminAddr,
+			},
+			&cli.StringFlag{
+				Name:        "snapshot-file",
+				Value:       "/tmp/consumer-snapshot.json",
+				Usage:       "file the snapshot forced through the admin API is written to",
+				Destination: &config.snapshotFileName,
+			},
+			&cli.StringFlag{
+				Name:        "metrics-addr",
+				Usage:       "address to serve the Prometheus metrics on, e.g. :9102, also available in the sharded map mode. Empty disables the metrics endpoint",
+				Destination: &config.metricsAddr,
+			},
+			&cli.StringFlag{
+				Name:        "trace-exporter",
+				Value:       "",
+				Usage:       "where the OpenTelemetry spans go: otlp, otlp://host:4318, otlps://host:4318, stdout or a file name, disabled if empty",
+				Destination: &config.traceExporter,
+			},
+			&cli.IntFlag{
+				Name:        "dedupe-window",
+				Value:       10000,
+				Usage:       "number of the last executed message ids remembered, so their redelivered copies are acked without executing them again, 0 disables it",
+				Destination: &config.dedupeWindow,
+			},
+			&cli.StringFlag{
+				Name:        "dedupe-state",
+				Value:       "",
+				Usage:       "file keeping the dedupe window, so it survives restarts, kept in memory only if empty",
+				Destination: &config.dedupeStateFileName,
+			},
+			&cli.StringFlag{
+				Name:        "replication",
+				Value:       "",
+				Usage:       "replication role: primary streams the maps to the standbys, standby follows the primary until promoted through the admin API, disabled if empty",
+				Destination: &config.replicationRole,
+			},
+			&cli.StringFlag{
+				Name:        "replication-exchange",
+				Value:       "cmdhandler.replication",
+				Usage:       "fanout exchange the primary publishes the replication log to",
+				Destination: &config.replicationExchangeName,
+			},
+			&cli.StringFlag{
+				Name:        "replication-queue",
+				Value:       "",
+				Usage:       "queue of the standby bound to the replication exchange, the exchange name suffixed by the host name if empty",
+				Destination: &config.replicationQueueName,
+			},
+			&cli.IntFlag{
+				Name:        "replication-buffer",
+				Value:       1000,
+				Usage:       "number of replication events waiting to be published before the map writers are held back",
+				Destination: &config.replicationBufferSize,
+			},
+			&cli.DurationFlag{
+				Name:        "replication-snapshot-interval",
+				Value:       time.Minute,
+				Usage:       "how often the primary publishes the full snapshot the standbys catch up from, 0 publishes it on start only",
+				Destination: &config.replicationSnapshotInterval,
+			},
+			&cli.IntFlag{
+				Name:        "partitions",
+				Value:       0,
+				Usage:       "number of the partitions the producer routes the commands to by the key, 0 disables the partitioned mode",
+				Destination: &config.partitions,
+			},
+			&cli.IntFlag{
+				Name:        "partition",
+				Value:       0,
+				Usage:       "partition owned by the consumer, from 0, it consumes the queue name suffixed by it",
+				Destination: &config.partition,
+			},
+			&cli.BoolFlag{
+				Name:        "single-active-consumer",
+				Usage:       "declare the queue with the single active consumer, so only one of the consumers executes the commands. The standby takes over once the broker hands the deliveries to it",
+				Destination: &config.singleActiveConsumer,
+			},
+			&cli.IntFlag{
+				Name:        "map-shards",
+				Value:       0,
+				Usage:       "number of the independently locked shards of the map, so the workers do not wait for each other. Supports AddItem, DeleteItem, GetItem and GetAllItems on the default namespace only, 0 disables it",
+				Destination: &config.mapShards,
+			},
 			&cli.StringFlag{
-				Name:        "output",
-				Value:       "/tmp/consumer-output.txt",
-				Usage:       "processing output file name",
-				Destination: &config.processingFileName,
+				Name:        "log-format",
+				Value:       shared.LogFormatText,
+				Usage:       "log format: text or json",
+				Destination: &config.logFormat,
+			},
+			&cli.StringFlag{
+				Name:        "log-level",
+				Value:       "info",
+				Usage:       "lowest level logged: debug, info, warn or error",
+				Destination: &config.logLevel,
+			},
+			&cli.BoolFlag{
+				Name:        "log-body",
+				Usage:       "log the body of every received message",
+				Destination: &config.logBody,
+			},
+			&cli.StringSliceFlag{
+				Name:  "log-redact",
+				Value: cli.NewStringSlice("Value"),
+				Usage: "command fields replaced by " + shared.RedactedValue + " in the logged bodies, repeat it for several fields",
 			},
 			&cli.IntFlag{
 				Name:  "workers",
@@ -61,7 +307,52 @@ func main() {
 			},
 		},
 		Action: func(cCtx *cli.Context) error {
-			execute(config)
+			logger, err := shared.NewLogger(os.Stdout, config.logFormat, config.logLevel)
+			if err != nil {
+				return err
+			}
+			config.logRedactFields = cCtx.StringSlice("log-redact")
+			switch config.replicationRole {
+			case "", rolePrimary, roleStandby:
+			default:
+				return fmt.Errorf("unknown replication role %q, use one of %s, %s", config.replicationRole, rolePrimary, roleStandby)
+			}
+			if config.partitions < 0 || (config.partitions > 0 && (config.partition < 0 || config.partition >= config.partitions)) {
+				return fmt.Errorf("partition %d out of %d partitions", config.partition, config.partitions)
+			}
+			if config.singleActiveConsumer && config.replicationRole == rolePrimary {
+				return errors.New("the single active consumer is elected by the broker, start it as the standby")
+			}
+			if config.cdcExchangeName != "" && config.replicationRole == roleStandby {
+				// It would publish the changes of the primary once again, numbered by its own sequence
+				return errors.New("the standby does not publish the change events, start the primary with --cdc-exchange")
+			}
+			if config.mapShards < 0 {
+				return fmt.Errorf("invalid number of map shards %d", config.mapShards)
+			}
+			if config.mapShards > 0 && (config.replicationRole != "" || config.partitions > 0 || config.cdcExchangeName != "" || config.adminAddr != "") {
+				return errors.New("the sharded map does not report its changes, it can not be combined with --replication, --partitions, --cdc-exchange or --admin-addr")
+			}
+			syncPolicy, err := consumer.ParseSyncPolicy(config.syncPolicy)
+			if err != nil {
+				return err
+			}
+			config.writerConfig.Sync = syncPolicy
+			config.outputs = cCtx.StringSlice("output")
+			config.formatter, err = consumer.LoadFormatter(config.outputFormat, config.outputTemplatesFile)
+			if err != nil {
+				return err
+			}
+			// Fail early on the invalid specs, the sinks do not touch anything until started
+			if _, err := consumer.OpenSinks(config.outputs, config.writerConfig, nil); err != nil {
+				return err
+			}
+			if config.namespaceFileNamePattern != "" {
+				if _, err := consumer.OpenSink(fmt.Sprintf(config.namespaceFileNamePattern, consumer.DefaultNamespace), config.writerConfig, nil); err != nil {
+					return err
+				}
+			}
+			execute(config, logger)
 			return nil
 		},
 	}
@@ -71,27 +362,198 @@ func main() {
 	}
 }
 
-func execute(config *ConsumerConfig) {
-	logger := log.New(os.Stdout, "", log.LstdFlags)
-	queue := shared.NewClient(config.ampqQueueName, config.ampqUri, logger)
+func execute(config *ConsumerConfig, logger *slog.Logger) {
+	shutdownTracing, err := shared.SetupTracing(config.traceExporter, "cmdhandler-consumer", logger)
+	if err != nil {
+		logger.Error("Could not set up tracing", "error", err)
+		return
+	}
+	defer func() {
+		shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer shutdownCancel()
+		if err := shutdownTracing(shutdownCtx); err != nil {
+			logger.Error("Error flushing the spans", "error", err)
+		}
+	}()
+	var queueArgs amqp.Table
+	if config.singleActiveConsumer {
+		queueArgs = amqp.Table{shared.SingleActiveConsumerArg: true}
+	}
+	queueName := config.ampqQueueName
+	if config.partitions > 0 {
+		queueName = shared.PartitionQueueName(config.ampqQueueName, config.partition)
+	}
+	queue := shared.NewClientWithQueueArgs(queueName, queueArgs, config.ampqUri, logger)
 
 	// Give the connection sometime to set up
 	for !queue.IsReady {
 		<-time.After(time.Second)
 	}
 
-	fileWriter := consumer.NewFileWriter(config.processingFileName, logger)
-	fileWriter.Start()
+	output, err := consumer.OpenSinks(config.outputs, config.writerConfig, logger)
+	if err != nil {
+		logger.Error("Could not create the output", "error", err)
+		return
+	}
+	if err := output.Start(); err != nil {
+		logger.Error("Could not open the output", "error", err)
+		return
+	}
 
+	defer output.Close()
+	defer logger.Info("Shutting down...")
+
+	namespaceWriters := newNamespaceWriters(config, output, logger)
+	defer namespaceWriters.Close()
+
+	// External logrotate moves the files away and sends SIGHUP for us to reopen them
+	hupCh := make(chan os.Signal, 1)
+	signal.Notify(hupCh, syscall.SIGHUP)
+	defer signal.Stop(hupCh)
+	go func() {
+		for range hupCh {
+			logger.Info("SIGHUP received, reopening output files")
+			if reopener, ok := output.(consumer.Reopener); ok {
+				reopener.Reopen()
+			}
+			namespaceWriters.Reopen()
+		}
+	}()
+
+	// Create the registry of the ordered maps, one per namespace
+	orderedMap := consumer.NewMapRegistry(namespaceWriters.WriterFor)
+	if config.namespaceFileNamePattern != "" {
+		// Otherwise the dropped maps would keep their files open
+		orderedMap.OnMutation(namespaceWriters.Drop)
+	}
+	orderedMap.SetFormatter(config.formatter)
+	// The blocking pops hold their workers while waiting, at least one is left for the commands they wait for
+	orderedMap.SetBlockingPopLimit(max(0, config.numWorkers-1))
+	prometheus.MustRegister(consumer.NewRegistryCollector(orderedMap))
+	if config.metricsAddr != "" {
+		metricsServer := shared.ServeMetrics(config.metricsAddr, logger)
+		defer func() {
+			_ = metricsServer.Close()
+		}()
+	}
+
+	if config.cdcExchangeName != "" {
+		cdcClient := shared.NewExchangeClient(config.cdcExchangeName, amqp.ExchangeFanout, config.ampqUri, logger)
+		for !cdcClient.IsReady {
+			<-time.After(time.Second)
+		}
+		defer func() { _ = cdcClient.Close() }()
+
+		publisher, err := consumer.NewCDCPublisher(cdcClient, config.cdcStateFileName, config.cdcBufferSize, logger)
+		if err != nil {
+			logger.Error("Could not start change data capture", "error", err)
+			return
+		}
+		publisher.Start()
+		defer publisher.Close()
+		orderedMap.OnMutation(publisher.Publish)
+	}
+
+	// Watch notifications go to the reply queues through the default exchange, so the consuming client can push them
+	watcher := consumer.NewWatcher(orderedMap, queue, namespaceWriters.WriterFor, logger)
+	watcher.Start()
+	defer watcher.Close()
+
+	var executor consumer.OrderedMap = watcher
+	if config.partitions > 0 {
+		executor = consumer.NewPartition(config.partition, config.partitions, watcher, orderedMap, queue, namespaceWriters.WriterFor)
+		logger.Info("Partitioned mode", "partition", config.partition, "partitions", config.partitions, "queue", queueName)
+	}
+	if config.mapShards > 0 {
+		sharded := consumer.NewShardedOrderedMap(config.mapShards, output)
+		sharded.SetFormatter(config.formatter)
+		executor = sharded
+		logger.Info("Sharded map", "shards", config.mapShards)
+	}
+
+	var flushOutput func(namespace string) error
+	if config.ackAfterFlush {
+		flushOutput = namespaceWriters.Flush
+	}
+
+	// Paused and resumed through the admin API
+	gate := &consumer.PauseGate{}
+
+	var deduplicator *consumer.Deduplicator
+	if config.dedupeWindow > 0 {
+		deduplicator, err = consumer.NewDeduplicator(config.dedupeWindow, config.dedupeStateFileName)
+		if err != nil {
+			logger.Error("Could not load the dedupe state", "file", config.dedupeStateFileName, "error", err)
+			return
+		}
+		defer func() {
+			if err := deduplicator.Close(); err != nil {
+				logger.Error("Error closing the dedupe state", "error", err)
+			}
+		}()
+	}
+	// The standby keeps following the primary until promoted
+	var follower *standby
+	if config.replicationRole == roleStandby {
+		follower = newStandby(config, orderedMap, logger)
+		go follower.follow()
+	}
+	if config.adminAddr != "" {
+		admin := consumer.NewAdminServer(orderedMap, func() bool { return queue.IsReady }, gate, config.snapshotFileName, logger)
+		if follower != nil {
+			admin.SetPromoter(follower.promote)
+		}
+		adminServer := &http.Server{
+			Addr:    config.adminAddr,
+			Handler: admin,
+		}
+		go func() {
+			logger.Info("Admin API listening", "addr", config.adminAddr)
+			if err := adminServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				logger.Error("Admin API failed", "error", err)
+			}
+		}()
+		defer func() {
+			shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer shutdownCancel()
+			_ = adminServer.Shutdown(shutdownCtx)
+		}()
+	}
+
+	var deliveries <-chan amqp.Delivery
+	if follower != nil {
+		// The single active consumer standby registers with the broker right away, to be elected once the active one goes away
+		activated := make(chan (<-chan amqp.Delivery), 1)
+		if config.singleActiveConsumer {
+			go func() { activated <- follower.awaitActivation(queue) }()
+		}
+		// Waits for as long as it takes, the run below starts only once promoted
+		waitCtx, stopWaiting := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		select {
+		case <-follower.promoted:
+			stopWaiting()
+		case <-waitCtx.Done():
+			stopWaiting()
+			logger.Info("Stopped before promoted")
+			_ = queue.Close()
+			return
+		}
+		if config.singleActiveConsumer {
+			deliveries = <-activated
+		}
+	}
 	ctx, cancel := context.WithTimeout(context.Background(), time.Minute*10)
 	defer cancel()
-	defer fileWriter.Close()
-	defer logger.Println("Shutting down...")
+	if config.replicationRole != "" {
+		defer startReplicationPublisher(config, orderedMap, logger)()
+	}
 
-	deliveries, err := queue.Consume()
-	if err != nil {
-		logger.Printf("Could not start consuming: %s\n", err)
-		return
+	if deliveries == nil {
+		deliveries, err = queue.Consume()
+		if err != nil {
+			logger.Error("Could not start consuming", "error", err)
+			return
+		}
 	}
 
 	// This channel will receive a notification when a channel closed event
@@ -102,11 +564,9 @@ func execute(config *ConsumerConfig) {
 	chClosedCh := make(chan *amqp.Error, 1)
 	queue.Channel.NotifyClose(chClosedCh)
 
-	// Create an OrderedMapV1 instance
-	orderedMap := consumer.NewOrderedMap(fileWriter)
-
+	consumerActive.Set(1)
 	// Start worker pool
-	startWorkers(config, deliveries, orderedMap, logger)
+	startWorkers(config, deliveries, executor, flushOutput, gate, deduplicator, logger)
 	// Handle meta-situations
 	for {
 		select {
@@ -116,57 +576,267 @@ func execute(config *ConsumerConfig) {
 
 		case amqErr := <-chClosedCh:
 			// This case handles the event of closed channel e.g. abnormal shutdown
-			logger.Printf("AMQP Channel was closed due to: %s. Reinitializing consuming...\n", amqErr)
+			logger.Warn("AMQP Channel was closed. Reinitializing consuming...", "error", amqErr)
 
 			deliveries, err = queue.Consume()
 			if err != nil {
 				// If the AMQP channel is not ready, it will continue the loop. Next
 				// iteration will enter this case because chClosedCh is closed by the
 				// library
-				logger.Println("Error trying to consume, will try again")
+				logger.Warn("Error trying to consume, will try again", "error", err)
 				<-time.After(time.Second)
 				continue
 			}
-			startWorkers(config, deliveries, orderedMap, logger)
+			startWorkers(config, deliveries, executor, flushOutput, gate, deduplicator, logger)
 
 			// Re-set channel to receive notifications
 			// The library closes this channel after abnormal shutdown
 			chClosedCh = make(chan *amqp.Error, 1)
 			queue.Channel.NotifyClose(chClosedCh)
-			logger.Printf("Consuming again!\n")
+			logger.Info("Consuming again!")
 		}
 	}
 }
 
-func processDelivery(delivery amqp.Delivery, orderedMap consumer.OrderedMap, logger *log.Logger) {
-	logger.Printf("Received message: %s\n", delivery.Body)
+// The copy of the message being executed by another worker waits that long for it before it is requeued
+const dedupeInFlightWait = 5 * time.Second
+
+// processDelivery executes the command, flushOutput is optional and called before the delivery is acknowledged.
+// The deliveries of the messages executed already are acked without executing them again, nil deduplicator disables it.
+func processDelivery(config *ConsumerConfig, delivery amqp.Delivery, orderedMap consumer.OrderedMap, flushOutput func(namespace string) error, deduplicator *consumer.Deduplicator, logger *slog.Logger) {
+	logger = logger.With("delivery_tag", delivery.DeliveryTag, "message_id", delivery.MessageId)
+	if config.logBody {
+		logger.Info("Received message", "body", shared.RedactBody(delivery.Body, config.logRedactFields))
+	} else {
+		logger.Info("Received message", "size", len(delivery.Body))
+	}
+	deliveriesReceived.Inc()
+	// Joins the trace of the producer when the delivery carries its context
+	ctx, span := shared.Tracer().Start(shared.ExtractTraceContext(context.Background(), delivery.Headers), "process "+delivery.RoutingKey,
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "rabbitmq"),
+			attribute.Int64("messaging.rabbitmq.delivery_tag", int64(delivery.DeliveryTag)),
+			attribute.Bool("messaging.rabbitmq.redelivered", delivery.Redelivered),
+		))
+	defer span.End()
+
+	status := deduplicator.Begin(delivery.MessageId)
+	if status == consumer.DedupeInFlight {
+		// Requeued right away, the copy would bounce between the workers until the other one is done
+		select {
+		case <-deduplicator.Done(delivery.MessageId):
+		case <-time.After(dedupeInFlightWait):
+		}
+		status = deduplicator.Begin(delivery.MessageId)
+	}
+	switch status {
+	case consumer.DedupeDuplicate:
+		logger.Info("Duplicate message, acknowledging without executing")
+		span.SetAttributes(attribute.Bool("cmdhandler.duplicate", true))
+		deliveriesDeduplicated.Inc()
+		deliveriesAcked.Inc()
+		if err := delivery.Ack(false); err != nil {
+			logger.Error("Error acknowledging message", "error", err)
+		}
+		return
+	case consumer.DedupeInFlight:
+		// Still left to the worker executing it, e.g. a blocking pop, this copy comes back later
+		logger.Info("Message is still being executed by another worker, requeueing")
+		deliveriesNacked.WithLabelValues("true").Inc()
+		if err := delivery.Nack(false, true); err != nil {
+			logger.Error("Error negatively acknowledging message", "error", err)
+		}
+		return
+	}
+
 	command := &shared.Command{}
+	_, decodeSpan := shared.Tracer().Start(ctx, "decode")
 	err := json.Unmarshal(delivery.Body, command)
+	shared.EndSpan(decodeSpan, err)
 	if err != nil {
-		logger.Printf("Error decoding JSON: %s\n", err)
+		logger.Error("Error decoding JSON", "error", err)
+		span.SetStatus(codes.Error, "not a valid command")
+		decodeErrors.Inc()
+		deduplicator.Abort(delivery.MessageId)
+		deliveriesNacked.WithLabelValues("false").Inc()
 		err := delivery.Nack(false, false)
 		if err != nil {
-			logger.Printf("Error negatively acknowledging message: %s\n", err)
+			logger.Error("Error negatively acknowledging message", "error", err)
+		}
+		return
+	}
+	action := actionLabel(command.Action)
+	logger = logger.With("action", action, "namespace", command.Namespace, "key", command.Key)
+	span.SetAttributes(
+		attribute.String("cmdhandler.action", action),
+		attribute.String("cmdhandler.namespace", command.Namespace),
+		attribute.String("cmdhandler.key", command.Key),
+	)
+	timer := prometheus.NewTimer(commandDuration.WithLabelValues(action))
+	_, executeSpan := shared.Tracer().Start(ctx, "ExecuteCommand")
+	err = orderedMap.ExecuteCommand(command)
+	shared.EndSpan(executeSpan, err)
+	if err == nil && flushOutput != nil {
+		_, flushSpan := shared.Tracer().Start(ctx, "flush output")
+		err = flushOutput(command.Namespace)
+		shared.EndSpan(flushSpan, err)
+	}
+	timer.ObserveDuration()
+	commandsExecuted.WithLabelValues(action).Inc()
+	if err != nil {
+		logger.Error("Error recording output", "error", err)
+		span.SetStatus(codes.Error, "output not recorded")
+		if command.Action.Idempotent() {
+			// Let it be redelivered, executing it once again changes nothing but the output
+			deduplicator.Abort(delivery.MessageId)
+			deliveriesNacked.WithLabelValues("true").Inc()
+			if err := delivery.Nack(false, true); err != nil {
+				logger.Error("Error negatively acknowledging message", "error", err)
+			}
+			return
+		}
+		// Applied already, the redelivery would apply the likes of Increment twice. Only its output is lost,
+		// the message goes to the dead letter exchange, if any, and its copies are deduplicated
+		logger.Error("Command applied, but its output is lost, not requeueing")
+		if err := deduplicator.Commit(delivery.MessageId); err != nil {
+			logger.Error("Error saving the dedupe state", "error", err)
+		}
+		deliveriesNacked.WithLabelValues("false").Inc()
+		if err := delivery.Nack(false, false); err != nil {
+			logger.Error("Error negatively acknowledging message", "error", err)
 		}
 		return
 	}
-	//logger.Printf("Received command: %s\n", *command)
-	orderedMap.ExecuteCommand(command)
+	if err := deduplicator.Commit(delivery.MessageId); err != nil {
+		// Executed already, so acked anyway. Only a restart may let its copy through
+		logger.Error("Error saving the dedupe state", "error", err)
+	}
+	deliveriesAcked.Inc()
 	if err := delivery.Ack(false); err != nil {
-		logger.Printf("Error acknowledging message: %s\n", err)
+		logger.Error("Error acknowledging message", "error", err)
 	}
 }
 
-func startWorkers(config *ConsumerConfig, deliveries <-chan amqp.Delivery, orderedMap *consumer.OrderedMapImpl, logger *log.Logger) {
+func startWorkers(config *ConsumerConfig, deliveries <-chan amqp.Delivery, orderedMap consumer.OrderedMap, flushOutput func(namespace string) error, gate *consumer.PauseGate, deduplicator *consumer.Deduplicator, logger *slog.Logger) {
 	for i := 0; i < config.numWorkers; i++ {
-		go worker(i, deliveries, orderedMap, logger)
+		go worker(config, deliveries, orderedMap, flushOutput, gate, deduplicator, logger.With("worker", i))
+	}
+}
+
+func worker(config *ConsumerConfig, deliveries <-chan amqp.Delivery, orderedMap consumer.OrderedMap, flushOutput func(namespace string) error, gate *consumer.PauseGate, deduplicator *consumer.Deduplicator, logger *slog.Logger) {
+	for {
+		// Waiting before taking the delivery, so no new one is taken while paused
+		gate.Wait()
+		delivery, ok := <-deliveries
+		if !ok {
+			break
+		}
+		logger.Debug("Received task")
+		processDelivery(config, delivery, orderedMap, flushOutput, deduplicator, logger)
+	}
+	logger.Info("Worker finished")
+}
+
+// namespaceWriters routes the output of every namespace either to its own file or to the shared one.
+type namespaceWriters struct {
+	config        *ConsumerConfig
+	defaultWriter consumer.FileWriter
+	writers       map[string]consumer.Sink
+	mu            sync.Mutex
+	logger        *slog.Logger
+}
+
+func newNamespaceWriters(config *ConsumerConfig, defaultWriter consumer.FileWriter, logger *slog.Logger) *namespaceWriters {
+	return &namespaceWriters{
+		config:        config,
+		defaultWriter: defaultWriter,
+		writers:       make(map[string]consumer.Sink),
+		logger:        logger,
+	}
+}
+
+func (nw *namespaceWriters) WriterFor(namespace string) consumer.FileWriter {
+	if namespace == consumer.DefaultNamespace {
+		return nw.defaultWriter
+	}
+	if !consumer.ValidNamespace(namespace) {
+		// Never put into the file name, whoever asks
+		nw.logger.Warn("Invalid namespace written to the shared output", "namespace", namespace)
+		return nw.defaultWriter
+	}
+	if nw.config.namespaceFileNamePattern == "" {
+		return consumer.NewNamespacedWriter(namespace, nw.defaultWriter)
+	}
+
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+	writer, ok := nw.writers[namespace]
+	if !ok {
+		var err error
+		writer, err = consumer.OpenSink(fmt.Sprintf(nw.config.namespaceFileNamePattern, namespace), nw.config.writerConfig, nw.logger)
+		if err != nil {
+			// The pattern is validated on start, only the namespace itself may break the URL
+			nw.logger.Error("Could not create the output of namespace", "namespace", namespace, "error", err)
+			return consumer.NewNamespacedWriter(namespace, nw.defaultWriter)
+		}
+		if err := writer.Start(); err != nil {
+			// Not kept, so the next command of the namespace tries to open it again.
+			// Meanwhile the writes fail with the error.
+			nw.logger.Error("Could not open the output file of namespace", "namespace", namespace, "error", err)
+			return writer
+		}
+		nw.writers[namespace] = writer
+	}
+	return writer
+}
+
+// Flush flushes the writer of the namespace, the shared one if the namespace has no file of its own.
+// It never opens one, the rejected commands must not create the outputs of their namespaces.
+func (nw *namespaceWriters) Flush(namespace string) error {
+	var writer consumer.FileWriter = nw.defaultWriter
+	nw.mu.Lock()
+	if sink, ok := nw.writers[namespace]; ok {
+		writer = sink
+	}
+	nw.mu.Unlock()
+	if flusher, ok := writer.(consumer.Flusher); ok {
+		return flusher.Flush()
+	}
+	return nil
+}
+
+// Reopen asks all the per-namespace writers opened so far to reopen their files.
+func (nw *namespaceWriters) Reopen() {
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+	for _, writer := range nw.writers {
+		if reopener, ok := writer.(consumer.Reopener); ok {
+			reopener.Reopen()
+		}
+	}
+}
+
+// Drop closes and forgets the writer of the dropped namespace, the next map of the namespace opens it again.
+// Called by the registry after the last line of the map is written.
+func (nw *namespaceWriters) Drop(namespace string, mutation consumer.Mutation) {
+	if mutation.Op != consumer.MutationDrop {
+		return
+	}
+	nw.mu.Lock()
+	writer, ok := nw.writers[namespace]
+	delete(nw.writers, namespace)
+	nw.mu.Unlock()
+	if ok {
+		writer.Close()
 	}
 }
 
-func worker(id int, deliveries <-chan amqp.Delivery, orderedMap consumer.OrderedMap, logger *log.Logger) {
-	for delivery := range deliveries {
-		logger.Printf("Worker %d: received task\n", id)
-		processDelivery(delivery, orderedMap, logger)
+// Close closes all the per-namespace writers opened so far.
+func (nw *namespaceWriters) Close() {
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+	for _, writer := range nw.writers {
+		writer.Close()
 	}
-	logger.Printf("Worker %d: finished\n", id)
 }
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"github.com/kgara/cmdhandler/pkg/shared"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"strings"
+)
+
+var (
+	consumerActive = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: shared.MetricsNamespace,
+		Subsystem: "consumer",
+		Name:      "active",
+		Help:      "1 while the consumer executes the commands, 0 while it is a standby.",
+	})
+	deliveriesReceived = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: shared.MetricsNamespace,
+		Subsystem: "consumer",
+		Name:      "deliveries_received_total",
+		Help:      "Number of deliveries taken by the workers.",
+	})
+	deliveriesAcked = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: shared.MetricsNamespace,
+		Subsystem: "consumer",
+		Name:      "deliveries_acked_total",
+		Help:      "Number of deliveries acknowledged.",
+	})
+	deliveriesNacked = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: shared.MetricsNamespace,
+		Subsystem: "consumer",
+		Name:      "deliveries_nacked_total",
+		Help:      "Number of deliveries negatively acknowledged, by whether they were requeued.",
+	}, []string{"requeue"})
+	deliveriesDeduplicated = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: shared.MetricsNamespace,
+		Subsystem: "consumer",
+		Name:      "deliveries_deduplicated_total",
+		Help:      "Number of deliveries of the messages executed already, acknowledged without executing them again.",
+	})
+	decodeErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: shared.MetricsNamespace,
+		Subsystem: "consumer",
+		Name:      "decode_errors_total",
+		Help:      "Number of deliveries which are not valid commands.",
+	})
+	commandsExecuted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: shared.MetricsNamespace,
+		Subsystem: "consumer",
+		Name:      "commands_total",
+		Help:      "Number of commands executed, by the action.",
+	}, []string{"action"})
+	commandDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: shared.MetricsNamespace,
+		Subsystem: "consumer",
+		Name:      "command_duration_seconds",
+		Help:      "Time spent executing the command and writing out its result, by the action.",
+		Buckets:   prometheus.ExponentialBuckets(0.00001, 4, 12),
+	}, []string{"action"})
+)
+
+// actionLabel keeps the unknown actions from blowing up the label cardinality.
+func actionLabel(action shared.ActionType) string {
+	label := action.String()
+	if strings.HasPrefix(label, "unknownAction") {
+		return "unknown"
+	}
+	return label
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/kgara/cmdhandler/pkg/consumer"
+	"github.com/kgara/cmdhandler/pkg/shared"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// Replication roles of the consumer
+const (
+	rolePrimary = "primary"
+	roleStandby = "standby"
+)
+
+// On promotion the standby keeps applying the events still queued until none arrives for that long
+const replicationDrainIdle = time.Second
+
+// replicationQueueName returns the queue of the standby, unique per host unless set explicitly.
+func replicationQueueName(config *ConsumerConfig) string {
+	if config.replicationQueueName != "" {
+		return config.replicationQueueName
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "standby"
+	}
+	return config.replicationExchangeName + "." + hostname
+}
+
+// startReplicationPublisher streams the maps to the standbys, the returned func stops it.
+func startReplicationPublisher(config *ConsumerConfig, registry *consumer.MapRegistry, logger *slog.Logger) func() {
+	client := shared.NewExchangeClient(config.replicationExchangeName, amqp.ExchangeFanout, config.ampqUri, logger)
+	for !client.IsReady {
+		<-time.After(time.Second)
+	}
+	publisher := consumer.NewReplicationPublisher(registry, client, config.replicationBufferSize, config.replicationSnapshotInterval, logger)
+	publisher.Start()
+	logger.Info("Replicating to the standbys", "exchange", config.replicationExchangeName, "epoch", publisher.Epoch())
+	return func() {
+		publisher.Close()
+		_ = client.Close()
+	}
+}
+
+// standby follows the primary until promoted.
+type standby struct {
+	config   *ConsumerConfig
+	follower *consumer.ReplicationFollower
+	// Closed by promote, the follower drains the queued events and stops
+	stop chan struct{}
+	// Closed once the follower stopped, the standby is the primary from then on
+	promoted chan struct{}
+	once     sync.Once
+	logger   *slog.Logger
+}
+
+func newStandby(config *ConsumerConfig, registry *consumer.MapRegistry, logger *slog.Logger) *standby {
+	return &standby{
+		config:   config,
+		follower: consumer.NewReplicationFollower(registry, logger),
+		stop:     make(chan struct{}),
+		promoted: make(chan struct{}),
+		logger:   logger,
+	}
+}
+
+// promote stops following the primary once the queued events are applied.
+func (s *standby) promote() error {
+	promoting := false
+	s.once.Do(func() {
+		promoting = true
+		close(s.stop)
+	})
+	if !promoting {
+		return errors.New("already promoted")
+	}
+	<-s.promoted
+	return nil
+}
+
+// follow applies the replication stream to the registry until promoted.
+func (s *standby) follow() {
+	defer close(s.promoted)
+	queueName := replicationQueueName(s.config)
+	client := shared.NewSubscriptionClient(s.config.replicationExchangeName, amqp.ExchangeFanout, queueName, s.config.ampqUri, s.logger)
+	defer func() { _ = client.Close() }()
+	s.logger.Info("Following the primary", "exchange", s.config.replicationExchangeName, "queue", queueName)
+
+	var deliveries <-chan amqp.Delivery
+	stop := s.stop
+	stopping := false
+	for {
+		if deliveries == nil {
+			var err error
+			if deliveries, err = client.Consume(); err != nil {
+				deliveries = nil
+				if stopping {
+					return
+				}
+				select {
+				case <-stop:
+					stopping = true
+				case <-time.After(time.Second):
+				}
+				continue
+			}
+		}
+
+		var idle <-chan time.Time
+		if stopping {
+			idle = time.After(replicationDrainIdle)
+		}
+		select {
+		case <-stop:
+			stop = nil
+			stopping = true
+		case <-idle:
+			s.logger.Info("Stopped following the primary", "synced", s.follower.Synced())
+			return
+		case delivery, ok := <-deliveries:
+			if !ok {
+				// The channel got closed, consume again once the client reconnects
+				deliveries = nil
+				continue
+			}
+			s.apply(delivery)
+		}
+	}
+}
+
+// awaitActivation consumes the queue declared with the single active consumer and promotes the standby once the
+// broker hands the deliveries over to it, i.e. the active consumer went away. It returns once promoted, either way,
+// with the deliveries starting with the one which triggered the promotion.
+func (s *standby) awaitActivation(queue *shared.Client) <-chan amqp.Delivery {
+	for {
+		deliveries, err := queue.Consume()
+		if err != nil {
+			select {
+			case <-s.promoted:
+				return nil
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+		s.logger.Info("Waiting to become the single active consumer")
+		select {
+		case <-s.promoted:
+			return deliveries
+		case first, ok := <-deliveries:
+			if !ok {
+				// The channel got closed, consume again once the client reconnects
+				continue
+			}
+			s.logger.Info("Became the single active consumer, taking over")
+			if err := s.promote(); err != nil {
+				// Promoted through the admin API meanwhile
+				<-s.promoted
+			}
+			forwarded := make(chan amqp.Delivery)
+			go func() {
+				defer close(forwarded)
+				forwarded <- first
+				for delivery := range deliveries {
+					forwarded <- delivery
+				}
+			}()
+			return forwarded
+		}
+	}
+}
+
+func (s *standby) apply(delivery amqp.Delivery) {
+	event := consumer.ReplicationEvent{}
+	if err := json.Unmarshal(delivery.Body, &event); err != nil {
+		s.logger.Error("Error decoding replication event", "error", err)
+	} else if err := s.follower.Apply(event); err != nil {
+		s.logger.Warn("Replication out of sync, waiting for the next snapshot", "sequence", event.Sequence, "error", err)
+	}
+	if err := delivery.Ack(false); err != nil {
+		s.logger.Error("Error acknowledging replication event", "error", err)
+	}
+}
@@ -0,0 +1,88 @@
+package consumer
+
+import (
+	"github.com/kgara/cmdhandler/pkg/shared"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"time"
+)
+
+var (
+	mapLockWait = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: shared.MetricsNamespace,
+		Subsystem: "map",
+		Name:      "lock_wait_seconds",
+		Help:      "Time spent waiting for the ordered map lock, by the mode: read or write.",
+		Buckets:   prometheus.ExponentialBuckets(0.000001, 4, 12),
+	}, []string{"mode"})
+	mapReadLockWait  = mapLockWait.WithLabelValues("read")
+	mapWriteLockWait = mapLockWait.WithLabelValues("write")
+
+	outputQueueDepth = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: shared.MetricsNamespace,
+		Subsystem: "output",
+		Name:      "queue_depth",
+		Help:      "Number of the output lines waiting to be written, by the sink kind: file, jsonl or store.",
+	}, []string{"sink"})
+	outputWriteLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: shared.MetricsNamespace,
+		Subsystem: "output",
+		Name:      "write_latency_seconds",
+		Help:      "Time from the output line being queued to it being written to the file buffer, by the sink kind.",
+		Buckets:   prometheus.ExponentialBuckets(0.00001, 4, 12),
+	}, []string{"sink"})
+	outputFlushDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: shared.MetricsNamespace,
+		Subsystem: "output",
+		Name:      "flush_duration_seconds",
+		Help:      "Time spent flushing the buffer to the file, including the fsync if any, by the sink kind.",
+		Buckets:   prometheus.ExponentialBuckets(0.00001, 4, 12),
+	}, []string{"sink"})
+
+	mapItemsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(shared.MetricsNamespace, "map", "items"),
+		"Number of the items in the ordered map of the namespace.",
+		[]string{"namespace"}, nil,
+	)
+)
+
+// lock takes the write lock, measuring the time spent waiting for it.
+func (om *OrderedMapImpl) lock() {
+	start := time.Now()
+	om.mu.Lock()
+	mapWriteLockWait.Observe(time.Since(start).Seconds())
+}
+
+// rlock takes the read lock, measuring the time spent waiting for it.
+func (om *OrderedMapImpl) rlock() {
+	start := time.Now()
+	om.mu.RLock()
+	mapReadLockWait.Observe(time.Since(start).Seconds())
+}
+
+// RegistryCollector exposes the sizes of the maps of the registry, read on every scrape.
+type RegistryCollector struct {
+	registry *MapRegistry
+}
+
+// NewRegistryCollector creates a new instance of RegistryCollector, it is to be registered by the caller.
+func NewRegistryCollector(registry *MapRegistry) *RegistryCollector {
+	return &RegistryCollector{registry: registry}
+}
+
+func (c *RegistryCollector) Describe(descs chan<- *prometheus.Desc) {
+	descs <- mapItemsDesc
+}
+
+func (c *RegistryCollector) Collect(metrics chan<- prometheus.Metric) {
+	for _, namespace := range c.registry.Namespaces() {
+		om, ok := c.registry.Map(namespace)
+		if !ok {
+			continue
+		}
+		om.rlock()
+		length := om.items.Len()
+		om.mu.RUnlock()
+		metrics <- prometheus.MustNewConstMetric(mapItemsDesc, prometheus.GaugeValue, float64(length), namespace)
+	}
+}
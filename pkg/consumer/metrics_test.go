@@ -0,0 +1,54 @@
+package consumer
+
+import (
+	"github.com/kgara/cmdhandler/pkg/shared"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRegistryCollector(t *testing.T) {
+	fileWriterMock, registry := initializeRegistry()
+	fileWriterMock.On("Write", mock.Anything)
+	registry.ExecuteCommand(&shared.Command{Action: shared.AddItem, Key: "key1", Value: "value1"})
+	registry.ExecuteCommand(&shared.Command{Action: shared.AddItem, Key: "key2", Value: "value2"})
+	registry.ExecuteCommand(&shared.Command{Action: shared.AddItem, Key: "key3", Value: "value3", Namespace: "orders"})
+
+	expected := `
+# HELP cmdhandler_map_items Number of the items in the ordered map of the namespace.
+# TYPE cmdhandler_map_items gauge
+cmdhandler_map_items{namespace=""} 2
+cmdhandler_map_items{namespace="orders"} 1
+`
+	assert.NoError(t, testutil.CollectAndCompare(NewRegistryCollector(registry), strings.NewReader(expected)))
+}
+
+func TestFileWriterMetrics(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "out.txt")
+	fileWriter := NewFileWriter(fileName, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	// Shared by all the file sinks, so only the change is checked
+	queueDepth := testutil.ToFloat64(outputQueueDepth.WithLabelValues("file"))
+	writes := histogramCount(t, outputWriteLatency.WithLabelValues("file"))
+	assert.NoError(t, fileWriter.Start())
+	assert.NoError(t, fileWriter.Write("line1\n"))
+	assert.NoError(t, fileWriter.Write("line2\n"))
+	assert.NoError(t, fileWriter.Flush())
+	fileWriter.Close()
+
+	assert.Equal(t, queueDepth, testutil.ToFloat64(outputQueueDepth.WithLabelValues("file")))
+	assert.Equal(t, writes+2, histogramCount(t, outputWriteLatency.WithLabelValues("file")))
+}
+
+func histogramCount(t *testing.T, observer prometheus.Observer) uint64 {
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(observer.(prometheus.Histogram))
+	families, err := registry.Gather()
+	assert.NoError(t, err)
+	return families[0].GetMetric()[0].GetHistogram().GetSampleCount()
+}
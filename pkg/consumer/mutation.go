@@ -0,0 +1,29 @@
+package consumer
+
+// MutationOp is the kind of change applied to the ordered map
+type MutationOp string
+
+const (
+	MutationInsert MutationOp = "insert"
+	MutationUpdate MutationOp = "update"
+	MutationDelete MutationOp = "delete"
+	// MutationCreate is reported by the registry when the map of a new namespace comes up
+	MutationCreate MutationOp = "create"
+	// MutationDrop is reported by the registry when the whole map goes away
+	MutationDrop MutationOp = "drop"
+)
+
+// Mutation describes a single change of the ordered map.
+type Mutation struct {
+	Op       MutationOp
+	Key      string
+	OldValue string
+	NewValue string
+	// Version of the map right after the mutation, 0 for MutationCreate and MutationDrop
+	Version uint64
+}
+
+// MutationListener is notified about every change while the map lock is still held,
+// so the notifications come in exactly the order the changes were applied.
+// It must not block for long and must not call back into the map.
+type MutationListener func(mutation Mutation)
@@ -0,0 +1,87 @@
+package consumer
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/kgara/cmdhandler/pkg/shared"
+)
+
+// Partition executes the commands of a single partition of the key space, see shared.PartitionOf.
+// The keyed commands of the other partitions are rejected, executing them here would split the key across
+// the partitions, and so are the positional ones, there is no front of the map across the partitions.
+// The queries carrying ReplyTo are the scatter-gather ones, see shared.ActionType.Gathered, this partition pushes
+// its part of the answer there as shared.ItemsReply before writing it out as usual. All the commands go to
+// the next map afterward.
+type Partition struct {
+	index     int
+	count     int
+	next      OrderedMap
+	registry  *MapRegistry
+	notifier  Notifier
+	writerFor func(namespace string) FileWriter
+}
+
+// NewPartition creates a new instance of Partition, the index out of count partitions, in front of the next map.
+// The registry is the one the next map executes against.
+func NewPartition(index, count int, next OrderedMap, registry *MapRegistry, notifier Notifier, writerFor func(namespace string) FileWriter) *Partition {
+	return &Partition{
+		index:     index,
+		count:     count,
+		next:      next,
+		registry:  registry,
+		notifier:  notifier,
+		writerFor: writerFor,
+	}
+}
+
+func (p *Partition) ExecuteCommand(cmd *shared.Command) error {
+	if cmd.Action.Keyed() {
+		if owner := shared.PartitionOf(cmd.Key, p.count); owner != p.index {
+			return writeResult(p.writerFor(cmd.Namespace), p.registry.formatter, Result{Action: actionName(cmd.Action), Outcome: OutcomeFailed, Key: cmd.Key,
+				Error: fmt.Sprintf("Key belongs to partition %d, not %d", owner, p.index)})
+		}
+	}
+	if cmd.Action.Positional() && p.count > 1 {
+		return writeResult(p.writerFor(cmd.Namespace), p.registry.formatter, Result{Action: actionName(cmd.Action), Outcome: OutcomeFailed,
+			Error: fmt.Sprintf("Not supported across %d partitions", p.count)})
+	}
+	if cmd.Action.Gathered() && cmd.ReplyTo != "" {
+		if err := p.reply(cmd); err != nil {
+			return err
+		}
+	}
+	return p.next.ExecuteCommand(cmd)
+}
+
+// reply pushes the answer of the partition to the query, nothing found if its map of the namespace does not exist.
+func (p *Partition) reply(cmd *shared.Command) error {
+	reply := shared.ItemsReply{QueryID: cmd.QueryID, Partition: p.index, Namespace: cmd.Namespace, Items: []shared.Item{}}
+	if om, ok := p.registry.Map(cmd.Namespace); ok {
+		switch cmd.Action {
+		case shared.GetAllItems:
+			items := readItems(cmd.Namespace, om)
+			reply.Version = items.Version
+			for _, item := range items.Items {
+				reply.Items = append(reply.Items, shared.Item{Key: item.Key, Value: item.Value})
+			}
+		case shared.Count:
+			reply.Count = om.count(cmd.Key)
+		default:
+			entries, err := om.query(cmd)
+			if err != nil {
+				reply.Error = err.Error()
+			}
+			for _, found := range entries {
+				reply.Items = append(reply.Items, shared.Item{Key: found.key, Value: found.value})
+			}
+		}
+	}
+	data, err := json.Marshal(reply)
+	if err != nil {
+		return err
+	}
+	if err := p.notifier.PushTo(cmd.ReplyTo, data); err != nil {
+		return fmt.Errorf("pushing the items to %s: %w", cmd.ReplyTo, err)
+	}
+	return nil
+}
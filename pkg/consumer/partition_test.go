@@ -0,0 +1,106 @@
+package consumer
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/kgara/cmdhandler/pkg/shared"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"sync"
+	"testing"
+)
+
+type replyStub struct {
+	mu      sync.Mutex
+	replies map[string][]shared.ItemsReply
+}
+
+func (r *replyStub) PushTo(queueName string, data []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	reply := shared.ItemsReply{}
+	if err := json.Unmarshal(data, &reply); err != nil {
+		return err
+	}
+	r.replies[queueName] = append(r.replies[queueName], reply)
+	return nil
+}
+
+// keyOf returns a key owned by the partition out of two
+func keyOf(partition int) string {
+	for i := 0; ; i++ {
+		if key := fmt.Sprintf("key%d", i); shared.PartitionOf(key, 2) == partition {
+			return key
+		}
+	}
+}
+
+func TestPartitionRejectsForeignKeys(t *testing.T) {
+	fileWriterMock, registry := initializeRegistry()
+	fileWriterMock.On("Write", mock.Anything)
+	partition := NewPartition(0, 2, registry, registry, &replyStub{replies: make(map[string][]shared.ItemsReply)}, registry.writerFor)
+
+	own, foreign := keyOf(0), keyOf(1)
+	assert.NoError(t, partition.ExecuteCommand(&shared.Command{Action: shared.AddItem, Key: own, Value: "value1"}))
+	assert.NoError(t, partition.ExecuteCommand(&shared.Command{Action: shared.AddItem, Key: foreign, Value: "value2"}))
+
+	fileWriterMock.AssertCalled(t, "Write", "AddItem: Key belongs to partition 1, not 0\n")
+	om, _ := registry.Map(DefaultNamespace)
+	_, ok := om.Get(own)
+	assert.True(t, ok)
+	_, ok = om.Get(foreign)
+	assert.False(t, ok)
+}
+
+func TestPartitionRepliesToScatterGather(t *testing.T) {
+	fileWriterMock, registry := initializeRegistry()
+	fileWriterMock.On("Write", mock.Anything)
+	notifier := &replyStub{replies: make(map[string][]shared.ItemsReply)}
+	partition := NewPartition(1, 2, registry, registry, notifier, registry.writerFor)
+
+	key := keyOf(1)
+	assert.NoError(t, partition.ExecuteCommand(&shared.Command{Action: shared.AddItem, Key: key, Value: "value1"}))
+	assert.NoError(t, partition.ExecuteCommand(&shared.Command{Action: shared.GetAllItems, ReplyTo: "replies", QueryID: "query1"}))
+	assert.NoError(t, partition.ExecuteCommand(&shared.Command{Action: shared.GetAllItems, ReplyTo: "replies", QueryID: "query2", Namespace: "team1"}))
+
+	assert.Equal(t, []shared.ItemsReply{
+		{QueryID: "query1", Partition: 1, Version: 1, Items: []shared.Item{{Key: key, Value: "value1"}}},
+		{QueryID: "query2", Partition: 1, Namespace: "team1", Items: []shared.Item{}},
+	}, notifier.replies["replies"])
+	// Written out as usual too
+	fileWriterMock.AssertCalled(t, "Write", "GetAllItems: Position: 0, Key: "+key+", Value: value1\n")
+}
+
+func TestPartitionRepliesToQueries(t *testing.T) {
+	fileWriterMock, registry := initializeRegistry()
+	fileWriterMock.On("Write", mock.Anything)
+	notifier := &replyStub{replies: make(map[string][]shared.ItemsReply)}
+	partition := NewPartition(0, 2, registry, registry, notifier, registry.writerFor)
+
+	key := keyOf(0)
+	assert.NoError(t, partition.ExecuteCommand(&shared.Command{Action: shared.AddItem, Key: key, Value: "value1"}))
+	assert.NoError(t, partition.ExecuteCommand(&shared.Command{Action: shared.Count, ReplyTo: "replies", QueryID: "count"}))
+	assert.NoError(t, partition.ExecuteCommand(&shared.Command{Action: shared.GetByPrefix, Key: "key", ReplyTo: "replies", QueryID: "prefix"}))
+	assert.NoError(t, partition.ExecuteCommand(&shared.Command{Action: shared.GetByRegex, Key: "(", ReplyTo: "replies", QueryID: "regex"}))
+
+	assert.Equal(t, []shared.ItemsReply{
+		{QueryID: "count", Partition: 0, Count: 1, Items: []shared.Item{}},
+		{QueryID: "prefix", Partition: 0, Items: []shared.Item{{Key: key, Value: "value1"}}},
+		{QueryID: "regex", Partition: 0, Items: []shared.Item{}, Error: "Pattern ( is not valid"},
+	}, notifier.replies["replies"])
+}
+
+func TestPartitionRejectsPositionalCommands(t *testing.T) {
+	fileWriterMock, registry := initializeRegistry()
+	fileWriterMock.On("Write", mock.Anything)
+	partition := NewPartition(0, 2, registry, registry, &replyStub{replies: make(map[string][]shared.ItemsReply)}, registry.writerFor)
+
+	key := keyOf(0)
+	assert.NoError(t, partition.ExecuteCommand(&shared.Command{Action: shared.AddItem, Key: key, Value: "value1"}))
+	assert.NoError(t, partition.ExecuteCommand(&shared.Command{Action: shared.PopFront}))
+
+	fileWriterMock.AssertCalled(t, "Write", "PopFront: Not supported across 2 partitions\n")
+	om, _ := registry.Map(DefaultNamespace)
+	_, ok := om.Get(key)
+	assert.True(t, ok)
+}
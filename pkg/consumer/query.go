@@ -0,0 +1,131 @@
+package consumer
+
+import (
+	"fmt"
+	"github.com/kgara/cmdhandler/pkg/shared"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// query returns copies of the entries matched by the GetBy* command in the insertion order.
+//
+//   - GetByPrefix: Key is the key prefix
+//   - GetByGlob: Key is a path.Match pattern, the literal part before the first wildcard is scanned through the index
+//   - GetByRegex: Key is a regexp matched against the whole list of keys
+//   - GetByValue: Value is a "<operator> <operand>" predicate, Key is an optional key prefix narrowing the scan
+func (om *OrderedMapImpl) query(cmd *shared.Command) ([]entry, error) {
+	prefix := ""
+	var match func(found *entry) bool
+
+	switch cmd.Action {
+	case shared.GetByPrefix:
+		prefix = cmd.Key
+		match = func(*entry) bool { return true }
+	case shared.GetByGlob:
+		if _, err := path.Match(cmd.Key, ""); err != nil {
+			return nil, fmt.Errorf("Pattern %s is not valid", cmd.Key)
+		}
+		prefix = globLiteralPrefix(cmd.Key)
+		match = func(found *entry) bool {
+			matched, _ := path.Match(cmd.Key, found.key)
+			return matched
+		}
+	case shared.GetByRegex:
+		re, err := regexp.Compile(cmd.Key)
+		if err != nil {
+			return nil, fmt.Errorf("Pattern %s is not valid", cmd.Key)
+		}
+		match = func(found *entry) bool { return re.MatchString(found.key) }
+	case shared.GetByValue:
+		predicate, err := parseValuePredicate(cmd.Value)
+		if err != nil {
+			return nil, err
+		}
+		prefix = cmd.Key
+		match = func(found *entry) bool { return predicate(found.value) }
+	}
+
+	var entries []entry
+	if prefix == "" {
+		// Nothing to narrow down with, matching against the snapshot keeps the writers going
+		// and the insertion order for free
+		snapshot := om.Snapshot()
+		defer snapshot.Release()
+		for _, current := range snapshot.entries {
+			if match(&current) {
+				entries = append(entries, current)
+			}
+		}
+		return entries, nil
+	}
+	om.rlock()
+	om.index.ascendPrefix(prefix, func(key string) {
+		if found, _ := om.items.Get(key); match(&found) {
+			entries = append(entries, found)
+		}
+	})
+	om.mu.RUnlock()
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].seq < entries[j].seq })
+	return entries, nil
+}
+
+// globLiteralPrefix returns the part of the pattern before the first special character.
+func globLiteralPrefix(pattern string) string {
+	if i := strings.IndexAny(pattern, `*?[\`); i >= 0 {
+		return pattern[:i]
+	}
+	return pattern
+}
+
+// parseValuePredicate parses "<operator> <operand>" value predicates. Supported operators are
+// =, !=, contains, prefix, suffix and the comparisons <, <=, >, >= which compare numerically
+// when both sides are numbers and lexicographically otherwise.
+func parseValuePredicate(predicate string) (func(value string) bool, error) {
+	operator, operand, ok := strings.Cut(predicate, " ")
+	if !ok {
+		return nil, fmt.Errorf("Predicate %s is not valid", predicate)
+	}
+
+	switch operator {
+	case "=":
+		return func(value string) bool { return value == operand }, nil
+	case "!=":
+		return func(value string) bool { return value != operand }, nil
+	case "contains":
+		return func(value string) bool { return strings.Contains(value, operand) }, nil
+	case "prefix":
+		return func(value string) bool { return strings.HasPrefix(value, operand) }, nil
+	case "suffix":
+		return func(value string) bool { return strings.HasSuffix(value, operand) }, nil
+	case "<":
+		return func(value string) bool { return compareValues(value, operand) < 0 }, nil
+	case "<=":
+		return func(value string) bool { return compareValues(value, operand) <= 0 }, nil
+	case ">":
+		return func(value string) bool { return compareValues(value, operand) > 0 }, nil
+	case ">=":
+		return func(value string) bool { return compareValues(value, operand) >= 0 }, nil
+	default:
+		return nil, fmt.Errorf("Predicate operator %s is not supported", operator)
+	}
+}
+
+func compareValues(a, b string) int {
+	aNumber, aErr := strconv.ParseFloat(a, 64)
+	bNumber, bErr := strconv.ParseFloat(b, 64)
+	if aErr == nil && bErr == nil {
+		switch {
+		case aNumber < bNumber:
+			return -1
+		case aNumber > bNumber:
+			return 1
+		default:
+			return 0
+		}
+	}
+	return strings.Compare(a, b)
+}
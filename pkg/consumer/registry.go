@@ -0,0 +1,244 @@
+package consumer
+
+import (
+	"github.com/kgara/cmdhandler/pkg/shared"
+	"regexp"
+	"sort"
+	"sync"
+)
+
+// DefaultNamespace is the namespace of the commands that do not specify one
+const DefaultNamespace = ""
+
+// Namespaces may end up in the output file names, so keep them to the safe subset
+var validNamespace = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// ValidNamespace reports whether the namespace is the default one or a valid name, the only ones safe to
+// put into the output file names.
+func ValidNamespace(namespace string) bool {
+	return namespace == DefaultNamespace || validNamespace.MatchString(namespace)
+}
+
+// MapRegistry keeps independently locked ordered maps, one per namespace.
+// Maps are created on demand by the first command addressing their namespace.
+type MapRegistry struct {
+	maps map[string]*OrderedMapImpl
+	mu   sync.RWMutex
+	// Resolves the output of the given namespace, both for its map and for the registry level actions
+	writerFor func(namespace string) FileWriter
+	// See OnMutation
+	mutationListeners []func(namespace string, mutation Mutation)
+	// See SetFormatter
+	formatter *Formatter
+	// See SetBlockingPopLimit
+	blockingPops chan struct{}
+}
+
+// NewMapRegistry creates a registry holding just the default map.
+func NewMapRegistry(writerFor func(namespace string) FileWriter) *MapRegistry {
+	registry := &MapRegistry{
+		maps:      make(map[string]*OrderedMapImpl),
+		writerFor: writerFor,
+	}
+	registry.maps[DefaultNamespace] = NewOrderedMap(writerFor(DefaultNamespace))
+	return registry
+}
+
+// SetFormatter sets the formatter of the output lines of all the maps, nil restores DefaultFormatter.
+// Must be called before the first command.
+func (r *MapRegistry) SetFormatter(formatter *Formatter) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.formatter = formatter
+	for _, om := range r.maps {
+		om.SetFormatter(formatter)
+	}
+}
+
+// SetBlockingPopLimit caps the number of the BlockingPopFront commands waiting at once across all the maps,
+// as every one of them holds a worker. The ones over the cap fail right away, unless the map has an item
+// to pop. Unlimited by default. Must be called before the first command.
+func (r *MapRegistry) SetBlockingPopLimit(limit int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.blockingPops = make(chan struct{}, limit)
+	for _, om := range r.maps {
+		om.blockingPops = r.blockingPops
+	}
+}
+
+// OnMutation adds the listener notified about the changes of all the maps, present and future ones.
+// Creating and dropping a map are reported as a single MutationCreate and MutationDrop, the latter
+// after the last line of the map is written.
+func (r *MapRegistry) OnMutation(listener func(namespace string, mutation Mutation)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.mutationListeners = append(r.mutationListeners, listener)
+	for namespace, om := range r.maps {
+		r.listen(namespace, om)
+	}
+}
+
+// ExecuteCommand executes the map management commands and routes the rest to the map of the namespace.
+// The returned error means the result could not be written.
+func (r *MapRegistry) ExecuteCommand(cmd *shared.Command) error {
+	if !ValidNamespace(cmd.Namespace) {
+		return r.output(DefaultNamespace, Result{Action: actionName(cmd.Action), Command: cmd.Action.String(), Outcome: OutcomeInvalidNamespace, Namespace: cmd.Namespace})
+	}
+
+	switch cmd.Action {
+	case shared.CreateMap:
+		_, created := r.getOrCreate(cmd.Namespace)
+		if created {
+			return r.output(cmd.Namespace, Result{Action: "CreateMap", Outcome: OutcomeCreated, Namespace: cmd.Namespace})
+		} else {
+			return r.output(cmd.Namespace, Result{Action: "CreateMap", Outcome: OutcomeExists, Namespace: cmd.Namespace})
+		}
+	case shared.DropMap:
+		if cmd.Namespace == DefaultNamespace {
+			return r.output(cmd.Namespace, Result{Action: "DropMap", Outcome: OutcomeFailed, Namespace: cmd.Namespace, Error: "Default map can not be dropped"})
+		}
+		if dropped, err := r.drop(cmd.Namespace, true); dropped {
+			return err
+		} else {
+			return r.output(cmd.Namespace, Result{Action: "DropMap", Outcome: OutcomeNotFound, Namespace: cmd.Namespace})
+		}
+	case shared.ListMaps:
+		for position, namespace := range r.Namespaces() {
+			if err := r.output(cmd.Namespace, Result{Action: "ListMaps", Outcome: OutcomeItem, Position: position, Namespace: namespace}); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		om := r.acquire(cmd.Namespace)
+		defer om.inflight.Done()
+		return om.ExecuteCommand(cmd)
+	}
+}
+
+func (r *MapRegistry) output(namespace string, result Result) error {
+	return writeResult(r.writerFor(namespace), r.formatter, result)
+}
+
+// Namespaces returns the names of the existing maps in the sorted order.
+// The default namespace is always there and goes first.
+func (r *MapRegistry) Namespaces() []string {
+	r.mu.RLock()
+	namespaces := make([]string, 0, len(r.maps))
+	for namespace := range r.maps {
+		namespaces = append(namespaces, namespace)
+	}
+	r.mu.RUnlock()
+	sort.Strings(namespaces)
+	return namespaces
+}
+
+// getOrCreate returns the map of the namespace, reporting if it had to be created.
+// Map returns the map of the namespace, without creating it.
+func (r *MapRegistry) Map(namespace string) (*OrderedMapImpl, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	om, ok := r.maps[namespace]
+	return om, ok
+}
+
+func (r *MapRegistry) getOrCreate(namespace string) (*OrderedMapImpl, bool) {
+	r.mu.RLock()
+	om, ok := r.maps[namespace]
+	r.mu.RUnlock()
+	if ok {
+		return om, false
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// Someone might have been faster between the locks
+	if om, ok = r.maps[namespace]; ok {
+		return om, false
+	}
+	om = r.newMap(namespace)
+	r.maps[namespace] = om
+	r.notify(namespace, Mutation{Op: MutationCreate})
+	return om, true
+}
+
+// acquire returns the map of the namespace like getOrCreate, holding off its drop until the command
+// executed on it calls inflight.Done, so the output of the namespace is not closed under the command.
+func (r *MapRegistry) acquire(namespace string) *OrderedMapImpl {
+	for {
+		om, _ := r.getOrCreate(namespace)
+		r.mu.RLock()
+		// The drop waits for the commands with the write lock, so it can not miss this one
+		current := r.maps[namespace] == om
+		if current {
+			om.inflight.Add(1)
+		}
+		r.mu.RUnlock()
+		if current {
+			return om
+		}
+		// Dropped between the locks, the command goes to the map created again
+	}
+}
+
+// retire unhooks the map removed from the registry and waits for the commands still executing on it,
+// waking its blocking pops. Must be called with the write lock held.
+func retire(om *OrderedMapImpl) {
+	om.OnMutation(nil)
+	close(om.dropped)
+	om.inflight.Wait()
+}
+
+// newMap creates the map of the namespace set up like the rest of the registry maps.
+// Must be called with the write lock held.
+func (r *MapRegistry) newMap(namespace string) *OrderedMapImpl {
+	om := NewOrderedMap(r.writerFor(namespace))
+	om.SetFormatter(r.formatter)
+	om.blockingPops = r.blockingPops
+	r.listen(namespace, om)
+	return om
+}
+
+// drop removes the map of the namespace, reporting if it was there. The result, if asked for,
+// goes out after the commands still executing on the map and before the listeners learn about the drop,
+// so they may release the output of the namespace before the map is created again.
+func (r *MapRegistry) drop(namespace string, withResult bool) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	om, ok := r.maps[namespace]
+	if !ok {
+		return false, nil
+	}
+	delete(r.maps, namespace)
+	retire(om)
+	var err error
+	if withResult {
+		err = r.output(namespace, Result{Action: "DropMap", Outcome: OutcomeDropped, Namespace: namespace})
+	}
+	r.notify(namespace, Mutation{Op: MutationDrop})
+	return true, err
+}
+
+// notify passes the registry level mutation to the listeners.
+// Must be called with the write lock held, so it is ordered with the mutations of the maps.
+func (r *MapRegistry) notify(namespace string, mutation Mutation) {
+	for _, listener := range r.mutationListeners {
+		listener(namespace, mutation)
+	}
+}
+
+// listen wires the registry listeners to the map.
+// Must be called with the write lock held.
+func (r *MapRegistry) listen(namespace string, om *OrderedMapImpl) {
+	if len(r.mutationListeners) == 0 {
+		om.OnMutation(nil)
+		return
+	}
+	listeners := r.mutationListeners
+	om.OnMutation(func(mutation Mutation) {
+		for _, listener := range listeners {
+			listener(namespace, mutation)
+		}
+	})
+}
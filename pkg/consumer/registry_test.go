@@ -0,0 +1,225 @@
+package consumer
+
+import (
+	"github.com/kgara/cmdhandler/pkg/shared"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"testing"
+	"time"
+)
+
+func initializeRegistry() (*FileWriterMock, *MapRegistry) {
+	fileWriterMock := &FileWriterMock{}
+	registry := NewMapRegistry(func(namespace string) FileWriter {
+		if namespace == DefaultNamespace {
+			return fileWriterMock
+		}
+		return NewNamespacedWriter(namespace, fileWriterMock)
+	})
+	return fileWriterMock, registry
+}
+
+func TestRegistryNamespacesAreIndependent(t *testing.T) {
+	fileWriterMock, registry := initializeRegistry()
+
+	fileWriterMock.On("Write", "AddItem: Added item successfully. Key: testKey, Value: defaultValue\n").Once()
+	registry.ExecuteCommand(&shared.Command{Action: shared.AddItem, Key: "testKey", Value: "defaultValue"})
+
+	fileWriterMock.On("Write", "[team1] AddItem: Added item successfully. Key: testKey, Value: team1Value\n").Once()
+	registry.ExecuteCommand(&shared.Command{Action: shared.AddItem, Key: "testKey", Value: "team1Value", Namespace: "team1"})
+
+	fileWriterMock.On("Write", "GetItem: Key: testKey, Value: defaultValue\n").Once()
+	registry.ExecuteCommand(&shared.Command{Action: shared.GetItem, Key: "testKey"})
+
+	fileWriterMock.On("Write", "[team1] GetItem: Key: testKey, Value: team1Value\n").Once()
+	registry.ExecuteCommand(&shared.Command{Action: shared.GetItem, Key: "testKey", Namespace: "team1"})
+
+	fileWriterMock.On("Write", "[team2] GetItem: Key testKey not found\n").Once()
+	registry.ExecuteCommand(&shared.Command{Action: shared.GetItem, Key: "testKey", Namespace: "team2"})
+
+	assert.Equal(t, []string{DefaultNamespace, "team1", "team2"}, registry.Namespaces())
+	fileWriterMock.AssertExpectations(t)
+}
+
+func TestRegistryCreateDropAndListMaps(t *testing.T) {
+	fileWriterMock, registry := initializeRegistry()
+
+	fileWriterMock.On("Write", "[team1] CreateMap: Created map successfully. Namespace: team1\n").Once()
+	registry.ExecuteCommand(&shared.Command{Action: shared.CreateMap, Namespace: "team1"})
+
+	fileWriterMock.On("Write", "[team1] CreateMap: Map already exists. Namespace: team1\n").Once()
+	registry.ExecuteCommand(&shared.Command{Action: shared.CreateMap, Namespace: "team1"})
+
+	fileWriterMock.On("Write", "ListMaps: Position: 0, Namespace: \n").Once()
+	fileWriterMock.On("Write", "ListMaps: Position: 1, Namespace: team1\n").Once()
+	registry.ExecuteCommand(&shared.Command{Action: shared.ListMaps})
+
+	fileWriterMock.On("Write", mock.Anything).Once()
+	registry.ExecuteCommand(&shared.Command{Action: shared.AddItem, Key: "testKey", Value: "testValue", Namespace: "team1"})
+
+	fileWriterMock.On("Write", "[team1] DropMap: Dropped map successfully. Namespace: team1\n").Once()
+	registry.ExecuteCommand(&shared.Command{Action: shared.DropMap, Namespace: "team1"})
+
+	fileWriterMock.On("Write", "[team1] DropMap: Namespace team1 not found\n").Once()
+	registry.ExecuteCommand(&shared.Command{Action: shared.DropMap, Namespace: "team1"})
+
+	fileWriterMock.On("Write", "DropMap: Default map can not be dropped\n").Once()
+	registry.ExecuteCommand(&shared.Command{Action: shared.DropMap})
+
+	// Dropped map is gone with its content
+	fileWriterMock.On("Write", "[team1] GetAllItems: Empty map\n").Once()
+	registry.ExecuteCommand(&shared.Command{Action: shared.GetAllItems, Namespace: "team1"})
+
+	fileWriterMock.AssertExpectations(t)
+}
+
+func TestRegistryInvalidNamespace(t *testing.T) {
+	fileWriterMock, registry := initializeRegistry()
+
+	fileWriterMock.On("Write", "addItem: Namespace \"../etc\" is not valid\n").Once()
+	registry.ExecuteCommand(&shared.Command{Action: shared.AddItem, Key: "testKey", Value: "testValue", Namespace: "../etc"})
+
+	assert.Equal(t, []string{DefaultNamespace}, registry.Namespaces())
+	fileWriterMock.AssertExpectations(t)
+}
+
+func TestRegistryReportsDropAfterTheResult(t *testing.T) {
+	fileWriterMock, registry := initializeRegistry()
+	fileWriterMock.On("Write", mock.Anything)
+	registry.ExecuteCommand(&shared.Command{Action: shared.CreateMap, Namespace: "team1"})
+
+	// The listener may release the output of the namespace, nothing is written there afterwards
+	var writtenBeforeDrop int
+	registry.OnMutation(func(namespace string, mutation Mutation) {
+		if mutation.Op == MutationDrop {
+			writtenBeforeDrop = len(fileWriterMock.Calls)
+		}
+	})
+	assert.NoError(t, registry.ExecuteCommand(&shared.Command{Action: shared.DropMap, Namespace: "team1"}))
+	assert.Equal(t, 2, writtenBeforeDrop)
+	assert.Len(t, fileWriterMock.Calls, 2)
+	fileWriterMock.AssertCalled(t, "Write", "[team1] DropMap: Dropped map successfully. Namespace: team1\n")
+}
+
+func TestRegistryReportsMutations(t *testing.T) {
+	fileWriterMock, registry := initializeRegistry()
+	fileWriterMock.On("Write", mock.Anything)
+
+	type namespacedMutation struct {
+		namespace string
+		mutation  Mutation
+	}
+	var mutations []namespacedMutation
+	registry.OnMutation(func(namespace string, mutation Mutation) {
+		mutations = append(mutations, namespacedMutation{namespace, mutation})
+	})
+
+	registry.ExecuteCommand(&shared.Command{Action: shared.AddItem, Key: "key1", Value: "value1"})
+	registry.ExecuteCommand(&shared.Command{Action: shared.AddItem, Key: "key1", Value: "value2"})
+	registry.ExecuteCommand(&shared.Command{Action: shared.Increment, Key: "counter", Namespace: "team1"})
+	registry.ExecuteCommand(&shared.Command{Action: shared.PopFront, Namespace: "team1"})
+	registry.ExecuteCommand(&shared.Command{Action: shared.DeleteItem, Key: "key1"})
+	registry.ExecuteCommand(&shared.Command{Action: shared.DropMap, Namespace: "team1"})
+	// Reads and failed mutations are not reported
+	registry.ExecuteCommand(&shared.Command{Action: shared.GetAllItems})
+	registry.ExecuteCommand(&shared.Command{Action: shared.DeleteItem, Key: "key1"})
+
+	assert.Equal(t, []namespacedMutation{
+		{"", Mutation{Op: MutationInsert, Key: "key1", NewValue: "value1", Version: 1}},
+		{"", Mutation{Op: MutationUpdate, Key: "key1", OldValue: "value1", NewValue: "value2", Version: 2}},
+		{"team1", Mutation{Op: MutationCreate}},
+		{"team1", Mutation{Op: MutationInsert, Key: "counter", NewValue: "1", Version: 1}},
+		{"team1", Mutation{Op: MutationDelete, Key: "counter", OldValue: "1", Version: 2}},
+		{"", Mutation{Op: MutationDelete, Key: "key1", OldValue: "value2", Version: 3}},
+		{"team1", Mutation{Op: MutationDrop}},
+	}, mutations)
+}
+
+func TestRegistryBlockingPopLimit(t *testing.T) {
+	fileWriterMock, registry := initializeRegistry()
+	registry.SetBlockingPopLimit(1)
+
+	fileWriterMock.On("Write", "[team1] BlockingPopFront: Key: key1, Value: value1\n").Once()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		registry.ExecuteCommand(&shared.Command{Action: shared.BlockingPopFront, Namespace: "team1", Timeout: "5s"})
+	}()
+	assert.Eventually(t, func() bool { return len(registry.blockingPops) == 1 }, time.Second, time.Millisecond)
+
+	// The cap is shared by the maps
+	fileWriterMock.On("Write", "BlockingPopFront: Too many blocking pops waiting, try again later\n").Once()
+	registry.ExecuteCommand(&shared.Command{Action: shared.BlockingPopFront, Timeout: "5s"})
+
+	// The pops not waiting are not capped
+	fileWriterMock.On("Write", "AddItem: Added item successfully. Key: key2, Value: value2\n").Once()
+	registry.ExecuteCommand(&shared.Command{Action: shared.AddItem, Key: "key2", Value: "value2"})
+	fileWriterMock.On("Write", "BlockingPopFront: Key: key2, Value: value2\n").Once()
+	registry.ExecuteCommand(&shared.Command{Action: shared.BlockingPopFront, Timeout: "5s"})
+
+	fileWriterMock.On("Write", "[team1] AddItem: Added item successfully. Key: key1, Value: value1\n").Once()
+	registry.ExecuteCommand(&shared.Command{Action: shared.AddItem, Namespace: "team1", Key: "key1", Value: "value1"})
+	<-done
+	assert.Len(t, registry.blockingPops, 0)
+	fileWriterMock.AssertExpectations(t)
+}
+
+func TestRegistryDropWaitsForCommandsInFlight(t *testing.T) {
+	fileWriterMock, registry := initializeRegistry()
+	fileWriterMock.On("Write", "[team1] AddItem: Added item successfully. Key: key1, Value: value1\n").Once()
+	registry.ExecuteCommand(&shared.Command{Action: shared.AddItem, Key: "key1", Value: "value1", Namespace: "team1"})
+
+	// The GetItem is still writing its result when the map is dropped
+	writing := make(chan struct{})
+	release := make(chan struct{})
+	fileWriterMock.On("Write", "[team1] GetItem: Key: key1, Value: value1\n").Once().Run(func(mock.Arguments) {
+		close(writing)
+		<-release
+	})
+	fileWriterMock.On("Write", "[team1] DropMap: Dropped map successfully. Namespace: team1\n").Once()
+	dropped := make(chan struct{})
+	registry.OnMutation(func(namespace string, mutation Mutation) {
+		if mutation.Op == MutationDrop {
+			close(dropped)
+		}
+	})
+	go registry.ExecuteCommand(&shared.Command{Action: shared.GetItem, Key: "key1", Namespace: "team1"})
+	<-writing
+	go registry.ExecuteCommand(&shared.Command{Action: shared.DropMap, Namespace: "team1"})
+
+	// The listeners may close the output of the namespace, so they learn about the drop after the write
+	select {
+	case <-dropped:
+		t.Fatal("dropped while the command was still writing")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	select {
+	case <-dropped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("not dropped after the command finished")
+	}
+	fileWriterMock.AssertExpectations(t)
+}
+
+func TestRegistryDropWakesBlockingPops(t *testing.T) {
+	fileWriterMock, registry := initializeRegistry()
+	registry.SetBlockingPopLimit(1)
+	fileWriterMock.On("Write", "[team1] BlockingPopFront: Map was dropped while waiting\n").Once()
+	fileWriterMock.On("Write", "[team1] DropMap: Dropped map successfully. Namespace: team1\n").Once()
+
+	popped := make(chan error)
+	go func() {
+		popped <- registry.ExecuteCommand(&shared.Command{Action: shared.BlockingPopFront, Namespace: "team1", Timeout: "1m"})
+	}()
+	assert.Eventually(t, func() bool { return len(registry.blockingPops) == 1 }, 5*time.Second, time.Millisecond)
+
+	assert.NoError(t, registry.ExecuteCommand(&shared.Command{Action: shared.DropMap, Namespace: "team1"}))
+	select {
+	case err := <-popped:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the blocking pop kept waiting on the dropped map")
+	}
+	fileWriterMock.AssertExpectations(t)
+}
@@ -0,0 +1,443 @@
+package consumer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dchest/uniuri"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// Delay between the attempts to publish the same replication event
+	replicationRetryDelay = time.Second
+	// Time the closing publisher waits for the queued replication events
+	replicationDrainTimeout = 10 * time.Second
+	// Number of the mutations the follower keeps while waiting for the snapshot
+	replicationPendingLimit = 100000
+)
+
+// ReplicationEventKind tells the mutation events from the snapshot ones
+type ReplicationEventKind string
+
+const (
+	// ReplicationMutation carries a single mutation of a single map
+	ReplicationMutation ReplicationEventKind = "mutation"
+	// ReplicationSnapshot carries the state of all the maps
+	ReplicationSnapshot ReplicationEventKind = "snapshot"
+)
+
+var (
+	// Returned by the followers missing some of the events, they resync on the next snapshot
+	errReplicationGap = errors.New("replication gap")
+	// Returned by the followers whose map does not match the primary one anymore
+	errReplicationDiverged = errors.New("replication diverged")
+)
+
+// ReplicationEvent is a record of the log streamed from the primary to the standby consumers.
+type ReplicationEvent struct {
+	// Epoch identifies the run of the primary, the sequence starts over with every one
+	Epoch string
+	// Sequence grows by one with every event of the epoch
+	Sequence uint64
+	Kind     ReplicationEventKind
+	// Namespace and Mutation of the mutation events
+	Namespace string
+	Mutation  Mutation
+	// State of all the maps of the snapshot events. The maps are copied one by one, so the mutation events
+	// numbered from Since on may or may not be included already, the followers tell them apart by the map versions
+	Since     uint64
+	Maps      []ItemsResponse
+	Timestamp time.Time
+}
+
+// ReplicationPublisher streams the mutations of all the maps to the standby consumers in the exact order
+// they were applied, numbered within the epoch of the publisher. The full snapshot goes first and then
+// periodically, so the followers joining late or missing some events can catch up.
+// The events are published at least once, still waiting in the buffer when the process dies they are lost.
+type ReplicationPublisher struct {
+	registry         *MapRegistry
+	pusher           Pusher
+	epoch            string
+	snapshotInterval time.Duration
+	events           chan ReplicationEvent
+	// Guards the sequence so the events get into the buffer in the numbered order
+	sequence uint64
+	closed   bool
+	mu       sync.Mutex
+	// Closed first thing in Close, releases the publishing blocked on the full buffer
+	closing chan struct{}
+	// Closed when Close gives up on the unpublished events
+	done   chan struct{}
+	wg     sync.WaitGroup
+	logger *slog.Logger
+}
+
+// NewReplicationPublisher creates a new instance of ReplicationPublisher starting a new epoch.
+// A zero snapshot interval publishes the snapshot on Start only.
+func NewReplicationPublisher(registry *MapRegistry, pusher Pusher, bufferSize int, snapshotInterval time.Duration, logger *slog.Logger) *ReplicationPublisher {
+	return &ReplicationPublisher{
+		registry:         registry,
+		pusher:           pusher,
+		epoch:            uniuri.New(),
+		snapshotInterval: snapshotInterval,
+		events:           make(chan ReplicationEvent, bufferSize),
+		closing:          make(chan struct{}),
+		done:             make(chan struct{}),
+		logger:           logger,
+	}
+}
+
+// Epoch returns the epoch of the published events.
+func (p *ReplicationPublisher) Epoch() string {
+	return p.epoch
+}
+
+// Start subscribes to the registry mutations and starts publishing, the first snapshot included.
+func (p *ReplicationPublisher) Start() {
+	p.registry.OnMutation(p.publishMutation)
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		for event := range p.events {
+			data, err := json.Marshal(event)
+			if err != nil {
+				p.logger.Error("Error encoding replication event", "sequence", event.Sequence, "error", err)
+				continue
+			}
+			if !p.publish(event.Sequence, data) {
+				return
+			}
+		}
+	}()
+	p.PublishSnapshot()
+	if p.snapshotInterval > 0 {
+		go func() {
+			ticker := time.NewTicker(p.snapshotInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-p.closing:
+					return
+				case <-ticker.C:
+					p.PublishSnapshot()
+				}
+			}
+		}()
+	}
+}
+
+// PublishSnapshot queues the snapshot of all the maps.
+func (p *ReplicationPublisher) PublishSnapshot() {
+	var since uint64
+	maps := p.registry.snapshotAll(func() {
+		p.mu.Lock()
+		since = p.sequence + 1
+		p.mu.Unlock()
+	})
+	p.enqueue(ReplicationEvent{Kind: ReplicationSnapshot, Since: since, Maps: maps})
+}
+
+// publishMutation is the registry listener, it blocks when the buffer is full,
+// holding the map writers back until the broker catches up.
+func (p *ReplicationPublisher) publishMutation(namespace string, mutation Mutation) {
+	p.enqueue(ReplicationEvent{Kind: ReplicationMutation, Namespace: namespace, Mutation: mutation})
+}
+
+func (p *ReplicationPublisher) enqueue(event ReplicationEvent) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		p.logger.Warn("Replication publisher is closed, dropping the event", "kind", event.Kind)
+		return
+	}
+	event.Epoch = p.epoch
+	event.Sequence = p.sequence + 1
+	event.Timestamp = time.Now().UTC()
+	select {
+	case p.events <- event:
+		p.sequence++
+	case <-p.closing:
+		p.logger.Warn("Replication publisher is closing, dropping the event", "kind", event.Kind)
+	}
+}
+
+// publish retries until the event is confirmed, returns false if the publisher got closed meanwhile.
+func (p *ReplicationPublisher) publish(sequence uint64, data []byte) bool {
+	for {
+		err := p.pusher.Push(data)
+		if err == nil {
+			return true
+		}
+		p.logger.Warn("Publishing replication event failed. Retrying...", "sequence", sequence, "error", err)
+		select {
+		case <-p.done:
+			return false
+		case <-time.After(replicationRetryDelay):
+		}
+	}
+}
+
+// Close stops accepting new events and waits for the queued ones to be published.
+// Events still not published after replicationDrainTimeout are abandoned.
+func (p *ReplicationPublisher) Close() {
+	close(p.closing)
+	p.mu.Lock()
+	p.closed = true
+	close(p.events)
+	p.mu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(replicationDrainTimeout):
+		p.logger.Warn("Abandoning unpublished replication events", "count", len(p.events))
+		close(p.done)
+		<-drained
+	}
+}
+
+// ReplicationFollower applies the events of the primary to the local registry in the order of their sequence.
+// It starts out of sync and buffers the mutations until a snapshot arrives, then it restores the maps from it
+// and replays the buffered mutations on top. A missing event, a new epoch or a map not matching the primary one
+// put it out of sync again, until the next snapshot.
+type ReplicationFollower struct {
+	registry *MapRegistry
+	epoch    string
+	synced   bool
+	// Last applied sequence of the epoch, valid when synced
+	sequence uint64
+	// Mutations of the epoch waiting for the snapshot
+	pending []ReplicationEvent
+	mu      sync.Mutex
+	logger  *slog.Logger
+}
+
+// NewReplicationFollower creates a new instance of ReplicationFollower applying the events to the registry.
+// The registry is meant to be fed by the follower only, the maps are replaced by the snapshots.
+func NewReplicationFollower(registry *MapRegistry, logger *slog.Logger) *ReplicationFollower {
+	return &ReplicationFollower{
+		registry: registry,
+		logger:   logger,
+	}
+}
+
+// Synced reports if the follower caught up with the primary and applies its events as they come.
+func (f *ReplicationFollower) Synced() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.synced
+}
+
+// Apply applies the event, or buffers it until the follower is in sync.
+// The redelivered events are skipped, the error means the follower fell out of sync.
+func (f *ReplicationFollower) Apply(event ReplicationEvent) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if event.Epoch != f.epoch {
+		if f.epoch != "" {
+			f.logger.Warn("New replication epoch, waiting for the snapshot", "epoch", event.Epoch)
+		}
+		f.epoch = event.Epoch
+		f.unsync()
+	}
+
+	switch event.Kind {
+	case ReplicationSnapshot:
+		if f.synced && event.Sequence <= f.sequence {
+			return nil
+		}
+		if f.synced && event.Sequence == f.sequence+1 {
+			// Everything in it got applied already
+			f.sequence = event.Sequence
+			return nil
+		}
+		f.restore(event)
+		return nil
+	case ReplicationMutation:
+		if !f.synced {
+			f.buffer(event)
+			return nil
+		}
+		if event.Sequence <= f.sequence {
+			return nil
+		}
+		if event.Sequence != f.sequence+1 {
+			f.unsync()
+			f.buffer(event)
+			return fmt.Errorf("%w: expected sequence %d, got %d", errReplicationGap, f.sequence+1, event.Sequence)
+		}
+		if err := f.registry.applyReplicated(event.Namespace, event.Mutation); err != nil {
+			f.unsync()
+			return err
+		}
+		f.sequence = event.Sequence
+		return nil
+	default:
+		return fmt.Errorf("unknown replication event kind %q", event.Kind)
+	}
+}
+
+// restore replaces the maps with the snapshot and replays the pending mutations not included in it.
+// Must be called with the lock held.
+func (f *ReplicationFollower) restore(snapshot ReplicationEvent) {
+	f.registry.restore(snapshot.Maps)
+	pending := f.pending
+	f.pending = nil
+	sort.Slice(pending, func(i, j int) bool { return pending[i].Sequence < pending[j].Sequence })
+	expected := snapshot.Since
+	for _, event := range pending {
+		if event.Sequence < expected {
+			// Either included in the snapshot or a redelivered copy
+			continue
+		}
+		if event.Sequence != expected {
+			f.logger.Warn("Replication events missing after the snapshot, waiting for the next one",
+				"expected_sequence", expected, "sequence", event.Sequence)
+			return
+		}
+		if err := f.registry.applyReplicated(event.Namespace, event.Mutation); err != nil {
+			f.logger.Warn("Replication event does not apply on top of the snapshot, waiting for the next one",
+				"sequence", event.Sequence, "error", err)
+			return
+		}
+		expected++
+	}
+	if expected < snapshot.Sequence {
+		f.logger.Warn("Replication events missing before the snapshot, waiting for the next one",
+			"expected_sequence", expected, "snapshot_sequence", snapshot.Sequence)
+		return
+	}
+	f.synced = true
+	f.sequence = max(snapshot.Sequence, expected-1)
+	f.logger.Info("Replication in sync", "epoch", f.epoch, "sequence", f.sequence)
+}
+
+// buffer keeps the mutation for the next snapshot, the oldest ones go first when the buffer is full
+// as they are the most likely to be included in it.
+// Must be called with the lock held.
+func (f *ReplicationFollower) buffer(event ReplicationEvent) {
+	if len(f.pending) >= replicationPendingLimit {
+		f.pending = f.pending[1:]
+	}
+	f.pending = append(f.pending, event)
+}
+
+// unsync drops the state of the sequence, the follower waits for the next snapshot.
+// Must be called with the lock held.
+func (f *ReplicationFollower) unsync() {
+	f.synced = false
+	f.sequence = 0
+	f.pending = nil
+}
+
+// snapshotAll copies all the maps holding the read lock, so no map is created or dropped meanwhile.
+// The before func is called with the lock held, before any map is copied.
+func (r *MapRegistry) snapshotAll(before func()) []ItemsResponse {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	before()
+	namespaces := make([]string, 0, len(r.maps))
+	for namespace := range r.maps {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+	maps := make([]ItemsResponse, 0, len(namespaces))
+	for _, namespace := range namespaces {
+		maps = append(maps, readItems(namespace, r.maps[namespace]))
+	}
+	return maps
+}
+
+// restore replaces all the maps with the ones of the snapshot, keeping their versions.
+// The listeners get wired to the new maps, the maps missing from the snapshot are reported as dropped.
+func (r *MapRegistry) restore(snapshot []ItemsResponse) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	replaced := r.maps
+	for _, om := range replaced {
+		retire(om)
+	}
+	r.maps = make(map[string]*OrderedMapImpl, len(snapshot))
+	for _, items := range snapshot {
+		om := r.newMap(items.Namespace)
+		om.load(items.Items, items.Version)
+		r.maps[items.Namespace] = om
+	}
+	if _, ok := r.maps[DefaultNamespace]; !ok {
+		r.maps[DefaultNamespace] = r.newMap(DefaultNamespace)
+	}
+	for namespace := range replaced {
+		if _, ok := r.maps[namespace]; !ok {
+			r.notify(namespace, Mutation{Op: MutationDrop})
+		}
+	}
+}
+
+// applyReplicated applies the mutation of the primary map to the map of the namespace.
+func (r *MapRegistry) applyReplicated(namespace string, mutation Mutation) error {
+	switch mutation.Op {
+	case MutationCreate:
+		r.getOrCreate(namespace)
+		return nil
+	case MutationDrop:
+		r.drop(namespace, false)
+		return nil
+	default:
+		om, _ := r.getOrCreate(namespace)
+		return om.applyReplicated(mutation)
+	}
+}
+
+// load fills the new map with the items at the version.
+func (om *OrderedMapImpl) load(items []Item, version uint64) {
+	om.lock()
+	defer om.mu.Unlock()
+	for _, item := range items {
+		om.items.Set(item.Key, entry{key: item.Key, value: item.Value, seq: om.nextSeq})
+		om.nextSeq++
+		om.index.insert(item.Key)
+	}
+	om.version = version
+}
+
+// applyReplicated applies the mutation of the primary map, which must be the next one by the version.
+// The mutations the map went past already are skipped.
+func (om *OrderedMapImpl) applyReplicated(mutation Mutation) error {
+	om.lock()
+	defer om.mu.Unlock()
+	if mutation.Version <= om.version {
+		return nil
+	}
+	if mutation.Version != om.version+1 {
+		return fmt.Errorf("%w: map version %d, mutation version %d", errReplicationGap, om.version, mutation.Version)
+	}
+	existing, exists := om.items.Get(mutation.Key)
+	switch mutation.Op {
+	case MutationInsert:
+		if exists {
+			return fmt.Errorf("%w: inserted key %s exists", errReplicationDiverged, mutation.Key)
+		}
+		om.append(mutation.Key, mutation.NewValue)
+	case MutationUpdate:
+		if !exists {
+			return fmt.Errorf("%w: updated key %s is missing", errReplicationDiverged, mutation.Key)
+		}
+		om.replace(existing, mutation.NewValue)
+	case MutationDelete:
+		if !exists {
+			return fmt.Errorf("%w: deleted key %s is missing", errReplicationDiverged, mutation.Key)
+		}
+		om.delete(mutation.Key)
+	default:
+		return fmt.Errorf("unknown mutation op %q", mutation.Op)
+	}
+	return nil
+}
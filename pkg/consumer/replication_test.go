@@ -0,0 +1,178 @@
+package consumer
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/kgara/cmdhandler/pkg/shared"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"io"
+	"log/slog"
+	"sync"
+	"testing"
+)
+
+// replicationPusherStub keeps the published events, failing the first few pushes
+type replicationPusherStub struct {
+	mu       sync.Mutex
+	failures int
+	pushed   []ReplicationEvent
+}
+
+func (p *replicationPusherStub) Push(data []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.failures > 0 {
+		p.failures--
+		return errors.New("not connected")
+	}
+	event := ReplicationEvent{}
+	if err := json.Unmarshal(data, &event); err != nil {
+		return err
+	}
+	p.pushed = append(p.pushed, event)
+	return nil
+}
+
+func initializeFollower() *ReplicationFollower {
+	fileWriterMock, registry := initializeRegistry()
+	fileWriterMock.On("Write", mock.Anything)
+	return NewReplicationFollower(registry, slog.New(slog.NewTextHandler(io.Discard, nil)))
+}
+
+func allMaps(registry *MapRegistry) []ItemsResponse {
+	return registry.snapshotAll(func() {})
+}
+
+func TestReplicationFollowerMirrorsPrimary(t *testing.T) {
+	fileWriterMock, primary := initializeRegistry()
+	fileWriterMock.On("Write", mock.Anything)
+	primary.ExecuteCommand(&shared.Command{Action: shared.AddItem, Key: "key1", Value: "value1"})
+	primary.ExecuteCommand(&shared.Command{Action: shared.AddItem, Key: "key2", Value: "value2", Namespace: "team1"})
+
+	pusher := &replicationPusherStub{failures: 1}
+	publisher := NewReplicationPublisher(primary, pusher, 10, 0, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	publisher.Start()
+	primary.ExecuteCommand(&shared.Command{Action: shared.AddItem, Key: "key3", Value: "value3"})
+	primary.ExecuteCommand(&shared.Command{Action: shared.AddItem, Key: "key1", Value: "value4"})
+	primary.ExecuteCommand(&shared.Command{Action: shared.PopFront})
+	primary.ExecuteCommand(&shared.Command{Action: shared.CreateMap, Namespace: "team2"})
+	primary.ExecuteCommand(&shared.Command{Action: shared.DropMap, Namespace: "team1"})
+	publisher.Close()
+
+	assert.Equal(t, ReplicationSnapshot, pusher.pushed[0].Kind)
+	for i, event := range pusher.pushed {
+		assert.Equal(t, publisher.Epoch(), event.Epoch)
+		assert.Equal(t, uint64(i+1), event.Sequence)
+	}
+
+	follower := initializeFollower()
+	for _, event := range pusher.pushed {
+		assert.NoError(t, follower.Apply(event))
+	}
+	assert.True(t, follower.Synced())
+	assert.Equal(t, allMaps(primary), allMaps(follower.registry))
+	assert.Equal(t, []string{DefaultNamespace, "team2"}, follower.registry.Namespaces())
+
+	// Redelivered events change nothing
+	for _, event := range pusher.pushed {
+		assert.NoError(t, follower.Apply(event))
+	}
+	assert.Equal(t, allMaps(primary), allMaps(follower.registry))
+}
+
+func TestReplicationFollowerReplaysBufferedMutations(t *testing.T) {
+	follower := initializeFollower()
+	events := []ReplicationEvent{
+		// Included in the snapshot
+		{Epoch: "e1", Sequence: 1, Kind: ReplicationMutation, Mutation: Mutation{Op: MutationInsert, Key: "key1", NewValue: "value1", Version: 1}},
+		// Applied to the map before it got copied
+		{Epoch: "e1", Sequence: 2, Kind: ReplicationMutation, Mutation: Mutation{Op: MutationInsert, Key: "key2", NewValue: "value2", Version: 2}},
+		// Applied after
+		{Epoch: "e1", Sequence: 3, Kind: ReplicationMutation, Mutation: Mutation{Op: MutationUpdate, Key: "key1", OldValue: "value1", NewValue: "value3", Version: 3}},
+	}
+	for _, event := range events {
+		assert.NoError(t, follower.Apply(event))
+	}
+	assert.False(t, follower.Synced())
+
+	assert.NoError(t, follower.Apply(ReplicationEvent{Epoch: "e1", Sequence: 4, Kind: ReplicationSnapshot, Since: 2, Maps: []ItemsResponse{
+		{Namespace: DefaultNamespace, Version: 2, Items: []Item{{"key1", "value1"}, {"key2", "value2"}}},
+	}}))
+	assert.True(t, follower.Synced())
+	assert.NoError(t, follower.Apply(ReplicationEvent{Epoch: "e1", Sequence: 5, Kind: ReplicationMutation, Mutation: Mutation{Op: MutationDelete, Key: "key2", OldValue: "value2", Version: 4}}))
+
+	assert.Equal(t, []ItemsResponse{
+		{Namespace: DefaultNamespace, Version: 4, Items: []Item{{"key1", "value3"}}},
+	}, allMaps(follower.registry))
+}
+
+func TestReplicationFollowerResyncsAfterGap(t *testing.T) {
+	follower := initializeFollower()
+	snapshot := ReplicationEvent{Epoch: "e1", Sequence: 1, Kind: ReplicationSnapshot, Since: 1, Maps: []ItemsResponse{
+		{Namespace: DefaultNamespace, Version: 0, Items: []Item{}},
+	}}
+	assert.NoError(t, follower.Apply(snapshot))
+	assert.True(t, follower.Synced())
+
+	// Sequence 2 got lost
+	err := follower.Apply(ReplicationEvent{Epoch: "e1", Sequence: 3, Kind: ReplicationMutation, Mutation: Mutation{Op: MutationInsert, Key: "key2", NewValue: "value2", Version: 2}})
+	assert.True(t, errors.Is(err, errReplicationGap))
+	assert.False(t, follower.Synced())
+
+	assert.NoError(t, follower.Apply(ReplicationEvent{Epoch: "e1", Sequence: 4, Kind: ReplicationSnapshot, Since: 4, Maps: []ItemsResponse{
+		{Namespace: DefaultNamespace, Version: 2, Items: []Item{{"key1", "value1"}, {"key2", "value2"}}},
+	}}))
+	assert.True(t, follower.Synced())
+	value, ok := follower.registry.maps[DefaultNamespace].Get("key1")
+	assert.True(t, ok)
+	assert.Equal(t, "value1", value)
+
+	// The restarted primary starts over in a new epoch
+	assert.NoError(t, follower.Apply(ReplicationEvent{Epoch: "e2", Sequence: 1, Kind: ReplicationMutation, Mutation: Mutation{Op: MutationInsert, Key: "key3", NewValue: "value3", Version: 1}}))
+	assert.False(t, follower.Synced())
+}
+
+func TestReplicationFollowerDetectsDivergence(t *testing.T) {
+	follower := initializeFollower()
+	assert.NoError(t, follower.Apply(ReplicationEvent{Epoch: "e1", Sequence: 1, Kind: ReplicationSnapshot, Since: 1, Maps: []ItemsResponse{
+		{Namespace: DefaultNamespace, Version: 1, Items: []Item{{"key1", "value1"}}},
+	}}))
+
+	err := follower.Apply(ReplicationEvent{Epoch: "e1", Sequence: 2, Kind: ReplicationMutation, Mutation: Mutation{Op: MutationInsert, Key: "key1", NewValue: "value2", Version: 2}})
+	assert.True(t, errors.Is(err, errReplicationDiverged))
+	assert.False(t, follower.Synced())
+}
+
+func TestRegistryRestoreKeepsBlockingPopLimit(t *testing.T) {
+	fileWriterMock, registry := initializeRegistry()
+	registry.SetBlockingPopLimit(0)
+	registry.restore([]ItemsResponse{{Namespace: "team1", Version: 1, Items: []Item{{"key1", "value1"}}}})
+
+	for _, namespace := range []string{DefaultNamespace, "team1"} {
+		om, ok := registry.Map(namespace)
+		assert.True(t, ok)
+		assert.Equal(t, registry.blockingPops, om.blockingPops, namespace)
+	}
+	// No room for any waiting pop, the restored maps included
+	fileWriterMock.On("Write", "BlockingPopFront: Too many blocking pops waiting, try again later\n").Once()
+	assert.NoError(t, registry.ExecuteCommand(&shared.Command{Action: shared.BlockingPopFront, Timeout: "5s"}))
+	fileWriterMock.AssertExpectations(t)
+}
+
+func TestRegistryRestoreDropsMissingMaps(t *testing.T) {
+	_, registry := initializeRegistry()
+	registry.getOrCreate("team1")
+	registry.getOrCreate("team2")
+	var dropped []string
+	registry.OnMutation(func(namespace string, mutation Mutation) {
+		if mutation.Op == MutationDrop {
+			dropped = append(dropped, namespace)
+		}
+	})
+
+	registry.restore([]ItemsResponse{{Namespace: "team1", Version: 1, Items: []Item{{"key1", "value1"}}}})
+	assert.Equal(t, []string{"team2"}, dropped)
+	_, ok := registry.Map("team2")
+	assert.False(t, ok)
+}
@@ -0,0 +1,185 @@
+package consumer
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Suffix of the rotated files, sorts in the rotation order
+const rotatedFileTimeFormat = "20060102-150405.000000"
+
+// RotationConfig describes when the FileWriterImpl moves the current file away and starts a new one.
+// The zero value never rotates.
+type RotationConfig struct {
+	// MaxSize rotates the file before it grows over the size in bytes, 0 disables it
+	MaxSize int64
+	// MaxAge rotates the file that has been written to for that long, 0 disables it
+	MaxAge time.Duration
+	// Retention is the number of the rotated files kept, the oldest ones are removed. 0 keeps all of them
+	Retention int
+	// Compress gzips the rotated files
+	Compress bool
+}
+
+// open opens the file for appending and restarts the age based rotation.
+func (fw *FileWriterImpl) open() error {
+	file, err := os.OpenFile(fw.filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	fw.file = file
+	fw.buffer = bufio.NewWriter(file)
+	fw.size = info.Size()
+	fw.fail(nil)
+	if fw.config.Rotation.MaxAge > 0 {
+		if fw.rotateTimer != nil {
+			fw.rotateTimer.Stop()
+		}
+		fw.rotateTimer = time.NewTimer(fw.config.Rotation.MaxAge)
+	}
+	return nil
+}
+
+func (fw *FileWriterImpl) closeFile() {
+	if fw.rotateTimer != nil {
+		fw.rotateTimer.Stop()
+	}
+	if fw.file == nil {
+		return
+	}
+	if err := fw.flush(fw.config.Sync != SyncNever); err != nil {
+		fw.logger.Error("Error flushing file", "file", fw.filename, "error", err)
+	}
+	if err := fw.file.Close(); err != nil {
+		fw.logger.Error("Error closing file", "file", fw.filename, "error", err)
+	}
+	fw.file = nil
+	fw.buffer = nil
+}
+
+// rotateTimerC is nil, so never ready, when the age based rotation is disabled.
+func (fw *FileWriterImpl) rotateTimerC() <-chan time.Time {
+	if fw.rotateTimer == nil {
+		return nil
+	}
+	return fw.rotateTimer.C
+}
+
+// reopen closes and opens the same file name again.
+func (fw *FileWriterImpl) reopen() {
+	fw.closeFile()
+	if err := fw.open(); err != nil {
+		fw.logger.Error("Error reopening file", "file", fw.filename, "error", err)
+		fw.fail(err)
+	}
+}
+
+// rotate moves the current file away, opens a new one and cleans up the rotated files over the retention.
+func (fw *FileWriterImpl) rotate() {
+	if fw.file != nil && fw.size == 0 {
+		// Nothing to rotate, just start counting the age again
+		if fw.rotateTimer != nil {
+			fw.rotateTimer.Reset(fw.config.Rotation.MaxAge)
+		}
+		return
+	}
+	fw.closeFile()
+	rotatedFileName := fw.filename + "." + time.Now().UTC().Format(rotatedFileTimeFormat)
+	if err := os.Rename(fw.filename, rotatedFileName); err != nil {
+		fw.logger.Error("Error rotating file", "file", fw.filename, "error", err)
+	} else if fw.config.Rotation.Compress {
+		fw.compressWg.Add(1)
+		go func() {
+			defer fw.compressWg.Done()
+			if err := compressFile(rotatedFileName); err != nil {
+				fw.logger.Error("Error compressing rotated file", "file", fw.filename, "error", err)
+			}
+			fw.removeOverRetention()
+		}()
+	}
+	if err := fw.open(); err != nil {
+		fw.logger.Error("Error opening file", "file", fw.filename, "error", err)
+		fw.fail(err)
+	}
+	if !fw.config.Rotation.Compress {
+		fw.removeOverRetention()
+	}
+}
+
+// rotatedFiles returns the names of the rotated files without the .gz extension from the oldest to the newest.
+// The file being compressed exists both with and without the extension, it is still listed once.
+func (fw *FileWriterImpl) rotatedFiles() ([]string, error) {
+	matches, err := filepath.Glob(fw.filename + ".*")
+	if err != nil {
+		return nil, err
+	}
+	var rotated []string
+	seen := make(map[string]bool)
+	for _, match := range matches {
+		name := strings.TrimSuffix(match, ".gz")
+		if _, err := time.Parse(rotatedFileTimeFormat, strings.TrimPrefix(name, fw.filename+".")); err != nil || seen[name] {
+			continue
+		}
+		seen[name] = true
+		rotated = append(rotated, name)
+	}
+	sort.Strings(rotated)
+	return rotated, nil
+}
+
+func (fw *FileWriterImpl) removeOverRetention() {
+	if fw.config.Rotation.Retention <= 0 {
+		return
+	}
+	rotated, err := fw.rotatedFiles()
+	if err != nil {
+		fw.logger.Error("Error listing rotated files", "file", fw.filename, "error", err)
+		return
+	}
+	for len(rotated) > fw.config.Rotation.Retention {
+		for _, name := range []string{rotated[0], rotated[0] + ".gz"} {
+			if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+				fw.logger.Error("Error removing rotated file", "file", fw.filename, "error", err)
+			}
+		}
+		rotated = rotated[1:]
+	}
+}
+
+// compressFile replaces the file with its gzipped version.
+func compressFile(fileName string) error {
+	source, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	target, err := os.OpenFile(fileName+".gz", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(target)
+	if _, err := io.Copy(gz, source); err != nil {
+		_ = target.Close()
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		_ = target.Close()
+		return err
+	}
+	if err := target.Close(); err != nil {
+		return err
+	}
+	return os.Remove(fileName)
+}
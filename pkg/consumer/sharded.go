@@ -0,0 +1,74 @@
+package consumer
+
+import (
+	"github.com/kgara/cmdhandler/pkg/orderedmap"
+	"github.com/kgara/cmdhandler/pkg/shared"
+)
+
+// ShardedOrderedMapImpl is the lower contention alternative to OrderedMapImpl: keys are spread over
+// independently locked shards, so the workers adding and deleting different keys do not wait for each other.
+// Only the basic AddItem, DeleteItem, GetItem and GetAllItems actions of the default namespace are supported.
+type ShardedOrderedMapImpl struct {
+	items      *orderedmap.Sharded[string, string]
+	fileWriter FileWriter
+	// Turns the results into the output lines, DefaultFormatter if nil
+	formatter *Formatter
+}
+
+func NewShardedOrderedMap(shards int, fileWriter FileWriter) *ShardedOrderedMapImpl {
+	return &ShardedOrderedMapImpl{
+		items:      orderedmap.NewSharded[string, string](shards, orderedmap.HashString),
+		fileWriter: fileWriter,
+	}
+}
+
+// SetFormatter sets the formatter of the output lines, nil restores DefaultFormatter.
+// Must be called before the first command.
+func (om *ShardedOrderedMapImpl) SetFormatter(formatter *Formatter) {
+	om.formatter = formatter
+}
+
+func (om *ShardedOrderedMapImpl) output(result Result) error {
+	return writeResult(om.fileWriter, om.formatter, result)
+}
+
+func (om *ShardedOrderedMapImpl) ExecuteCommand(cmd *shared.Command) error {
+	if cmd.Namespace != DefaultNamespace {
+		return om.output(Result{Action: actionName(cmd.Action), Command: cmd.Action.String(), Outcome: OutcomeUnsupported, Namespace: cmd.Namespace})
+	}
+	switch cmd.Action {
+	case shared.AddItem:
+		// Same as in OrderedMapImpl, replacing keeps the initial order
+		if _, replaced := om.items.Set(cmd.Key, cmd.Value); replaced {
+			return om.output(Result{Action: "AddItem", Outcome: OutcomeReplaced, Key: cmd.Key, Value: cmd.Value})
+		} else {
+			return om.output(Result{Action: "AddItem", Outcome: OutcomeAdded, Key: cmd.Key, Value: cmd.Value})
+		}
+	case shared.DeleteItem:
+		if _, ok := om.items.Delete(cmd.Key); ok {
+			return om.output(Result{Action: "DeleteItem", Outcome: OutcomeDeleted, Key: cmd.Key})
+		} else {
+			return om.output(Result{Action: "DeleteItem", Outcome: OutcomeNotFound, Key: cmd.Key})
+		}
+	case shared.GetItem:
+		if value, ok := om.items.Get(cmd.Key); ok {
+			return om.output(Result{Action: "GetItem", Outcome: OutcomeFound, Key: cmd.Key, Value: value})
+		} else {
+			return om.output(Result{Action: "GetItem", Outcome: OutcomeNotFound, Key: cmd.Key})
+		}
+	case shared.GetAllItems:
+		var position int
+		for key, value := range om.items.All() {
+			if err := om.output(Result{Action: "GetAllItems", Outcome: OutcomeItem, Position: position, Key: key, Value: value}); err != nil {
+				return err
+			}
+			position++
+		}
+		if position == 0 {
+			return om.output(Result{Action: "GetAllItems", Outcome: OutcomeEmpty})
+		}
+		return nil
+	default:
+		return om.output(Result{Action: actionName(cmd.Action), Command: cmd.Action.String(), Outcome: OutcomeUnsupported})
+	}
+}
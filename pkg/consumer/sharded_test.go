@@ -0,0 +1,73 @@
+package consumer
+
+import (
+	"fmt"
+	"github.com/kgara/cmdhandler/pkg/shared"
+	"github.com/stretchr/testify/mock"
+	"sync/atomic"
+	"testing"
+)
+
+func TestShardedExecuteCommand(t *testing.T) {
+	fileWriterMock := &FileWriterMock{}
+	om := NewShardedOrderedMap(4, fileWriterMock)
+
+	fileWriterMock.On("Write", "GetAllItems: Empty map\n").Once()
+	om.ExecuteCommand(&shared.Command{Action: shared.GetAllItems})
+
+	for i := 0; i < 10; i++ {
+		fileWriterMock.On("Write", mock.Anything).Once()
+		om.ExecuteCommand(&shared.Command{Action: shared.AddItem, Key: fmt.Sprintf("key%d", i), Value: fmt.Sprintf("value%d", i)})
+	}
+
+	fileWriterMock.On("Write", "AddItem: Replaced item successfully. Key: key0, Value: replaced\n").Once()
+	om.ExecuteCommand(&shared.Command{Action: shared.AddItem, Key: "key0", Value: "replaced"})
+
+	fileWriterMock.On("Write", "DeleteItem: Deleted item successfully. Key: key1\n").Once()
+	om.ExecuteCommand(&shared.Command{Action: shared.DeleteItem, Key: "key1"})
+
+	fileWriterMock.On("Write", "GetItem: Key key1 not found\n").Once()
+	om.ExecuteCommand(&shared.Command{Action: shared.GetItem, Key: "key1"})
+
+	fileWriterMock.On("Write", "GetAllItems: Position: 0, Key: key0, Value: replaced\n").Once()
+	for i := 2; i < 10; i++ {
+		fileWriterMock.On("Write", fmt.Sprintf("GetAllItems: Position: %d, Key: key%d, Value: value%d\n", i-1, i, i)).Once()
+	}
+	om.ExecuteCommand(&shared.Command{Action: shared.GetAllItems})
+
+	fileWriterMock.On("Write", "Action: popFront, is not supported\n").Once()
+	om.ExecuteCommand(&shared.Command{Action: shared.PopFront})
+
+	// Only the default namespace is there
+	fileWriterMock.On("Write", "Action: getItem, is not supported\n").Once()
+	om.ExecuteCommand(&shared.Command{Action: shared.GetItem, Key: "key0", Namespace: "team1"})
+
+	fileWriterMock.AssertExpectations(t)
+}
+
+type discardWriter struct{}
+
+func (discardWriter) Write(string) error { return nil }
+
+func benchmarkExecuteCommand(b *testing.B, om OrderedMap) {
+	var worker atomic.Int64
+	b.RunParallel(func(pb *testing.PB) {
+		// Every worker has its own keys, as the producers with different scenarios would
+		prefix := fmt.Sprintf("worker%d-", worker.Add(1))
+		i := 0
+		for pb.Next() {
+			key := prefix + fmt.Sprint(i%1024)
+			om.ExecuteCommand(&shared.Command{Action: shared.AddItem, Key: key, Value: key})
+			om.ExecuteCommand(&shared.Command{Action: shared.DeleteItem, Key: key})
+			i++
+		}
+	})
+}
+
+func BenchmarkOrderedMapExecuteCommand(b *testing.B) {
+	benchmarkExecuteCommand(b, NewOrderedMap(discardWriter{}))
+}
+
+func BenchmarkShardedOrderedMapExecuteCommand(b *testing.B) {
+	benchmarkExecuteCommand(b, NewShardedOrderedMap(16, discardWriter{}))
+}
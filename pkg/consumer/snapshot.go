@@ -0,0 +1,90 @@
+package consumer
+
+import "iter"
+
+// Snapshot is an immutable view of the ordered map at a version, reading it never blocks the writers.
+// Readers asking for the snapshot of the same version at once share a single copy.
+// Every snapshot must be released once it is not needed anymore, the copy is freed with the last reference.
+type Snapshot struct {
+	version uint64
+	entries []entry
+	// Guarded by the owner snapshotsMu
+	refs  int
+	owner *OrderedMapImpl
+}
+
+// Version is the number of mutations applied to the map before the snapshot was taken.
+func (s *Snapshot) Version() uint64 {
+	return s.version
+}
+
+// Len returns the number of keys in the snapshot.
+func (s *Snapshot) Len() int {
+	return len(s.entries)
+}
+
+// All iterates over the key-value pairs of the snapshot in the insertion order.
+func (s *Snapshot) All() iter.Seq2[string, string] {
+	return func(yield func(string, string) bool) {
+		for _, e := range s.entries {
+			if !yield(e.key, e.value) {
+				return
+			}
+		}
+	}
+}
+
+// Release gives the snapshot back, it must not be used afterward.
+func (s *Snapshot) Release() {
+	s.owner.releaseSnapshot(s)
+}
+
+// Snapshot returns the view of the current version of the map, taking a new copy unless another reader
+// still holds the snapshot of this version. The copy is done under the read lock, but it is
+// just memory, the slow reading of the snapshot (e.g. writing it out) happens without holding any lock.
+func (om *OrderedMapImpl) Snapshot() *Snapshot {
+	om.rlock()
+	defer om.mu.RUnlock()
+	om.snapshotsMu.Lock()
+	defer om.snapshotsMu.Unlock()
+
+	if snapshot, ok := om.snapshots[om.version]; ok {
+		snapshot.refs++
+		return snapshot
+	}
+
+	entries := make([]entry, 0, om.items.Len())
+	for _, e := range om.items.All() {
+		entries = append(entries, e)
+	}
+	snapshot := &Snapshot{
+		version: om.version,
+		entries: entries,
+		refs:    1,
+		owner:   om,
+	}
+	om.snapshots[om.version] = snapshot
+	return snapshot
+}
+
+// releaseSnapshot drops the reference, freeing the copy with the last one.
+func (om *OrderedMapImpl) releaseSnapshot(snapshot *Snapshot) {
+	om.snapshotsMu.Lock()
+	defer om.snapshotsMu.Unlock()
+	snapshot.refs--
+	if snapshot.refs > 0 {
+		return
+	}
+	if om.snapshots[snapshot.version] == snapshot {
+		delete(om.snapshots, snapshot.version)
+	}
+	snapshot.entries = nil
+}
+
+// invalidateSnapshot stops sharing the snapshot of the current version, its readers keep it until they release it.
+// Must be called with the write lock held.
+func (om *OrderedMapImpl) invalidateSnapshot() {
+	om.snapshotsMu.Lock()
+	defer om.snapshotsMu.Unlock()
+	delete(om.snapshots, om.version)
+}
@@ -0,0 +1,101 @@
+package consumer
+
+import (
+	"github.com/kgara/cmdhandler/pkg/shared"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"testing"
+)
+
+func snapshotKeys(snapshot *Snapshot) []string {
+	var keys []string
+	for key := range snapshot.All() {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func TestSnapshotIsolation(t *testing.T) {
+	fileWriterMock, om := initialize()
+	addItems(fileWriterMock, om, "key1", "value1", "key2", "value2")
+
+	snapshot := om.Snapshot()
+	defer snapshot.Release()
+
+	fileWriterMock.On("Write", mock.Anything).Times(3)
+	om.ExecuteCommand(&shared.Command{Action: shared.DeleteItem, Key: "key1"})
+	om.ExecuteCommand(&shared.Command{Action: shared.AddItem, Key: "key2", Value: "changed"})
+	om.ExecuteCommand(&shared.Command{Action: shared.AddItem, Key: "key3", Value: "value3"})
+
+	assert.Equal(t, uint64(2), snapshot.Version())
+	assert.Equal(t, 2, snapshot.Len())
+	assert.Equal(t, []string{"key1", "key2"}, snapshotKeys(snapshot))
+	for key, value := range snapshot.All() {
+		if key == "key2" {
+			assert.Equal(t, "value2", value)
+		}
+	}
+
+	current := om.Snapshot()
+	defer current.Release()
+	assert.Equal(t, uint64(5), current.Version())
+	assert.Equal(t, []string{"key2", "key3"}, snapshotKeys(current))
+}
+
+func TestSnapshotSharingAndGarbageCollection(t *testing.T) {
+	fileWriterMock, om := initialize()
+	addItems(fileWriterMock, om, "key1", "value1")
+
+	first := om.Snapshot()
+	second := om.Snapshot()
+	assert.Same(t, first, second)
+	first.Release()
+	assert.Len(t, om.snapshots, 1)
+
+	// The copy is freed with the last reference
+	second.Release()
+	assert.Empty(t, om.snapshots)
+	assert.Nil(t, first.entries)
+
+	third := om.Snapshot()
+	assert.NotSame(t, first, third)
+
+	// The mutation stops sharing the outdated snapshot, its reader still holds it
+	addItems(fileWriterMock, om, "key2", "value2")
+	assert.Empty(t, om.snapshots)
+	assert.Equal(t, []string{"key1"}, snapshotKeys(third))
+	fourth := om.Snapshot()
+	assert.NotSame(t, third, fourth)
+	assert.Len(t, om.snapshots, 1)
+
+	third.Release()
+	assert.Len(t, om.snapshots, 1)
+	assert.Equal(t, []string{"key1", "key2"}, snapshotKeys(fourth))
+	fourth.Release()
+	assert.Empty(t, om.snapshots)
+}
+
+func TestGetAllItemsFreesSnapshot(t *testing.T) {
+	fileWriterMock, om := initialize()
+	addItems(fileWriterMock, om, "key1", "value1")
+	fileWriterMock.On("Write", "GetAllItems: Position: 0, Key: key1, Value: value1\n").Once()
+
+	om.ExecuteCommand(&shared.Command{Action: shared.GetAllItems})
+	fileWriterMock.AssertExpectations(t)
+	assert.Empty(t, om.snapshots)
+}
+
+func TestGetAllItemsDoesNotBlockWriters(t *testing.T) {
+	fileWriterMock, om := initialize()
+	addItems(fileWriterMock, om, "key1", "value1", "key2", "value2")
+
+	// The writer adds an item while GetAllItems is still writing out, that would deadlock under the map lock
+	fileWriterMock.On("Write", "GetAllItems: Position: 0, Key: key1, Value: value1\n").Once().Run(func(mock.Arguments) {
+		om.ExecuteCommand(&shared.Command{Action: shared.AddItem, Key: "key3", Value: "value3"})
+	})
+	fileWriterMock.On("Write", "AddItem: Added item successfully. Key: key3, Value: value3\n").Once()
+	fileWriterMock.On("Write", "GetAllItems: Position: 1, Key: key2, Value: value2\n").Once()
+	om.ExecuteCommand(&shared.Command{Action: shared.GetAllItems})
+
+	fileWriterMock.AssertExpectations(t)
+}
@@ -0,0 +1,166 @@
+package consumer
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"sync"
+)
+
+const (
+	// Length, its checksum and the payload checksum in front of every stored record
+	storeHeaderSize = 12
+	// Longer length is never written
+	maxStoreRecordSize = 64 << 20
+)
+
+// errStoreCorrupted is returned for the damaged record which can not be the torn last one
+var errStoreCorrupted = errors.New("store record corrupted")
+
+// StoreRecord is the OutputRecord numbered by the store.
+type StoreRecord struct {
+	Sequence uint64
+	OutputRecord
+}
+
+// storeSink is the embedded append-only store of the output records.
+// Every record is framed as 4 bytes of the big-endian payload length, 4 bytes of the CRC-32 (IEEE) of the length,
+// 4 bytes of the payload CRC-32 and the JSON encoded StoreRecord. The length is checked before it is trusted,
+// so the damaged one never passes for the end of the file. The record torn by a crash at the end of the file
+// is cut off on Start, so the file always holds the complete records only. The damaged record anywhere else
+// fails Start, leaving the file as it is. Read it back with ReadStore.
+// It is never rotated, that would split the sequence over several files.
+type storeSink struct {
+	*FileWriterImpl
+	mu sync.Mutex
+	// Sequence of the last record, guarded by mu
+	sequence uint64
+}
+
+func newStoreSink(target *url.URL, config FileWriterConfig, logger *slog.Logger) (Sink, error) {
+	name, err := sinkPath(target)
+	if err != nil {
+		return nil, err
+	}
+	config.Rotation = RotationConfig{}
+	return &storeSink{FileWriterImpl: newFileWriter("store", name, config, logger)}, nil
+}
+
+// Start recovers the store and starts writing to it.
+func (s *storeSink) Start() error {
+	records, validSize, err := readStore(s.filename)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err == nil {
+		if info, err := os.Stat(s.filename); err == nil && info.Size() > validSize {
+			s.logger.Warn("Cutting off the torn record", "file", s.filename, "offset", validSize)
+			if err := os.Truncate(s.filename, validSize); err != nil {
+				return err
+			}
+		}
+	}
+	if len(records) > 0 {
+		s.sequence = records[len(records)-1].Sequence
+	}
+	return s.FileWriterImpl.Start()
+}
+
+func (s *storeSink) Write(content string) error {
+	return s.writeRecord(parseOutputLine(content))
+}
+
+func (s *storeSink) WriteResult(formatter *Formatter, result Result) error {
+	record, err := formatter.Record(result)
+	if err != nil {
+		return err
+	}
+	return s.writeRecord(record)
+}
+
+func (s *storeSink) writeRecord(record OutputRecord) error {
+	// Numbering and queueing under the same lock, so the records are stored in the sequence order
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	payload, err := json.Marshal(StoreRecord{Sequence: s.sequence + 1, OutputRecord: record})
+	if err != nil {
+		return err
+	}
+	frame := make([]byte, storeHeaderSize, storeHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(frame, uint32(len(payload)))
+	binary.BigEndian.PutUint32(frame[4:], crc32.ChecksumIEEE(frame[:4]))
+	binary.BigEndian.PutUint32(frame[8:], crc32.ChecksumIEEE(payload))
+	if err := s.FileWriterImpl.Write(string(append(frame, payload...))); err != nil {
+		return err
+	}
+	s.sequence++
+	return nil
+}
+
+// ReadStore reads all the complete records of the store file written by the store:// output.
+func ReadStore(fileName string) ([]StoreRecord, error) {
+	records, _, err := readStore(fileName)
+	return records, err
+}
+
+// readStore reads the records up to the torn one at the end of the file, returning the size of the valid part.
+// The torn record is either the header cut short, or the header running past the end of the file, or the payload
+// ending right at the end of the file with the wrong checksum. Any other damage is reported as errStoreCorrupted.
+func readStore(fileName string) ([]StoreRecord, int64, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	reader := bufio.NewReader(file)
+	var records []StoreRecord
+	var validSize int64
+	header := make([]byte, storeHeaderSize)
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return records, validSize, nil
+			}
+			return nil, 0, err
+		}
+		if crc32.ChecksumIEEE(header[:4]) != binary.BigEndian.Uint32(header[4:]) {
+			return nil, 0, fmt.Errorf("header at %d of store %s: %w", validSize, fileName, errStoreCorrupted)
+		}
+		size := binary.BigEndian.Uint32(header)
+		if size > maxStoreRecordSize {
+			return nil, 0, fmt.Errorf("record at %d of store %s is %d bytes long: %w", validSize, fileName, size, errStoreCorrupted)
+		}
+		// The length is intact, so only the record torn by a crash runs past the end of the file
+		if validSize+storeHeaderSize+int64(size) > info.Size() {
+			return records, validSize, nil
+		}
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			return nil, 0, err
+		}
+		if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[8:]) {
+			if validSize+storeHeaderSize+int64(size) == info.Size() {
+				return records, validSize, nil
+			}
+			return nil, 0, fmt.Errorf("record at %d of store %s: %w", validSize, fileName, errStoreCorrupted)
+		}
+		var record StoreRecord
+		if err := json.Unmarshal(payload, &record); err != nil {
+			return nil, 0, fmt.Errorf("record at %d of store %s: %w", validSize, fileName, err)
+		}
+		records = append(records, record)
+		validSize += int64(storeHeaderSize + len(payload))
+	}
+}
@@ -0,0 +1,227 @@
+package consumer
+
+import (
+	"encoding/json"
+	"github.com/kgara/cmdhandler/pkg/shared"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Used when the Watch command does not carry its own timeout
+	defaultWatchExpiry = time.Hour
+	// Number of notifications waiting to be pushed before the new ones are dropped
+	watchNotificationBuffer = 1000
+)
+
+// Notifier pushes the data to the named queue, shared.Client is the one we use.
+type Notifier interface {
+	PushTo(queueName string, data []byte) error
+}
+
+// WatchNotification is pushed to the reply queue of the watch when a matching key changes.
+type WatchNotification struct {
+	Namespace string
+	// Pattern is the key or the prefix the watch was registered with
+	Pattern   string
+	Op        MutationOp
+	Key       string
+	OldValue  string
+	NewValue  string
+	Timestamp time.Time
+}
+
+type watch struct {
+	// Key, or the prefix followed by "*"
+	pattern string
+	replyTo string
+	expires time.Time
+}
+
+func (w *watch) matches(key string) bool {
+	if prefix, ok := strings.CutSuffix(w.pattern, "*"); ok {
+		return strings.HasPrefix(key, prefix)
+	}
+	return key == w.pattern
+}
+
+type pendingNotification struct {
+	replyTo      string
+	notification WatchNotification
+}
+
+// Watcher handles the Watch and Unwatch commands on top of the map registry and pushes
+// notifications about the changes of the watched keys. All the other commands go to the registry.
+//
+// The Watch command Key is either the exact key or the prefix followed by "*", ReplyTo is the queue
+// to push the notifications to and the optional Timeout is the watch expiry. Watching the same key
+// with the same reply queue again just extends the expiry. Notifications are best effort, they are
+// dropped when the reply queue can not keep up.
+type Watcher struct {
+	registry *MapRegistry
+	notifier Notifier
+	// Active watches by namespace
+	watches       map[string][]*watch
+	mu            sync.Mutex
+	notifications chan pendingNotification
+	closed        bool
+	wg            sync.WaitGroup
+	writerFor     func(namespace string) FileWriter
+	logger        *slog.Logger
+	now           func() time.Time
+}
+
+// NewWatcher creates a new instance of Watcher and subscribes it to the registry mutations.
+func NewWatcher(registry *MapRegistry, notifier Notifier, writerFor func(namespace string) FileWriter, logger *slog.Logger) *Watcher {
+	watcher := &Watcher{
+		registry:      registry,
+		notifier:      notifier,
+		watches:       make(map[string][]*watch),
+		notifications: make(chan pendingNotification, watchNotificationBuffer),
+		writerFor:     writerFor,
+		logger:        logger,
+		now:           time.Now,
+	}
+	registry.OnMutation(watcher.onMutation)
+	return watcher
+}
+
+func (w *Watcher) ExecuteCommand(cmd *shared.Command) error {
+	if !ValidNamespace(cmd.Namespace) {
+		return w.output(DefaultNamespace, Result{Action: actionName(cmd.Action), Command: cmd.Action.String(), Outcome: OutcomeInvalidNamespace, Namespace: cmd.Namespace})
+	}
+	switch cmd.Action {
+	case shared.Watch:
+		if cmd.Key == "" || cmd.ReplyTo == "" {
+			return w.output(cmd.Namespace, Result{Action: "Watch", Outcome: OutcomeFailed, Key: cmd.Key, ReplyTo: cmd.ReplyTo, Error: "Key and ReplyTo are required"})
+		}
+		expiry := defaultWatchExpiry
+		if cmd.Timeout != "" {
+			parsed, err := time.ParseDuration(cmd.Timeout)
+			if err != nil || parsed <= 0 {
+				return w.output(cmd.Namespace, Result{Action: "Watch", Outcome: OutcomeInvalidTimeout, Key: cmd.Key, Timeout: cmd.Timeout})
+			}
+			expiry = parsed
+		}
+		w.add(cmd.Namespace, cmd.Key, cmd.ReplyTo, expiry)
+		return w.output(cmd.Namespace, Result{Action: "Watch", Outcome: OutcomeWatched, Key: cmd.Key, ReplyTo: cmd.ReplyTo, Timeout: expiry.String()})
+	case shared.Unwatch:
+		if w.remove(cmd.Namespace, cmd.Key, cmd.ReplyTo) {
+			return w.output(cmd.Namespace, Result{Action: "Unwatch", Outcome: OutcomeUnwatched, Key: cmd.Key, ReplyTo: cmd.ReplyTo})
+		} else {
+			return w.output(cmd.Namespace, Result{Action: "Unwatch", Outcome: OutcomeNotFound, Key: cmd.Key, ReplyTo: cmd.ReplyTo})
+		}
+	default:
+		return w.registry.ExecuteCommand(cmd)
+	}
+}
+
+// output writes the result with the formatter of the registry.
+func (w *Watcher) output(namespace string, result Result) error {
+	return writeResult(w.writerFor(namespace), w.registry.formatter, result)
+}
+
+// Start starts pushing the notifications.
+func (w *Watcher) Start() {
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		for pending := range w.notifications {
+			data, err := json.Marshal(pending.notification)
+			if err != nil {
+				w.logger.Error("Error encoding watch notification", "error", err)
+				continue
+			}
+			if err := w.notifier.PushTo(pending.replyTo, data); err != nil {
+				w.logger.Error("Error pushing watch notification", "reply_to", pending.replyTo, "error", err)
+			}
+		}
+	}()
+}
+
+// Close stops the notifications and waits for the queued ones to be pushed.
+func (w *Watcher) Close() {
+	w.mu.Lock()
+	w.closed = true
+	close(w.notifications)
+	w.mu.Unlock()
+	w.wg.Wait()
+}
+
+func (w *Watcher) add(namespace, pattern, replyTo string, expiry time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	expires := w.now().Add(expiry)
+	for _, existing := range w.watches[namespace] {
+		if existing.pattern == pattern && existing.replyTo == replyTo {
+			existing.expires = expires
+			return
+		}
+	}
+	w.watches[namespace] = append(w.watches[namespace], &watch{pattern: pattern, replyTo: replyTo, expires: expires})
+}
+
+func (w *Watcher) remove(namespace, pattern, replyTo string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	watches := w.watches[namespace]
+	for i, existing := range watches {
+		if existing.pattern == pattern && existing.replyTo == replyTo {
+			w.watches[namespace] = append(watches[:i], watches[i+1:]...)
+			return existing.expires.After(w.now())
+		}
+	}
+	return false
+}
+
+// onMutation queues the notifications for the matching watches, dropping the expired ones on the way.
+func (w *Watcher) onMutation(namespace string, mutation Mutation) {
+	// The new map has no keys to watch yet
+	if mutation.Op == MutationCreate {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	now := w.now()
+	watches := w.watches[namespace]
+	active := watches[:0]
+	for _, existing := range watches {
+		if !existing.expires.After(now) {
+			continue
+		}
+		active = append(active, existing)
+		// Dropping the map touches all of its keys
+		if mutation.Op != MutationDrop && !existing.matches(mutation.Key) {
+			continue
+		}
+		w.queue(existing.replyTo, WatchNotification{
+			Namespace: namespace,
+			Pattern:   existing.pattern,
+			Op:        mutation.Op,
+			Key:       mutation.Key,
+			OldValue:  mutation.OldValue,
+			NewValue:  mutation.NewValue,
+			Timestamp: now.UTC(),
+		})
+	}
+	if len(active) == 0 {
+		delete(w.watches, namespace)
+	} else {
+		w.watches[namespace] = active
+	}
+}
+
+// queue hands the notification over to the pushing goroutine without blocking the map writers.
+// Must be called with the lock held.
+func (w *Watcher) queue(replyTo string, notification WatchNotification) {
+	if w.closed {
+		return
+	}
+	select {
+	case w.notifications <- pendingNotification{replyTo: replyTo, notification: notification}:
+	default:
+		w.logger.Warn("Watch notifications buffer is full, dropping the notification", "op", notification.Op, "key", notification.Key, "reply_to", replyTo)
+	}
+}
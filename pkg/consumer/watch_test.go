@@ -0,0 +1,126 @@
+package consumer
+
+import (
+	"encoding/json"
+	"github.com/kgara/cmdhandler/pkg/shared"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"io"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+)
+
+type notifierStub struct {
+	mu     sync.Mutex
+	pushed map[string][]WatchNotification
+}
+
+func (n *notifierStub) PushTo(queueName string, data []byte) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	notification := WatchNotification{}
+	if err := json.Unmarshal(data, &notification); err != nil {
+		return err
+	}
+	n.pushed[queueName] = append(n.pushed[queueName], notification)
+	return nil
+}
+
+func initializeWatcher() (*FileWriterMock, *notifierStub, *Watcher, *time.Time) {
+	fileWriterMock, registry := initializeRegistry()
+	notifier := &notifierStub{pushed: make(map[string][]WatchNotification)}
+	writerFor := func(string) FileWriter { return fileWriterMock }
+	watcher := NewWatcher(registry, notifier, writerFor, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	watcher.now = func() time.Time { return now }
+	watcher.Start()
+	return fileWriterMock, notifier, watcher, &now
+}
+
+func TestWatcherNotifiesMatchingKeys(t *testing.T) {
+	fileWriterMock, notifier, watcher, _ := initializeWatcher()
+
+	fileWriterMock.On("Write", "Watch: Key: key1, ReplyTo: replies1, Expires in: 1h0m0s\n").Once()
+	watcher.ExecuteCommand(&shared.Command{Action: shared.Watch, Key: "key1", ReplyTo: "replies1"})
+
+	fileWriterMock.On("Write", "Watch: Key: user/*, ReplyTo: replies2, Expires in: 5m0s\n").Once()
+	watcher.ExecuteCommand(&shared.Command{Action: shared.Watch, Key: "user/*", ReplyTo: "replies2", Timeout: "5m"})
+
+	fileWriterMock.On("Write", mock.Anything).Times(4)
+	watcher.ExecuteCommand(&shared.Command{Action: shared.AddItem, Key: "key1", Value: "value1"})
+	watcher.ExecuteCommand(&shared.Command{Action: shared.AddItem, Key: "key2", Value: "value2"})
+	watcher.ExecuteCommand(&shared.Command{Action: shared.AddItem, Key: "user/1", Value: "alice"})
+	watcher.ExecuteCommand(&shared.Command{Action: shared.DeleteItem, Key: "key1"})
+	// Same key in a different namespace is a different key
+	fileWriterMock.On("Write", mock.Anything).Once()
+	watcher.ExecuteCommand(&shared.Command{Action: shared.AddItem, Key: "key1", Value: "value1", Namespace: "team1"})
+	watcher.Close()
+
+	assert.Len(t, notifier.pushed["replies1"], 2)
+	assert.Equal(t, MutationInsert, notifier.pushed["replies1"][0].Op)
+	assert.Equal(t, "value1", notifier.pushed["replies1"][0].NewValue)
+	assert.Equal(t, MutationDelete, notifier.pushed["replies1"][1].Op)
+	assert.Len(t, notifier.pushed["replies2"], 1)
+	assert.Equal(t, "user/*", notifier.pushed["replies2"][0].Pattern)
+	assert.Equal(t, "user/1", notifier.pushed["replies2"][0].Key)
+	fileWriterMock.AssertExpectations(t)
+}
+
+func TestWatcherExpiryAndCancellation(t *testing.T) {
+	fileWriterMock, notifier, watcher, now := initializeWatcher()
+
+	fileWriterMock.On("Write", mock.Anything).Times(2)
+	watcher.ExecuteCommand(&shared.Command{Action: shared.Watch, Key: "key1", ReplyTo: "replies1", Timeout: "1m"})
+	watcher.ExecuteCommand(&shared.Command{Action: shared.Watch, Key: "key2", ReplyTo: "replies2"})
+
+	*now = now.Add(2 * time.Minute)
+	fileWriterMock.On("Write", mock.Anything).Once()
+	watcher.ExecuteCommand(&shared.Command{Action: shared.AddItem, Key: "key1", Value: "value1"})
+
+	fileWriterMock.On("Write", "Unwatch: Watch of key key1 for replies1 not found\n").Once()
+	watcher.ExecuteCommand(&shared.Command{Action: shared.Unwatch, Key: "key1", ReplyTo: "replies1"})
+
+	fileWriterMock.On("Write", "Unwatch: Key: key2, ReplyTo: replies2\n").Once()
+	watcher.ExecuteCommand(&shared.Command{Action: shared.Unwatch, Key: "key2", ReplyTo: "replies2"})
+
+	fileWriterMock.On("Write", mock.Anything).Once()
+	watcher.ExecuteCommand(&shared.Command{Action: shared.AddItem, Key: "key2", Value: "value2"})
+	watcher.Close()
+
+	assert.Empty(t, notifier.pushed)
+	fileWriterMock.AssertExpectations(t)
+}
+
+func TestWatcherInvalidNamespace(t *testing.T) {
+	fileWriterMock, _, watcher, _ := initializeWatcher()
+	defer watcher.Close()
+	var requested []string
+	watcher.writerFor = func(namespace string) FileWriter {
+		requested = append(requested, namespace)
+		return fileWriterMock
+	}
+
+	fileWriterMock.On("Write", "watch: Namespace \"../etc\" is not valid\n").Once()
+	watcher.ExecuteCommand(&shared.Command{Action: shared.Watch, Key: "key1", ReplyTo: "replies1", Namespace: "../etc"})
+	fileWriterMock.On("Write", "unwatch: Namespace \"../etc\" is not valid\n").Once()
+	watcher.ExecuteCommand(&shared.Command{Action: shared.Unwatch, Key: "key1", ReplyTo: "replies1", Namespace: "../etc"})
+
+	assert.Empty(t, watcher.watches)
+	assert.Equal(t, []string{DefaultNamespace, DefaultNamespace}, requested)
+	fileWriterMock.AssertExpectations(t)
+}
+
+func TestWatcherInvalidCommands(t *testing.T) {
+	fileWriterMock, _, watcher, _ := initializeWatcher()
+	defer watcher.Close()
+
+	fileWriterMock.On("Write", "Watch: Key and ReplyTo are required\n").Once()
+	watcher.ExecuteCommand(&shared.Command{Action: shared.Watch, Key: "key1"})
+
+	fileWriterMock.On("Write", "Watch: Invalid timeout -1s\n").Once()
+	watcher.ExecuteCommand(&shared.Command{Action: shared.Watch, Key: "key1", ReplyTo: "replies1", Timeout: "-1s"})
+
+	fileWriterMock.AssertExpectations(t)
+}
@@ -1,34 +1,148 @@
 package consumer
 
 import (
-	"log"
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"log/slog"
 	"os"
 	"sync"
+	"time"
 )
 
+// FileWriter records the results of the commands.
+// The error means the content could not be recorded, so the command should be retried later.
 type FileWriter interface {
-	Write(content string)
+	Write(content string) error
+}
+
+// ErrWriterClosed is returned by the writes made after Close.
+var ErrWriterClosed = errors.New("file writer is closed")
+
+var errWriterNotStarted = errors.New("file writer is not started")
+
+// A batch takes at most that many requests, so the steady stream of writes still lets the flushes,
+// the reopens and the rotations through
+const maxBatchRequests = 1024
+
+// The failed file is reopened after the delay, doubled up to the max while it keeps failing,
+// so a temporary disk error clears without an explicit Reopen
+const (
+	writerRetryMinDelay = 100 * time.Millisecond
+	writerRetryMaxDelay = 30 * time.Second
+)
+
+// Flusher is implemented by the writers able to make the data written so far durable.
+type Flusher interface {
+	Flush() error
+}
+
+// SyncPolicy tells when the FileWriterImpl calls fsync.
+type SyncPolicy string
+
+const (
+	// SyncNever leaves it to the OS, only the explicit Flush syncs
+	SyncNever SyncPolicy = "never"
+	// SyncEveryBatch syncs whenever the buffer is flushed
+	SyncEveryBatch SyncPolicy = "every-batch"
+	// SyncEveryWrite flushes and syncs after every single write
+	SyncEveryWrite SyncPolicy = "every-write"
+)
+
+// ParseSyncPolicy validates the policy name.
+func ParseSyncPolicy(name string) (SyncPolicy, error) {
+	switch policy := SyncPolicy(name); policy {
+	case SyncNever, SyncEveryBatch, SyncEveryWrite:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown sync policy %q", name)
+	}
+}
+
+// FileWriterConfig tunes the FileWriterImpl. The zero value writes every line as soon as it comes.
+type FileWriterConfig struct {
+	Rotation RotationConfig
+	// ChannelSize is the number of the lines waiting to be written before Write blocks
+	ChannelSize int
+	// FlushInterval keeps the lines in the buffer for up to that long, 0 flushes as soon as no more lines are waiting
+	FlushInterval time.Duration
+	Sync          SyncPolicy
+}
+
+type writeRequest struct {
+	data   string
+	queued time.Time
+	// Set for the Flush requests, receives the result once everything before the request is durable
+	flushed chan error
 }
 
 // FileWriter represents a writer that writes to a file concurrently.
+// The lines are buffered and written in batches, see FileWriterConfig.
 type FileWriterImpl struct {
 	filename string
-	dataCh   chan string
+	config   FileWriterConfig
+	dataCh   chan writeRequest
+	reopenCh chan struct{}
 	wg       sync.WaitGroup
-	logger   *log.Logger
+	logger   *slog.Logger
+	// Guards closed, held by the writes while they send to dataCh
+	mu     sync.RWMutex
+	closed bool
+	// Last failure of the file, the writes are refused until the file is open again, see armRetry
+	failure   error
+	failureMu sync.Mutex
+
+	queueDepth    prometheus.Gauge
+	writeLatency  prometheus.Observer
+	flushDuration prometheus.Observer
+
+	// Owned by the writing goroutine
+	file        *os.File
+	buffer      *bufio.Writer
+	size        int64
+	rotateTimer *time.Timer
+	// Armed while the file is failing, see armRetry
+	retryTimer *time.Timer
+	retryDelay time.Duration
+	// Compressions of the rotated files still running
+	compressWg sync.WaitGroup
 }
 
 // NewFileWriter creates a new instance of FileWriter.
-func NewFileWriter(filename string, logger *log.Logger) *FileWriterImpl {
+func NewFileWriter(filename string, logger *slog.Logger) *FileWriterImpl {
+	return NewFileWriterWithConfig(filename, FileWriterConfig{}, logger)
+}
+
+// NewFileWriterWithConfig creates a new instance of FileWriter tuned by the config.
+func NewFileWriterWithConfig(filename string, config FileWriterConfig, logger *slog.Logger) *FileWriterImpl {
+	return newFileWriter("file", filename, config, logger)
+}
+
+// newFileWriter creates the FileWriter of the sink kind, its metrics are labeled by the kind
+// rather than by the file name, as there may be a file per namespace.
+func newFileWriter(sink, filename string, config FileWriterConfig, logger *slog.Logger) *FileWriterImpl {
+	if config.Sync == "" {
+		config.Sync = SyncNever
+	}
 	return &FileWriterImpl{
 		filename: filename,
-		dataCh:   make(chan string),
+		config:   config,
+		dataCh:   make(chan writeRequest, config.ChannelSize),
+		reopenCh: make(chan struct{}, 1),
 		logger:   logger,
+		failure:  errWriterNotStarted,
+
+		queueDepth:    outputQueueDepth.WithLabelValues(sink),
+		writeLatency:  outputWriteLatency.WithLabelValues(sink),
+		flushDuration: outputFlushDuration.WithLabelValues(sink),
 	}
 }
 
-// Write writes data to the file.
-func (fw *FileWriterImpl) Write(data string) {
+// Write queues data to be written to the file.
+// The data is written asynchronously, so the error reports the failures of the earlier writes,
+// use Flush to learn the fate of this one.
+func (fw *FileWriterImpl) Write(data string) error {
 	// Writing to the file might be considered a "long io" operation.
 	// We may even delay it "intentionally", so we can run our "delivery processing" in thread pool of say cpuCores*8 threads.
 	// Technically such approach will not give much advantage.
@@ -37,32 +151,284 @@ func (fw *FileWriterImpl) Write(data string) {
 	// But as far as I understand - need to demonstrate explicit parallelism somewhere :)
 	// Intentional delay for emulating "slow io operation"
 	// <-time.After(time.Second * 10)
-	fw.dataCh <- data
+	fw.mu.RLock()
+	defer fw.mu.RUnlock()
+	if err := fw.checkWritable(); err != nil {
+		return err
+	}
+	// Shared by the writers of the same sink kind, so counted up and down rather than set
+	fw.queueDepth.Inc()
+	fw.dataCh <- writeRequest{data: data, queued: time.Now()}
+	return nil
+}
+
+// Flush blocks until everything written before the call is flushed and synced to the disk.
+// Concurrent flushes are served by a single fsync.
+func (fw *FileWriterImpl) Flush() error {
+	flushed := make(chan error, 1)
+	fw.mu.RLock()
+	if err := fw.checkWritable(); err != nil {
+		fw.mu.RUnlock()
+		return err
+	}
+	fw.dataCh <- writeRequest{flushed: flushed}
+	fw.mu.RUnlock()
+	return <-flushed
+}
+
+// checkWritable must be called with the read lock held.
+func (fw *FileWriterImpl) checkWritable() error {
+	if fw.closed {
+		return ErrWriterClosed
+	}
+	fw.failureMu.Lock()
+	defer fw.failureMu.Unlock()
+	return fw.failure
+}
+
+// fail records the failure of the file, nil clears it.
+func (fw *FileWriterImpl) fail(err error) {
+	fw.failureMu.Lock()
+	fw.failure = err
+	fw.failureMu.Unlock()
+}
+
+// failed returns the last failure of the file, nil if it is fine.
+func (fw *FileWriterImpl) failed() error {
+	fw.failureMu.Lock()
+	defer fw.failureMu.Unlock()
+	return fw.failure
+}
+
+// armRetry schedules reopening the failed file, backing off while the reopened file keeps failing.
+// Owned by the writing goroutine, like the file itself.
+func (fw *FileWriterImpl) armRetry() {
+	if fw.retryTimer != nil || fw.failed() == nil {
+		return
+	}
+	fw.retryDelay = min(writerRetryMaxDelay, max(writerRetryMinDelay, 2*fw.retryDelay))
+	fw.retryTimer = time.NewTimer(fw.retryDelay)
+}
+
+// retryTimerC is nil, so never ready, unless the file is failing.
+func (fw *FileWriterImpl) retryTimerC() <-chan time.Time {
+	if fw.retryTimer == nil {
+		return nil
+	}
+	return fw.retryTimer.C
+}
+
+// retry reopens the failed file, the writes are accepted again once it is open.
+func (fw *FileWriterImpl) retry() {
+	fw.retryTimer = nil
+	if fw.failed() == nil {
+		// Reopened explicitly meanwhile
+		fw.retryDelay = 0
+		return
+	}
+	fw.logger.Info("Reopening the failed file", "file", fw.filename, "delay", fw.retryDelay)
+	fw.reopen()
+	if fw.failed() == nil {
+		fw.retryDelay = 0
+	}
+}
+
+func (fw *FileWriterImpl) stopRetry() {
+	if fw.retryTimer != nil {
+		fw.retryTimer.Stop()
+	}
 }
 
-// Start starts the FileWriter to handle writing data to the file.
-func (fw *FileWriterImpl) Start() {
+// Start opens the file and starts the FileWriter to handle writing data to it.
+// If the file can not be opened, the error is returned and all the writes fail with it.
+func (fw *FileWriterImpl) Start() error {
+	if err := fw.open(); err != nil {
+		fw.fail(err)
+		return err
+	}
 	fw.wg.Add(1)
 	go func() {
 		defer fw.wg.Done()
-		file, err := os.OpenFile(fw.filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-		if err != nil {
-			fw.logger.Printf("Error opening file: %v\n", err)
-			return
+		defer fw.closeFile()
+		defer fw.stopRetry()
+
+		var flushTicker <-chan time.Time
+		if fw.config.FlushInterval > 0 {
+			ticker := time.NewTicker(fw.config.FlushInterval)
+			defer ticker.Stop()
+			flushTicker = ticker.C
 		}
-		defer file.Close()
 
-		for data := range fw.dataCh {
-			_, err := file.WriteString(data)
-			if err != nil {
-				fw.logger.Printf("Error writing to file: %v\n", err)
+		for {
+			fw.armRetry()
+			select {
+			case request, ok := <-fw.dataCh:
+				if !ok {
+					return
+				}
+				if !fw.writeBatch(request) {
+					return
+				}
+			case <-flushTicker:
+				if err := fw.flush(fw.config.Sync == SyncEveryBatch); err != nil {
+					fw.logger.Error("Error flushing file", "file", fw.filename, "error", err)
+					fw.fail(err)
+				}
+			case <-fw.reopenCh:
+				fw.reopen()
+			case <-fw.rotateTimerC():
+				fw.rotate()
+			case <-fw.retryTimerC():
+				fw.retry()
 			}
 		}
 	}()
+	return nil
+}
+
+// writeBatch writes the request together with the other ones already waiting in the channel, up to
+// maxBatchRequests of them. Returns false if the channel got closed.
+func (fw *FileWriterImpl) writeBatch(request writeRequest) bool {
+	var waiters []chan error
+	for taken := 1; ; taken++ {
+		if request.flushed != nil {
+			waiters = append(waiters, request.flushed)
+		} else {
+			fw.queueDepth.Dec()
+			fw.write(request.data)
+			fw.writeLatency.Observe(time.Since(request.queued).Seconds())
+		}
+
+		if taken >= maxBatchRequests {
+			fw.endBatch(waiters)
+			return true
+		}
+		select {
+		case next, ok := <-fw.dataCh:
+			if ok {
+				request = next
+				continue
+			}
+			fw.endBatch(waiters)
+			return false
+		default:
+		}
+		fw.endBatch(waiters)
+		return true
+	}
+}
+
+func (fw *FileWriterImpl) endBatch(waiters []chan error) {
+	if len(waiters) > 0 {
+		err := fw.flush(true)
+		if err != nil {
+			fw.fail(err)
+		}
+		for _, waiter := range waiters {
+			waiter <- err
+		}
+		return
+	}
+	if fw.config.FlushInterval == 0 {
+		if err := fw.flush(fw.config.Sync == SyncEveryBatch); err != nil {
+			fw.logger.Error("Error flushing file", "file", fw.filename, "error", err)
+			fw.fail(err)
+		}
+	}
+}
+
+func (fw *FileWriterImpl) write(data string) {
+	if fw.config.Rotation.MaxSize > 0 && fw.size > 0 && fw.size+int64(len(data)) > fw.config.Rotation.MaxSize {
+		fw.rotate()
+	}
+	if fw.buffer == nil {
+		fw.logger.Error("Error writing to file: file is not open, dropping the line", "file", fw.filename, "line", data)
+		return
+	}
+	n, err := fw.buffer.WriteString(data)
+	fw.size += int64(n)
+	if err != nil {
+		fw.logger.Error("Error writing to file", "file", fw.filename, "error", err)
+		fw.fail(err)
+		return
+	}
+	if fw.config.Sync == SyncEveryWrite {
+		if err := fw.flush(true); err != nil {
+			fw.logger.Error("Error flushing file", "file", fw.filename, "error", err)
+			fw.fail(err)
+		}
+	}
+}
+
+// flush writes the buffer out to the file, optionally syncing it to the disk.
+func (fw *FileWriterImpl) flush(sync bool) error {
+	if fw.buffer == nil {
+		return errors.New("file is not open")
+	}
+	start := time.Now()
+	defer func() { fw.flushDuration.Observe(time.Since(start).Seconds()) }()
+	if err := fw.buffer.Flush(); err != nil {
+		return err
+	}
+	if sync {
+		return fw.file.Sync()
+	}
+	return nil
+}
+
+// Reopen asks the writer to close and open the file again, e.g. after it was moved away by logrotate.
+// It does not wait for the file to be reopened.
+func (fw *FileWriterImpl) Reopen() {
+	select {
+	case fw.reopenCh <- struct{}{}:
+	default:
+		// Already requested
+	}
 }
 
 // Close closes the FileWriter and waits for all pending writes to complete.
 func (fw *FileWriterImpl) Close() {
+	fw.mu.Lock()
+	fw.closed = true
 	close(fw.dataCh)
+	fw.mu.Unlock()
 	fw.wg.Wait()
+	fw.compressWg.Wait()
+}
+
+// NamespacedWriter tells the results of the namespace apart, so several maps may share a single output.
+// The results get the namespace set, the text lines are prefixed with it as well.
+type NamespacedWriter struct {
+	namespace string
+	writer    FileWriter
+}
+
+// NewNamespacedWriter creates a new instance of NamespacedWriter on top of the given writer.
+func NewNamespacedWriter(namespace string, writer FileWriter) *NamespacedWriter {
+	return &NamespacedWriter{
+		namespace: namespace,
+		writer:    writer,
+	}
+}
+
+// Write writes the prefixed data to the underlying writer.
+func (nw *NamespacedWriter) Write(data string) error {
+	return nw.writer.Write(fmt.Sprintf("[%s] %s", nw.namespace, data))
+}
+
+// WriteResult writes the result of the namespace to the underlying writer.
+func (nw *NamespacedWriter) WriteResult(formatter *Formatter, result Result) error {
+	// Set already by the map management commands, e.g. the namespaces listed by ListMaps
+	if result.Namespace == "" {
+		result.Namespace = nw.namespace
+	}
+	return writeResult(nw.writer, formatter.forNamespace(nw.namespace), result)
+}
+
+// Flush flushes the underlying writer, if it is able to.
+func (nw *NamespacedWriter) Flush() error {
+	if flusher, ok := nw.writer.(Flusher); ok {
+		return flusher.Flush()
+	}
+	return nil
 }
@@ -0,0 +1,170 @@
+package consumer
+
+import (
+	"compress/gzip"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func readFile(t *testing.T, fileName string) string {
+	content, err := os.ReadFile(fileName)
+	assert.NoError(t, err)
+	return string(content)
+}
+
+func TestFileWriterRotatesBySize(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "output.txt")
+	fw := NewFileWriterWithConfig(fileName, FileWriterConfig{Rotation: RotationConfig{MaxSize: 10, Retention: 2}}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	assert.NoError(t, fw.Start())
+	for _, line := range []string{"line1\n", "line2\n", "line3\n", "line4\n", "line5\n"} {
+		fw.Write(line)
+		// Rotated file names are based on time
+		time.Sleep(time.Millisecond)
+	}
+	fw.Close()
+
+	assert.Equal(t, "line5\n", readFile(t, fileName))
+	rotated, err := fw.rotatedFiles()
+	assert.NoError(t, err)
+	assert.Len(t, rotated, 2)
+	assert.Equal(t, "line3\n", readFile(t, rotated[0]))
+	assert.Equal(t, "line4\n", readFile(t, rotated[1]))
+}
+
+func TestFileWriterRotatesByAgeAndCompresses(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "output.txt")
+	fw := NewFileWriterWithConfig(fileName, FileWriterConfig{Rotation: RotationConfig{MaxAge: 100 * time.Millisecond, Compress: true}}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	assert.NoError(t, fw.Start())
+	fw.Write("old\n")
+	time.Sleep(150 * time.Millisecond)
+	fw.Write("new\n")
+	fw.Close()
+
+	assert.Equal(t, "new\n", readFile(t, fileName))
+	rotated, err := fw.rotatedFiles()
+	assert.NoError(t, err)
+	assert.Len(t, rotated, 1)
+	_, err = os.Stat(rotated[0])
+	assert.True(t, os.IsNotExist(err))
+
+	file, err := os.Open(rotated[0] + ".gz")
+	assert.NoError(t, err)
+	defer file.Close()
+	gz, err := gzip.NewReader(file)
+	assert.NoError(t, err)
+	content, err := io.ReadAll(gz)
+	assert.NoError(t, err)
+	assert.Equal(t, "old\n", string(content))
+}
+
+func TestFileWriterReopen(t *testing.T) {
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "output.txt")
+	fw := NewFileWriter(fileName, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	assert.NoError(t, fw.Start())
+	fw.Write("before\n")
+
+	// The way logrotate does it
+	assert.NoError(t, os.Rename(fileName, filepath.Join(dir, "output.txt.1")))
+	fw.Reopen()
+	// The writer serves the reopen request before the next data, as it waits on both of them
+	time.Sleep(50 * time.Millisecond)
+	fw.Write("after\n")
+	fw.Close()
+
+	assert.Equal(t, "before\n", readFile(t, filepath.Join(dir, "output.txt.1")))
+	assert.Equal(t, "after\n", readFile(t, fileName))
+}
+
+func TestFileWriterFlush(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "output.txt")
+	fw := NewFileWriterWithConfig(fileName, FileWriterConfig{ChannelSize: 10, FlushInterval: time.Hour, Sync: SyncEveryBatch}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	assert.NoError(t, fw.Start())
+	defer fw.Close()
+	fw.Write("line1\n")
+	fw.Write("line2\n")
+	// Nothing is flushed before the interval passes
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, "", readFile(t, fileName))
+
+	assert.NoError(t, fw.Flush())
+	assert.Equal(t, "line1\nline2\n", readFile(t, fileName))
+}
+
+func TestFileWriterBatchIsBounded(t *testing.T) {
+	// Queued past Write, so its own sink label keeps the queue depth of the file sinks right
+	fw := newFileWriter("batch", filepath.Join(t.TempDir(), "output.txt"), FileWriterConfig{ChannelSize: 2 * maxBatchRequests}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	for i := 0; i < 2*maxBatchRequests; i++ {
+		fw.dataCh <- writeRequest{data: "line\n", queued: time.Now()}
+	}
+
+	// The rest is left for the next batch, after the flushes and the rotations had their turn
+	assert.True(t, fw.writeBatch(<-fw.dataCh))
+	assert.Len(t, fw.dataCh, maxBatchRequests)
+}
+
+func TestFileWriterWithoutFlushIntervalWritesAtOnce(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "output.txt")
+	fw := NewFileWriterWithConfig(fileName, FileWriterConfig{Sync: SyncEveryWrite}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	assert.NoError(t, fw.Start())
+	defer fw.Close()
+	fw.Write("line1\n")
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, "line1\n", readFile(t, fileName))
+}
+
+func TestParseSyncPolicy(t *testing.T) {
+	policy, err := ParseSyncPolicy("every-batch")
+	assert.NoError(t, err)
+	assert.Equal(t, SyncEveryBatch, policy)
+
+	_, err = ParseSyncPolicy("sometimes")
+	assert.Error(t, err)
+}
+
+func TestFileWriterStartFailure(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "missing", "output.txt")
+	fw := NewFileWriter(fileName, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	err := fw.Start()
+	assert.Error(t, err)
+	defer fw.Close()
+
+	// Refused instead of blocking forever
+	assert.Equal(t, err, fw.Write("line\n"))
+	assert.Equal(t, err, fw.Flush())
+}
+
+func TestFileWriterWriteAfterClose(t *testing.T) {
+	fw := NewFileWriter(filepath.Join(t.TempDir(), "output.txt"), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	assert.NoError(t, fw.Start())
+	assert.NoError(t, fw.Write("line\n"))
+	fw.Close()
+
+	assert.Equal(t, ErrWriterClosed, fw.Write("line\n"))
+}
+
+func TestFileWriterRecoversFromFailure(t *testing.T) {
+	if _, err := os.Stat("/dev/full"); err != nil {
+		t.Skip("no /dev/full to fail the writes")
+	}
+	fileName := filepath.Join(t.TempDir(), "output.txt")
+	// Every write to /dev/full fails with no space left on the device
+	assert.NoError(t, os.Symlink("/dev/full", fileName))
+	fw := NewFileWriter(fileName, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	assert.NoError(t, fw.Start())
+	defer fw.Close()
+	assert.NoError(t, fw.Write("lost\n"))
+	assert.Error(t, fw.Flush())
+	assert.Error(t, fw.Write("refused\n"))
+
+	// The space is back, the writer reopens the file by itself
+	assert.NoError(t, os.Remove(fileName))
+	assert.Eventually(t, func() bool { return fw.Write("line\n") == nil }, 5*time.Second, 10*time.Millisecond)
+	assert.NoError(t, fw.Flush())
+	assert.Equal(t, "line\n", readFile(t, fileName))
+}
@@ -0,0 +1,213 @@
+// Package orderedmap provides a map remembering the insertion order of its keys.
+// Set, Get, Delete and the moves are all O(1).
+package orderedmap
+
+import "iter"
+
+// Element is a single key-value pair of the Map.
+type Element[K comparable, V any] struct {
+	Key        K
+	Value      V
+	prev, next *Element[K, V]
+}
+
+// Next returns the next element in the order or nil.
+func (e *Element[K, V]) Next() *Element[K, V] {
+	return e.next
+}
+
+// Prev returns the previous element in the order or nil.
+func (e *Element[K, V]) Prev() *Element[K, V] {
+	return e.prev
+}
+
+// Map is a hash map with a doubly linked list running through its elements in the insertion order.
+// It is not safe for concurrent use.
+type Map[K comparable, V any] struct {
+	items      map[K]*Element[K, V]
+	head, tail *Element[K, V]
+}
+
+// New creates an empty Map.
+func New[K comparable, V any]() *Map[K, V] {
+	return &Map[K, V]{
+		items: make(map[K]*Element[K, V]),
+	}
+}
+
+// Set adds the key to the back of the map. The existing key keeps its position and just gets the new value,
+// in that case the replaced value is returned too.
+func (m *Map[K, V]) Set(key K, value V) (old V, replaced bool) {
+	if existing, ok := m.items[key]; ok {
+		old = existing.Value
+		existing.Value = value
+		return old, true
+	}
+
+	element := &Element[K, V]{Key: key, Value: value}
+	m.linkBack(element)
+	m.items[key] = element
+	return old, false
+}
+
+// Get returns the value of the key.
+func (m *Map[K, V]) Get(key K) (value V, ok bool) {
+	if element, ok := m.items[key]; ok {
+		return element.Value, true
+	}
+	return value, false
+}
+
+// Delete removes the key, returning its value.
+func (m *Map[K, V]) Delete(key K) (value V, ok bool) {
+	element, ok := m.items[key]
+	if !ok {
+		return value, false
+	}
+	m.unlink(element)
+	delete(m.items, key)
+	return element.Value, true
+}
+
+// Len returns the number of keys.
+func (m *Map[K, V]) Len() int {
+	return len(m.items)
+}
+
+// Front returns the oldest element or nil if the map is empty.
+func (m *Map[K, V]) Front() *Element[K, V] {
+	return m.head
+}
+
+// Back returns the newest element or nil if the map is empty.
+func (m *Map[K, V]) Back() *Element[K, V] {
+	return m.tail
+}
+
+// All iterates over the key-value pairs from the front to the back.
+// The current pair may be deleted during the iteration.
+func (m *Map[K, V]) All() iter.Seq2[K, V] {
+	return func(yield func(K, V) bool) {
+		for element := m.head; element != nil; {
+			next := element.next
+			if !yield(element.Key, element.Value) {
+				return
+			}
+			element = next
+		}
+	}
+}
+
+// Backward iterates over the key-value pairs from the back to the front.
+// The current pair may be deleted during the iteration.
+func (m *Map[K, V]) Backward() iter.Seq2[K, V] {
+	return func(yield func(K, V) bool) {
+		for element := m.tail; element != nil; {
+			prev := element.prev
+			if !yield(element.Key, element.Value) {
+				return
+			}
+			element = prev
+		}
+	}
+}
+
+// MoveToFront moves the key to the front, reporting if the key exists.
+func (m *Map[K, V]) MoveToFront(key K) bool {
+	element, ok := m.items[key]
+	if !ok {
+		return false
+	}
+	if element != m.head {
+		m.unlink(element)
+		m.linkBefore(element, m.head)
+	}
+	return true
+}
+
+// MoveToBack moves the key to the back, reporting if the key exists.
+func (m *Map[K, V]) MoveToBack(key K) bool {
+	element, ok := m.items[key]
+	if !ok {
+		return false
+	}
+	if element != m.tail {
+		m.unlink(element)
+		m.linkBack(element)
+	}
+	return true
+}
+
+// MoveBefore moves the key right before the mark key, reporting if both keys exist.
+func (m *Map[K, V]) MoveBefore(key, mark K) bool {
+	element, ok := m.items[key]
+	markElement, markOk := m.items[mark]
+	if !ok || !markOk {
+		return false
+	}
+	if element != markElement {
+		m.unlink(element)
+		m.linkBefore(element, markElement)
+	}
+	return true
+}
+
+// MoveAfter moves the key right after the mark key, reporting if both keys exist.
+func (m *Map[K, V]) MoveAfter(key, mark K) bool {
+	element, ok := m.items[key]
+	markElement, markOk := m.items[mark]
+	if !ok || !markOk {
+		return false
+	}
+	if element != markElement {
+		m.unlink(element)
+		if markElement.next == nil {
+			m.linkBack(element)
+		} else {
+			m.linkBefore(element, markElement.next)
+		}
+	}
+	return true
+}
+
+func (m *Map[K, V]) linkBack(element *Element[K, V]) {
+	element.prev = m.tail
+	element.next = nil
+	if m.tail == nil {
+		// First element
+		m.head = element
+	} else {
+		m.tail.next = element
+	}
+	m.tail = element
+}
+
+// linkBefore links the element before the mark, which must be in the list.
+func (m *Map[K, V]) linkBefore(element, mark *Element[K, V]) {
+	element.next = mark
+	element.prev = mark.prev
+	if mark.prev == nil {
+		// New head element
+		m.head = element
+	} else {
+		mark.prev.next = element
+	}
+	mark.prev = element
+}
+
+func (m *Map[K, V]) unlink(element *Element[K, V]) {
+	if element.prev != nil {
+		element.prev.next = element.next
+	} else {
+		// Head element
+		m.head = element.next
+	}
+
+	if element.next != nil {
+		element.next.prev = element.prev
+	} else {
+		// Tail element
+		m.tail = element.prev
+	}
+	element.prev, element.next = nil, nil
+}
@@ -0,0 +1,164 @@
+package orderedmap
+
+import (
+	"github.com/stretchr/testify/assert"
+	"iter"
+	"testing"
+)
+
+func keys[V any](seq iter.Seq2[string, V]) []string {
+	var result []string
+	for key := range seq {
+		result = append(result, key)
+	}
+	return result
+}
+
+func initialize(keyValues ...string) *Map[string, string] {
+	m := New[string, string]()
+	for i := 0; i < len(keyValues); i += 2 {
+		m.Set(keyValues[i], keyValues[i+1])
+	}
+	return m
+}
+
+func TestSetSingle(t *testing.T) {
+	m := New[string, string]()
+
+	_, replaced := m.Set("testKey", "testValue")
+	assert.False(t, replaced)
+
+	value, ok := m.Get("testKey")
+	assert.True(t, ok)
+	assert.Equal(t, "testValue", value)
+	assert.Equal(t, 1, m.Len())
+	assert.Equal(t, []string{"testKey"}, keys(m.All()))
+}
+
+func TestSetSomeEntriesBeforeAndAfter(t *testing.T) {
+	m := initialize("key1", "value1", "testKey", "testValue", "key2", "value2")
+
+	value, ok := m.Get("testKey")
+	assert.True(t, ok)
+	assert.Equal(t, "testValue", value)
+	assert.Equal(t, []string{"key1", "testKey", "key2"}, keys(m.All()))
+}
+
+func TestSetReplace(t *testing.T) {
+	m := initialize("key1", "value1", "testKey", "testValue", "key2", "value2")
+
+	old, replaced := m.Set("testKey", "differentTestValue")
+	assert.True(t, replaced)
+	assert.Equal(t, "testValue", old)
+
+	value, _ := m.Get("testKey")
+	assert.Equal(t, "differentTestValue", value)
+	// Replacing keeps the initial order
+	assert.Equal(t, []string{"key1", "testKey", "key2"}, keys(m.All()))
+}
+
+func TestDeleteSingle(t *testing.T) {
+	m := initialize("testKey", "testValue")
+
+	value, ok := m.Delete("testKey")
+	assert.True(t, ok)
+	assert.Equal(t, "testValue", value)
+
+	_, ok = m.Get("testKey")
+	assert.False(t, ok)
+	assert.Equal(t, 0, m.Len())
+	assert.Nil(t, m.Front())
+	assert.Nil(t, m.Back())
+	assert.Nil(t, keys(m.All()))
+
+	_, ok = m.Delete("testKey")
+	assert.False(t, ok)
+}
+
+func TestDeleteMiddleHeadTail(t *testing.T) {
+	for name, tc := range map[string]struct {
+		deleted  string
+		expected []string
+	}{
+		"middle": {"key2", []string{"key1", "key3"}},
+		"head":   {"key1", []string{"key2", "key3"}},
+		"tail":   {"key3", []string{"key1", "key2"}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			m := initialize("key1", "value1", "key2", "value2", "key3", "value3")
+
+			_, ok := m.Delete(tc.deleted)
+			assert.True(t, ok)
+			assert.Equal(t, tc.expected, keys(m.All()))
+
+			// Just adding one more item to be sure, that we did not break the map somehow
+			m.Set("key4", "value4")
+			assert.Equal(t, append(tc.expected, "key4"), keys(m.All()))
+			assert.Equal(t, tc.expected[0], m.Front().Key)
+			assert.Equal(t, "key4", m.Back().Key)
+		})
+	}
+}
+
+func TestGetDoesNotExist(t *testing.T) {
+	m := initialize("testKey", "testValue")
+
+	value, ok := m.Get("wrongKey")
+	assert.False(t, ok)
+	assert.Equal(t, "", value)
+}
+
+func TestIterators(t *testing.T) {
+	m := initialize("key1", "value1", "key2", "value2", "key3", "value3")
+
+	assert.Equal(t, []string{"key3", "key2", "key1"}, keys(m.Backward()))
+
+	var values []string
+	for element := m.Front(); element != nil; element = element.Next() {
+		values = append(values, element.Value)
+	}
+	assert.Equal(t, []string{"value1", "value2", "value3"}, values)
+
+	// Deleting the current pair while iterating is fine
+	for key, value := range m.All() {
+		if value != "value3" {
+			m.Delete(key)
+		}
+	}
+	assert.Equal(t, []string{"key3"}, keys(m.All()))
+
+	// Breaking early
+	m.Set("key4", "value4")
+	for key := range m.Backward() {
+		assert.Equal(t, "key4", key)
+		break
+	}
+}
+
+func TestMoves(t *testing.T) {
+	m := initialize("key1", "value1", "key2", "value2", "key3", "value3", "key4", "value4")
+
+	assert.True(t, m.MoveToFront("key3"))
+	assert.Equal(t, []string{"key3", "key1", "key2", "key4"}, keys(m.All()))
+
+	assert.True(t, m.MoveToBack("key3"))
+	assert.Equal(t, []string{"key1", "key2", "key4", "key3"}, keys(m.All()))
+
+	assert.True(t, m.MoveBefore("key3", "key1"))
+	assert.Equal(t, []string{"key3", "key1", "key2", "key4"}, keys(m.All()))
+
+	assert.True(t, m.MoveAfter("key3", "key4"))
+	assert.Equal(t, []string{"key1", "key2", "key4", "key3"}, keys(m.All()))
+
+	assert.True(t, m.MoveAfter("key1", "key2"))
+	assert.Equal(t, []string{"key2", "key1", "key4", "key3"}, keys(m.All()))
+
+	// Moving relative to itself is a no-op
+	assert.True(t, m.MoveBefore("key4", "key4"))
+	assert.Equal(t, []string{"key2", "key1", "key4", "key3"}, keys(m.All()))
+	assert.Equal(t, []string{"key3", "key4", "key1", "key2"}, keys(m.Backward()))
+
+	assert.False(t, m.MoveToFront("missing"))
+	assert.False(t, m.MoveAfter("key1", "missing"))
+	assert.Equal(t, 4, m.Len())
+}
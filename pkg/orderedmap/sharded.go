@@ -0,0 +1,139 @@
+package orderedmap
+
+import (
+	"hash/maphash"
+	"iter"
+	"sync"
+	"sync/atomic"
+)
+
+var stringHashSeed = maphash.MakeSeed()
+
+// HashString is the ready to use hash function for the string keyed Sharded maps.
+func HashString(key string) uint64 {
+	return maphash.String(stringHashSeed, key)
+}
+
+type sequenced[V any] struct {
+	seq   uint64
+	value V
+}
+
+type shard[K comparable, V any] struct {
+	mu    sync.RWMutex
+	items *Map[K, sequenced[V]]
+}
+
+// Sharded spreads the keys over independently locked Maps, so the writers of different keys
+// do not wait for each other. Every new key takes a number from the global insertion sequence,
+// All merges the shards by it to restore the overall insertion order.
+// It is safe for concurrent use.
+type Sharded[K comparable, V any] struct {
+	shards []*shard[K, V]
+	hash   func(key K) uint64
+	seq    atomic.Uint64
+}
+
+// NewSharded creates an empty Sharded map with the given number of shards.
+func NewSharded[K comparable, V any](shards int, hash func(key K) uint64) *Sharded[K, V] {
+	if shards < 1 {
+		shards = 1
+	}
+	s := &Sharded[K, V]{
+		shards: make([]*shard[K, V], shards),
+		hash:   hash,
+	}
+	for i := range s.shards {
+		s.shards[i] = &shard[K, V]{items: New[K, sequenced[V]]()}
+	}
+	return s
+}
+
+func (s *Sharded[K, V]) shardOf(key K) *shard[K, V] {
+	return s.shards[s.hash(key)%uint64(len(s.shards))]
+}
+
+// Set adds the key to the back of the map, see Map.Set.
+func (s *Sharded[K, V]) Set(key K, value V) (old V, replaced bool) {
+	sh := s.shardOf(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if existing, ok := sh.items.Get(key); ok {
+		sh.items.Set(key, sequenced[V]{seq: existing.seq, value: value})
+		return existing.value, true
+	}
+	// Taken under the shard lock, so the sequence of the same key never goes back
+	sh.items.Set(key, sequenced[V]{seq: s.seq.Add(1), value: value})
+	return old, false
+}
+
+// Get returns the value of the key.
+func (s *Sharded[K, V]) Get(key K) (value V, ok bool) {
+	sh := s.shardOf(key)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	existing, ok := sh.items.Get(key)
+	return existing.value, ok
+}
+
+// Delete removes the key, returning its value.
+func (s *Sharded[K, V]) Delete(key K) (value V, ok bool) {
+	sh := s.shardOf(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	deleted, ok := sh.items.Delete(key)
+	return deleted.value, ok
+}
+
+// Len returns the number of keys. The shards are counted one by one,
+// so the result is only exact when there are no concurrent writers.
+func (s *Sharded[K, V]) Len() int {
+	length := 0
+	for _, sh := range s.shards {
+		sh.mu.RLock()
+		length += sh.items.Len()
+		sh.mu.RUnlock()
+	}
+	return length
+}
+
+// All iterates over the key-value pairs in the insertion order.
+// Every shard is copied under its own read lock first, so the writers are not held back
+// by the iteration, though the changes made while copying may or may not be seen.
+func (s *Sharded[K, V]) All() iter.Seq2[K, V] {
+	return func(yield func(K, V) bool) {
+		type pair struct {
+			key   K
+			value sequenced[V]
+		}
+		copies := make([][]pair, len(s.shards))
+		for i, sh := range s.shards {
+			sh.mu.RLock()
+			copies[i] = make([]pair, 0, sh.items.Len())
+			for key, value := range sh.items.All() {
+				copies[i] = append(copies[i], pair{key, value})
+			}
+			sh.mu.RUnlock()
+		}
+
+		// Every shard is already in the sequence order, so it's a k-way merge.
+		// The number of shards is small, the linear scan for the minimum is good enough.
+		positions := make([]int, len(copies))
+		for {
+			next := -1
+			for i, c := range copies {
+				if positions[i] < len(c) && (next < 0 || c[positions[i]].value.seq < copies[next][positions[next]].value.seq) {
+					next = i
+				}
+			}
+			if next < 0 {
+				return
+			}
+			p := copies[next][positions[next]]
+			positions[next]++
+			if !yield(p.key, p.value.value) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package orderedmap
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+)
+
+func TestShardedKeepsInsertionOrder(t *testing.T) {
+	s := NewSharded[string, string](4, HashString)
+	var expected []string
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key%d", i)
+		s.Set(key, fmt.Sprintf("value%d", i))
+		expected = append(expected, key)
+	}
+
+	old, replaced := s.Set("key10", "replaced")
+	assert.True(t, replaced)
+	assert.Equal(t, "value10", old)
+
+	value, ok := s.Delete("key20")
+	assert.True(t, ok)
+	assert.Equal(t, "value20", value)
+	expected = append(expected[:20], expected[21:]...)
+
+	// Re-added key goes to the back
+	s.Set("key0", "value0")
+	s.Delete("key0")
+	s.Set("key0", "readded")
+	expected = append(expected[1:], "key0")
+
+	assert.Equal(t, expected, keys(s.All()))
+	assert.Equal(t, 99, s.Len())
+
+	value, ok = s.Get("key10")
+	assert.True(t, ok)
+	assert.Equal(t, "replaced", value)
+	_, ok = s.Get("key20")
+	assert.False(t, ok)
+}
+
+func TestShardedConcurrentWriters(t *testing.T) {
+	s := NewSharded[string, int](8, HashString)
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				s.Set(fmt.Sprintf("worker%d-key%d", w, i), i)
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	assert.Equal(t, 8000, s.Len())
+	// Keys of every single writer come out in the order that writer added them
+	last := make(map[int]int)
+	for key, value := range s.All() {
+		var w, i int
+		_, err := fmt.Sscanf(key, "worker%d-key%d", &w, &i)
+		assert.NoError(t, err)
+		if previous, ok := last[w]; ok {
+			assert.Less(t, previous, value)
+		}
+		last[w] = value
+	}
+}
+
+// The benchmarks compare the single locked Map, the way the consumer uses it, with the Sharded one
+// under the parallel writers, run with e.g. -cpu 1,4,8 to see the contention.
+
+type lockedMap struct {
+	mu    sync.RWMutex
+	items *Map[string, string]
+}
+
+func (m *lockedMap) Set(key, value string) {
+	m.mu.Lock()
+	m.items.Set(key, value)
+	m.mu.Unlock()
+}
+
+func (m *lockedMap) Delete(key string) {
+	m.mu.Lock()
+	m.items.Delete(key)
+	m.mu.Unlock()
+}
+
+func benchmarkKeys() []string {
+	keys := make([]string, 1024)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key%d", i)
+	}
+	return keys
+}
+
+func BenchmarkSingleLockSetDelete(b *testing.B) {
+	m := &lockedMap{items: New[string, string]()}
+	keys := benchmarkKeys()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			key := keys[i%len(keys)]
+			m.Set(key, key)
+			m.Delete(key)
+			i++
+		}
+	})
+}
+
+func BenchmarkShardedSetDelete(b *testing.B) {
+	for _, shards := range []int{4, 16, 64} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			s := NewSharded[string, string](shards, HashString)
+			keys := benchmarkKeys()
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					key := keys[i%len(keys)]
+					s.Set(key, key)
+					s.Delete(key)
+					i++
+				}
+			})
+		})
+	}
+}
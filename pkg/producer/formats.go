@@ -0,0 +1,251 @@
+package producer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/kgara/cmdhandler/pkg/shared"
+	"gopkg.in/yaml.v3"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Formats of the scenario files
+const (
+	FormatJSON = "json"
+	FormatYAML = "yaml"
+	FormatCSV  = "csv"
+	FormatText = "text"
+)
+
+// Columns of the CSV scenario without the header row
+var defaultCSVColumns = []string{"action", "key", "value", "times"}
+
+// DetectScenarioFormat returns the format of the scenario by the extension of the file. The files without
+// a known extension, stdin included, are JSON if they look like it and text otherwise.
+func DetectScenarioFormat(fileName string, content []byte) string {
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".json":
+		return FormatJSON
+	case ".yaml", ".yml":
+		return FormatYAML
+	case ".csv":
+		return FormatCSV
+	case ".txt", ".text":
+		return FormatText
+	}
+	if trimmed := bytes.TrimSpace(content); len(trimmed) > 0 && (trimmed[0] == '[' || trimmed[0] == '{') {
+		return FormatJSON
+	}
+	return FormatText
+}
+
+// ParseScenarioFormat parses and validates the scenario in the format:
+//
+//   - json: see ParseScenario
+//   - yaml: the same structure as the JSON one
+//   - csv: action,key,value,times rows, the optional header row may reorder the columns and add
+//     the namespace, timeout and replyTo ones
+//   - text: a command per line, the action followed by the optional key and value and the optional
+//     times=, namespace=, timeout= and replyTo= options, e.g. add key1 value1 times=3
+//
+// The actions are either the integer codes or the names, e.g. addItem or add, see shared.ParseActionType.
+func ParseScenarioFormat(content []byte, format string) (*Scenario, error) {
+	switch format {
+	case FormatJSON:
+		return ParseScenario(content)
+	case FormatYAML:
+		return parseYAMLScenario(content)
+	case FormatCSV:
+		return parseCSVScenario(content)
+	case FormatText:
+		return parseTextScenario(content)
+	default:
+		return nil, fmt.Errorf("unknown scenario format %q", format)
+	}
+}
+
+// parseYAMLScenario converts the YAML to JSON, so both share the field names and the validation.
+func parseYAMLScenario(content []byte) (*Scenario, error) {
+	var document any
+	if err := yaml.Unmarshal(content, &document); err != nil {
+		return nil, err
+	}
+	if document == nil {
+		return nil, errors.New("empty scenario")
+	}
+	converted, err := json.Marshal(document)
+	if err != nil {
+		return nil, err
+	}
+	return ParseScenario(converted)
+}
+
+func parseCSVScenario(content []byte) (*Scenario, error) {
+	reader := csv.NewReader(bytes.NewReader(content))
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	reader.Comment = '#'
+
+	scenario := &Scenario{}
+	columns := defaultCSVColumns
+	for row := 0; ; row++ {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if row == 0 && strings.EqualFold(strings.TrimSpace(record[0]), "action") {
+			columns = make([]string, len(record))
+			for i, column := range record {
+				columns[i] = strings.ToLower(strings.TrimSpace(column))
+				if !isTextOption(columns[i]) && columns[i] != "action" && columns[i] != "key" && columns[i] != "value" {
+					return nil, fmt.Errorf("unknown column %q", column)
+				}
+			}
+			continue
+		}
+		line, _ := reader.FieldPos(0)
+		if len(record) > len(columns) {
+			return nil, fmt.Errorf("line %d: %d fields, expected at most %d", line, len(record), len(columns))
+		}
+		step := RepeatableCommand{Times: 1}
+		for i, field := range record {
+			if err := setStepField(&step, columns[i], field); err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+		}
+		scenario.Steps = append(scenario.Steps, step)
+	}
+	if err := scenario.compile(); err != nil {
+		return nil, err
+	}
+	return scenario, nil
+}
+
+func parseTextScenario(content []byte) (*Scenario, error) {
+	scenario := &Scenario{}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields, err := splitFields(text)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		step := RepeatableCommand{Times: 1}
+		positional := []string{"action", "key", "value"}
+		for _, field := range fields {
+			name, value, isOption := strings.Cut(field.text, "=")
+			if isOption && !field.quoted && isTextOption(name) {
+				if err := setStepField(&step, strings.ToLower(name), value); err != nil {
+					return nil, fmt.Errorf("line %d: %w", line, err)
+				}
+				continue
+			}
+			if len(positional) == 0 {
+				return nil, fmt.Errorf("line %d: unexpected %q after the value", line, field.text)
+			}
+			if err := setStepField(&step, positional[0], field.text); err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+			positional = positional[1:]
+		}
+		scenario.Steps = append(scenario.Steps, step)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if err := scenario.compile(); err != nil {
+		return nil, err
+	}
+	return scenario, nil
+}
+
+func isTextOption(name string) bool {
+	switch strings.ToLower(name) {
+	case "times", "namespace", "timeout", "replyto":
+		return true
+	}
+	return false
+}
+
+// textField is a whitespace separated field of the text scenario line, the quoted ones may hold the spaces.
+type textField struct {
+	text   string
+	quoted bool
+}
+
+func splitFields(line string) ([]textField, error) {
+	var fields []textField
+	for line = strings.TrimLeft(line, " \t"); line != ""; line = strings.TrimLeft(line, " \t") {
+		if line[0] != '"' {
+			end := strings.IndexAny(line, " \t")
+			if end < 0 {
+				end = len(line)
+			}
+			fields = append(fields, textField{text: line[:end]})
+			line = line[end:]
+			continue
+		}
+		quoted, err := strconv.QuotedPrefix(line)
+		if err != nil {
+			return nil, fmt.Errorf("unterminated quoted field %s", line)
+		}
+		text, _ := strconv.Unquote(quoted)
+		fields = append(fields, textField{text: text, quoted: true})
+		line = line[len(quoted):]
+	}
+	return fields, nil
+}
+
+// setStepField sets the field of the single command step by its lowercase column or option name.
+func setStepField(step *RepeatableCommand, name, value string) error {
+	switch name {
+	case "action":
+		action, err := parseAction(value)
+		if err != nil {
+			return err
+		}
+		step.Command.Action = action
+	case "key":
+		step.Command.Key = value
+	case "value":
+		step.Command.Value = value
+	case "namespace":
+		step.Command.Namespace = value
+	case "timeout":
+		step.Command.Timeout = value
+	case "replyto":
+		step.Command.ReplyTo = value
+	case "times":
+		if strings.TrimSpace(value) == "" {
+			return nil
+		}
+		times, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil {
+			return fmt.Errorf("invalid times %q", value)
+		}
+		step.Times = times
+	default:
+		return fmt.Errorf("unknown column %q", name)
+	}
+	return nil
+}
+
+// parseAction accepts the action either as its integer code or as its name.
+func parseAction(value string) (shared.ActionType, error) {
+	if code, err := strconv.Atoi(strings.TrimSpace(value)); err == nil {
+		return shared.ActionType(code), nil
+	}
+	return shared.ParseActionType(value)
+}
@@ -0,0 +1,86 @@
+package producer
+
+import (
+	"github.com/kgara/cmdhandler/pkg/shared"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestDetectScenarioFormat(t *testing.T) {
+	assert.Equal(t, FormatYAML, DetectScenarioFormat("scenario.yml", nil))
+	assert.Equal(t, FormatCSV, DetectScenarioFormat("/tmp/Scenario.CSV", nil))
+	assert.Equal(t, FormatText, DetectScenarioFormat("scenario.txt", []byte(`[]`)))
+	assert.Equal(t, FormatJSON, DetectScenarioFormat("-", []byte("  [{}]")))
+	assert.Equal(t, FormatText, DetectScenarioFormat("-", []byte("add key1 value1")))
+}
+
+func TestParseScenarioFormats(t *testing.T) {
+	expected := []shared.Command{
+		{Action: shared.AddItem, Key: "key-0", Value: "value 1"},
+		{Action: shared.AddItem, Key: "key-1", Value: "value 1"},
+		{Action: shared.GetItem, Key: "key-0", Namespace: "team1"},
+		{Action: shared.GetAllItems},
+	}
+	for format, content := range map[string]string{
+		FormatJSON: `[
+			{"Command":{"Action":"add","Key":"key-{{.i}}","Value":"value 1"},"Times":2},
+			{"Command":{"Action":2,"Key":"key-0","Namespace":"team1"},"Times":1},
+			{"Command":{"Action":"getAllItems"},"Times":1}
+		]`,
+		FormatYAML: `
+steps:
+  - command: {action: add, key: "key-{{.i}}", value: value 1}
+    times: 2
+  - command: {action: 2, key: key-0, namespace: team1}
+    times: 1
+  - command: {action: getAllItems}
+    times: 1
+`,
+		FormatCSV: `# comment
+action,key,value,times,namespace
+add,key-{{.i}},value 1,2,
+get,key-0,,,team1
+getAll
+`,
+		FormatText: `
+# comment
+add key-{{.i}} "value 1" times=2
+2 key-0 namespace=team1
+getAllItems
+`,
+	} {
+		scenario, err := ParseScenarioFormat([]byte(content), format)
+		if assert.NoError(t, err, format) {
+			assert.Equal(t, expected, collect(t, scenario, 0), format)
+		}
+	}
+}
+
+func TestParseScenarioFormatsInvalid(t *testing.T) {
+	for format, content := range map[string]string{
+		FormatYAML: "- command: [",
+		FormatCSV:  "fly,key1\n",
+		FormatText: "add key1 value1 extra\n",
+		"xml":      "<scenario/>",
+		FormatJSON: `[{"Command":{"Action":"fly"},"Times":1}]`,
+	} {
+		_, err := ParseScenarioFormat([]byte(content), format)
+		assert.Error(t, err, format)
+	}
+	for _, content := range []string{
+		"action,key,weight\nadd,key1,1\n",
+		"add,key1,value1,many\n",
+		"add,key1,value1,1,extra\n",
+	} {
+		_, err := ParseScenarioFormat([]byte(content), FormatCSV)
+		assert.Error(t, err, content)
+	}
+	for _, content := range []string{
+		`add key1 "value1`,
+		"add key1 times=-1",
+		`add "{{.i"`,
+	} {
+		_, err := ParseScenarioFormat([]byte(content), FormatText)
+		assert.Error(t, err, content)
+	}
+}
@@ -0,0 +1,225 @@
+package producer
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Ramp-up profiles of the load
+const (
+	RampLinear = "linear"
+	RampStep   = "step"
+)
+
+// The limiter sleeps at most that long at once, so the ramp-up is followed closely
+const maxLimiterSleep = 100 * time.Millisecond
+
+// The bucket holds the commands of that long, so the coarse timers do not cap the high rates
+const limiterBurstWindow = 10 * time.Millisecond
+
+// The percentiles are taken from the uniform sample of that many latencies, so the long runs take bounded memory
+const latencySampleSize = 10000
+
+// LoadProfile is the target rate of the commands over the run, reached after the RampUp.
+type LoadProfile struct {
+	// Commands per second, 0 is unlimited
+	Rate   float64
+	RampUp time.Duration
+	// RampLinear, or RampStep going up in RampSteps equal steps
+	Ramp      string
+	RampSteps int
+}
+
+// Validate checks the profile.
+func (p LoadProfile) Validate() error {
+	switch {
+	case p.Rate < 0 || math.IsNaN(p.Rate) || math.IsInf(p.Rate, 0):
+		return fmt.Errorf("invalid rate %v", p.Rate)
+	case p.RampUp < 0:
+		return fmt.Errorf("negative ramp-up %s", p.RampUp)
+	case p.Ramp != RampLinear && p.Ramp != RampStep:
+		return fmt.Errorf("unknown ramp-up profile %q", p.Ramp)
+	case p.Ramp == RampStep && p.RampSteps <= 0:
+		return fmt.Errorf("ramp-up steps must be positive, got %d", p.RampSteps)
+	}
+	return nil
+}
+
+// RateAt returns the target rate at the elapsed time since the start of the run.
+func (p LoadProfile) RateAt(elapsed time.Duration) float64 {
+	if p.RampUp <= 0 || elapsed >= p.RampUp {
+		return p.Rate
+	}
+	progress := float64(elapsed) / float64(p.RampUp)
+	if p.Ramp == RampStep {
+		// The first step starts right away
+		return p.Rate * math.Floor(progress*float64(p.RampSteps)+1) / float64(p.RampSteps)
+	}
+	return p.Rate * progress
+}
+
+// Limiter paces the commands by the token bucket refilled at the rate of the profile.
+// It is not safe for the concurrent use, the commands are taken by a single feeder.
+type Limiter struct {
+	profile LoadProfile
+	start   time.Time
+	last    time.Time
+	tokens  float64
+}
+
+// NewLimiter returns the limiter of the profile, its run starts with the first Wait.
+func NewLimiter(profile LoadProfile) *Limiter {
+	return &Limiter{profile: profile}
+}
+
+// Wait blocks until the next command may go or the ctx is done.
+func (l *Limiter) Wait(ctx context.Context) error {
+	if l.profile.Rate == 0 {
+		return ctx.Err()
+	}
+	for {
+		delay := l.take(time.Now())
+		if delay == 0 {
+			return ctx.Err()
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// take refills the bucket up to now and takes a token, returning 0, or returns how long to wait
+// before trying again.
+func (l *Limiter) take(now time.Time) time.Duration {
+	if l.start.IsZero() {
+		l.start, l.last = now, now
+		l.tokens = 1
+	}
+	rate := l.profile.RateAt(now.Sub(l.start))
+	burst := max(1, rate*limiterBurstWindow.Seconds())
+	l.tokens = min(burst, l.tokens+rate*now.Sub(l.last).Seconds())
+	l.last = now
+	if l.tokens >= 1 {
+		l.tokens--
+		return 0
+	}
+	if rate == 0 {
+		return maxLimiterSleep
+	}
+	delay := time.Duration((1 - l.tokens) / rate * float64(time.Second))
+	return max(time.Microsecond, min(maxLimiterSleep, delay))
+}
+
+// LoadStats collects the confirm latencies and the errors of the pushed commands.
+// The latencies are kept as a reservoir sample of latencySampleSize, the percentiles are exact up to it.
+type LoadStats struct {
+	mu         sync.Mutex
+	start      time.Time
+	latencies  []time.Duration
+	confirmed  int
+	maxLatency time.Duration
+	errors     map[string]int
+	failed     int
+}
+
+// NewLoadStats returns the stats of the run starting now.
+func NewLoadStats() *LoadStats {
+	return &LoadStats{start: time.Now(), errors: make(map[string]int)}
+}
+
+// Record adds the command pushed in latency, until confirmed, or failed with the err.
+func (s *LoadStats) Record(latency time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		s.failed++
+		s.errors[err.Error()]++
+		return
+	}
+	s.confirmed++
+	s.maxLatency = max(s.maxLatency, latency)
+	if len(s.latencies) < latencySampleSize {
+		s.latencies = append(s.latencies, latency)
+		return
+	}
+	// Every latency so far stays in the sample with the same chance
+	if i := rand.IntN(s.confirmed); i < latencySampleSize {
+		s.latencies[i] = latency
+	}
+}
+
+// LoadReport sums up the run.
+type LoadReport struct {
+	Duration time.Duration
+	// Confirmed and failed commands
+	Confirmed int
+	Failed    int
+	// Confirmed commands per second
+	Rate float64
+	// Confirm latency percentiles
+	P50 time.Duration
+	P90 time.Duration
+	P99 time.Duration
+	Max time.Duration
+	// Failed commands by the error
+	Errors map[string]int
+}
+
+// Report returns the report of the run so far.
+func (s *LoadStats) Report() LoadReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	report := LoadReport{
+		Duration:  time.Since(s.start),
+		Confirmed: s.confirmed,
+		Failed:    s.failed,
+		Errors:    make(map[string]int, len(s.errors)),
+	}
+	for err, count := range s.errors {
+		report.Errors[err] = count
+	}
+	if report.Duration > 0 {
+		report.Rate = float64(report.Confirmed) / report.Duration.Seconds()
+	}
+	if len(s.latencies) > 0 {
+		sorted := slices.Clone(s.latencies)
+		slices.Sort(sorted)
+		report.P50 = percentile(sorted, 50)
+		report.P90 = percentile(sorted, 90)
+		report.P99 = percentile(sorted, 99)
+		report.Max = s.maxLatency
+	}
+	return report
+}
+
+// percentile returns the nearest-rank percentile of the sorted latencies.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	return sorted[max(0, rank-1)]
+}
+
+// LogValue logs the report as a group.
+func (r LoadReport) LogValue() slog.Value {
+	attrs := []slog.Attr{
+		slog.Duration("duration", r.Duration.Round(time.Millisecond)),
+		slog.Int("confirmed", r.Confirmed),
+		slog.Int("failed", r.Failed),
+		slog.String("rate", fmt.Sprintf("%.1f/s", r.Rate)),
+		slog.Duration("p50", r.P50),
+		slog.Duration("p90", r.P90),
+		slog.Duration("p99", r.P99),
+		slog.Duration("max", r.Max),
+	}
+	if len(r.Errors) > 0 {
+		attrs = append(attrs, slog.Any("errors", r.Errors))
+	}
+	return slog.GroupValue(attrs...)
+}
@@ -0,0 +1,113 @@
+package producer
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestLoadProfileRateAt(t *testing.T) {
+	linear := LoadProfile{Rate: 100, RampUp: 10 * time.Second, Ramp: RampLinear}
+	assert.Equal(t, 0.0, linear.RateAt(0))
+	assert.Equal(t, 25.0, linear.RateAt(2500*time.Millisecond))
+	assert.Equal(t, 100.0, linear.RateAt(time.Minute))
+
+	step := LoadProfile{Rate: 100, RampUp: 10 * time.Second, Ramp: RampStep, RampSteps: 4}
+	assert.Equal(t, 25.0, step.RateAt(0))
+	assert.Equal(t, 25.0, step.RateAt(2*time.Second))
+	assert.Equal(t, 50.0, step.RateAt(3*time.Second))
+	assert.Equal(t, 100.0, step.RateAt(9*time.Second))
+
+	assert.Equal(t, 100.0, LoadProfile{Rate: 100, Ramp: RampLinear}.RateAt(0))
+}
+
+func TestLoadProfileValidate(t *testing.T) {
+	assert.NoError(t, LoadProfile{Ramp: RampLinear}.Validate())
+	assert.NoError(t, LoadProfile{Rate: 10, RampUp: time.Second, Ramp: RampStep, RampSteps: 2}.Validate())
+	for _, profile := range []LoadProfile{
+		{Rate: -1, Ramp: RampLinear},
+		{Rate: 1, RampUp: -time.Second, Ramp: RampLinear},
+		{Rate: 1, Ramp: "exponential"},
+		{Rate: 1, Ramp: RampStep},
+	} {
+		assert.Error(t, profile.Validate(), profile)
+	}
+}
+
+func TestLimiterPacesToRate(t *testing.T) {
+	limiter := NewLimiter(LoadProfile{Rate: 10, Ramp: RampLinear})
+	start := time.Now()
+	assert.Equal(t, time.Duration(0), limiter.take(start))
+	assert.Equal(t, 100*time.Millisecond, limiter.take(start))
+	assert.Equal(t, 50*time.Millisecond, limiter.take(start.Add(50*time.Millisecond)))
+	assert.Equal(t, time.Duration(0), limiter.take(start.Add(100*time.Millisecond)))
+
+	// The idle time does not pile up more than the burst
+	assert.Equal(t, time.Duration(0), limiter.take(start.Add(time.Minute)))
+	assert.NotEqual(t, time.Duration(0), limiter.take(start.Add(time.Minute)))
+}
+
+func TestLimiterFollowsRampUp(t *testing.T) {
+	limiter := NewLimiter(LoadProfile{Rate: 1000, RampUp: time.Second, Ramp: RampLinear})
+	start := time.Now()
+	taken := 0
+	for now := start; now.Before(start.Add(2 * time.Second)); now = now.Add(time.Millisecond) {
+		for limiter.take(now) == 0 {
+			taken++
+		}
+	}
+	// Half of the full rate during the ramp-up and the full rate after it
+	assert.InDelta(t, 1500, taken, 20)
+}
+
+func TestLimiterWaitStopsWithContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	limiter := NewLimiter(LoadProfile{Rate: 0.001, Ramp: RampLinear})
+	assert.NoError(t, limiter.Wait(ctx))
+	cancel()
+	assert.ErrorIs(t, limiter.Wait(ctx), context.Canceled)
+
+	// Unlimited
+	assert.NoError(t, NewLimiter(LoadProfile{Ramp: RampLinear}).Wait(context.Background()))
+}
+
+func TestLoadStatsReport(t *testing.T) {
+	stats := NewLoadStats()
+	for i := 100; i >= 1; i-- {
+		stats.Record(time.Duration(i)*time.Millisecond, nil)
+	}
+	stats.Record(time.Second, errors.New("failed to push: not connected"))
+	stats.Record(time.Second, errors.New("failed to push: not connected"))
+
+	report := stats.Report()
+	assert.Equal(t, 100, report.Confirmed)
+	assert.Equal(t, 2, report.Failed)
+	assert.Equal(t, map[string]int{"failed to push: not connected": 2}, report.Errors)
+	assert.Equal(t, 50*time.Millisecond, report.P50)
+	assert.Equal(t, 90*time.Millisecond, report.P90)
+	assert.Equal(t, 99*time.Millisecond, report.P99)
+	assert.Equal(t, 100*time.Millisecond, report.Max)
+	assert.Greater(t, report.Rate, 0.0)
+
+	empty := NewLoadStats().Report()
+	assert.Equal(t, 0, empty.Confirmed)
+	assert.Equal(t, time.Duration(0), empty.P99)
+}
+
+func TestLoadStatsSamplesLatencies(t *testing.T) {
+	stats := NewLoadStats()
+	total := 10 * latencySampleSize
+	for i := 1; i <= total; i++ {
+		stats.Record(time.Duration(i)*time.Microsecond, nil)
+	}
+	assert.Len(t, stats.latencies, latencySampleSize)
+
+	report := stats.Report()
+	assert.Equal(t, total, report.Confirmed)
+	assert.Equal(t, time.Duration(total)*time.Microsecond, report.Max)
+	// The sample is uniform, so its percentiles are close to the exact ones
+	assert.InDelta(t, float64(total/2), float64(report.P50/time.Microsecond), float64(total)/20)
+	assert.InDelta(t, float64(total*99/100), float64(report.P99/time.Microsecond), float64(total)/20)
+}
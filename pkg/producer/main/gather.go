@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/dchest/uniuri"
+	"github.com/kgara/cmdhandler/pkg/shared"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// The reply queue goes away once the producer is not around for that long
+const replyQueueExpiry = time.Hour
+
+// gatherResult is the line written to the gather output for every scatter-gather query.
+type gatherResult struct {
+	QueryID   string
+	Action    string
+	Namespace string
+	Key       string `json:",omitempty"`
+	// Partitions which did not reply in time, their part of the answer is missing
+	Missing []int `json:",omitempty"`
+	Items   []shared.Item
+	// Sum of the counts of the partitions for Count, the number of the items otherwise
+	Count int
+	// Reason the query failed, reported by the partitions
+	Error     string `json:",omitempty"`
+	Timestamp time.Time
+}
+
+// gatherer collects the replies of the partitions to the scatter-gather queries from the reply queue
+// of the producer, merges them and writes them out.
+type gatherer struct {
+	client     *shared.Client
+	replyQueue string
+	// Replies by the query id, registered before the query is pushed
+	pending map[string]chan shared.ItemsReply
+	mu      sync.Mutex
+	output  *os.File
+	done    chan struct{}
+	logger  *slog.Logger
+}
+
+func newGatherer(config *ProducerConfig, logger *slog.Logger) (*gatherer, error) {
+	output, err := os.OpenFile(config.gatherOutputFileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	replyQueue := config.ampqQueueName + ".replies." + uniuri.New()
+	queueArgs := amqp.Table{"x-expires": int32(replyQueueExpiry / time.Millisecond)}
+	return &gatherer{
+		client:     shared.NewClientWithQueueArgs(replyQueue, queueArgs, config.ampqUri, logger),
+		replyQueue: replyQueue,
+		pending:    make(map[string]chan shared.ItemsReply),
+		output:     output,
+		done:       make(chan struct{}),
+		logger:     logger,
+	}, nil
+}
+
+// start consumes the reply queue, consuming again after the reconnects.
+func (g *gatherer) start() {
+	go func() {
+		for {
+			deliveries, err := g.client.Consume()
+			if err == nil {
+				g.dispatch(deliveries)
+			}
+			select {
+			case <-g.done:
+				return
+			case <-time.After(time.Second):
+			}
+		}
+	}()
+}
+
+func (g *gatherer) dispatch(deliveries <-chan amqp.Delivery) {
+	for delivery := range deliveries {
+		reply := shared.ItemsReply{}
+		if err := json.Unmarshal(delivery.Body, &reply); err != nil {
+			g.logger.Error("Error decoding partition reply", "error", err)
+		} else {
+			g.mu.Lock()
+			replies, ok := g.pending[reply.QueryID]
+			g.mu.Unlock()
+			if ok {
+				// Buffered for all the partitions, the redelivered copies are the only ones which may not fit
+				select {
+				case replies <- reply:
+				default:
+				}
+			} else {
+				g.logger.Warn("Late partition reply dropped", "query_id", reply.QueryID, "partition", reply.Partition)
+			}
+		}
+		if err := delivery.Ack(false); err != nil {
+			g.logger.Error("Error acknowledging partition reply", "error", err)
+		}
+	}
+}
+
+// expect registers the query, so its replies are kept until gather is called.
+func (g *gatherer) expect(queryID string, partitions int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.pending[queryID] = make(chan shared.ItemsReply, partitions)
+}
+
+// gather waits up to timeout for the replies of all the partitions to the command and writes out the merged answer.
+func (g *gatherer) gather(queryID string, command shared.Command, partitions int, timeout time.Duration) gatherResult {
+	g.mu.Lock()
+	replies := g.pending[queryID]
+	g.mu.Unlock()
+	defer func() {
+		g.mu.Lock()
+		delete(g.pending, queryID)
+		g.mu.Unlock()
+	}()
+
+	received := make(map[int]shared.ItemsReply, partitions)
+	deadline := time.After(timeout)
+waiting:
+	for len(received) < partitions {
+		select {
+		case reply := <-replies:
+			received[reply.Partition] = reply
+		case <-deadline:
+			break waiting
+		}
+	}
+
+	result := mergeReplies(command, received, partitions)
+	result.QueryID = queryID
+
+	data, err := json.Marshal(result)
+	if err == nil {
+		g.mu.Lock()
+		_, err = g.output.Write(append(data, '\n'))
+		g.mu.Unlock()
+	}
+	if err != nil {
+		g.logger.Error("Error writing gathered items", "query_id", queryID, "error", err)
+	}
+	return result
+}
+
+// mergeReplies merges the replies of the partitions by the index, listing the ones missing.
+func mergeReplies(command shared.Command, received map[int]shared.ItemsReply, partitions int) gatherResult {
+	result := gatherResult{Action: command.Action.String(), Namespace: command.Namespace, Key: command.Key, Timestamp: time.Now().UTC()}
+	merged := make([]shared.ItemsReply, 0, len(received))
+	for partition := 0; partition < partitions; partition++ {
+		reply, ok := received[partition]
+		if !ok {
+			result.Missing = append(result.Missing, partition)
+			continue
+		}
+		merged = append(merged, reply)
+		if result.Error == "" {
+			result.Error = reply.Error
+		}
+	}
+	result.Items = shared.MergeItems(merged)
+	result.Count = len(result.Items)
+	if command.Action == shared.Count {
+		result.Count = shared.SumCounts(merged)
+	}
+	return result
+}
+
+func (g *gatherer) close() {
+	close(g.done)
+	_ = g.client.Close()
+	_ = g.output.Close()
+}
@@ -3,21 +3,57 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"log"
+	"log/slog"
+	"math/rand/v2"
 	"os"
+	"os/signal"
 	"sync"
+	"syscall"
 	"time"
 
+	"github.com/dchest/uniuri"
+	"github.com/kgara/cmdhandler/pkg/producer"
 	"github.com/kgara/cmdhandler/pkg/shared"
+	amqp "github.com/rabbitmq/amqp091-go"
 	"github.com/urfave/cli/v2"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// The workers get that long to push the commands already taken once the feeding stops
+const drainTimeout = 10 * time.Minute
+
 type ProducerConfig struct {
 	ampqUri          string
 	ampqQueueName    string
 	scenarioFileName string
-	numWorkers       int
+	// Scenario format, detected by the file extension if empty
+	scenarioFormat string
+	// Seed of the random scenario data, the scenario one or a random one if 0
+	seed       uint64
+	numWorkers int
+	// Load mode: the rate profile, the run duration, 0 until the scenario ends, and the runs of the scenario,
+	// 0 until the duration elapses
+	load        producer.LoadProfile
+	duration    time.Duration
+	loops       int
+	metricsAddr string
+	// Partitioned mode is disabled if the number of the partitions is 0
+	partitions           int
+	gatherTimeout        time.Duration
+	gatherOutputFileName string
+	// The queue arguments must match the consumer ones
+	singleActiveConsumer bool
+	traceExporter        string
+	logFormat            string
+	logLevel             string
+	// The message bodies are logged only if enabled, with the fields listed in logRedactFields redacted
+	logBody         bool
+	logRedactFields []string
 }
 
 func main() {
@@ -44,9 +80,21 @@ func main() {
 			&cli.StringFlag{
 				Name:        "scenario",
 				Value:       "/tmp/scenario01.json",
-				Usage:       "scenario.json file name",
+				Usage:       "scenario file name, - reads it from stdin",
 				Destination: &config.scenarioFileName,
 			},
+			&cli.StringFlag{
+				Name:        "scenario-format",
+				Value:       "",
+				Usage:       "scenario format: json, yaml, csv or text. Detected by the file extension if empty, stdin is json if it looks like it and text otherwise",
+				Destination: &config.scenarioFormat,
+			},
+			&cli.Uint64Flag{
+				Name:        "seed",
+				Value:       0,
+				Usage:       "seed of the random data of the scenario, the same seed produces the same commands. The scenario Seed, or a random one, if 0",
+				Destination: &config.seed,
+			},
 			&cli.IntFlag{
 				Name:  "workers",
 				Value: 8,
@@ -55,9 +103,114 @@ func main() {
 						Buy defaults we assume that we care for maintaining the order only in the orderedMap on the consumer.`,
 				Destination: &config.numWorkers,
 			},
+			&cli.Float64Flag{
+				Name:        "rate",
+				Value:       0,
+				Usage:       "target commands per second, 0 pushes them as fast as the workers can",
+				Destination: &config.load.Rate,
+			},
+			&cli.DurationFlag{
+				Name:        "ramp-up",
+				Value:       0,
+				Usage:       "how long the rate takes to go up to the --rate",
+				Destination: &config.load.RampUp,
+			},
+			&cli.StringFlag{
+				Name:        "ramp-profile",
+				Value:       producer.RampLinear,
+				Usage:       "how the rate goes up during the ramp-up: linear or step",
+				Destination: &config.load.Ramp,
+			},
+			&cli.IntFlag{
+				Name:        "ramp-steps",
+				Value:       4,
+				Usage:       "number of the equal steps of the step ramp-up profile",
+				Destination: &config.load.RampSteps,
+			},
+			&cli.DurationFlag{
+				Name:        "duration",
+				Value:       0,
+				Usage:       "how long the commands are pushed for, 0 until the scenario ends",
+				Destination: &config.duration,
+			},
+			&cli.IntFlag{
+				Name:        "loops",
+				Value:       1,
+				Usage:       "how many times the scenario is run, 0 loops it until the --duration elapses or interrupted",
+				Destination: &config.loops,
+			},
+			&cli.IntFlag{
+				Name:        "partitions",
+				Value:       0,
+				Usage:       "number of the partition queues the commands are routed to by the key, the queue name suffixed by the partition. 0 disables the partitioned mode",
+				Destination: &config.partitions,
+			},
+			&cli.DurationFlag{
+				Name:        "gather-timeout",
+				Value:       5 * time.Second,
+				Usage:       "how long the partitioned queries wait for the replies of all the partitions",
+				Destination: &config.gatherTimeout,
+			},
+			&cli.StringFlag{
+				Name:        "gather-output",
+				Value:       "/tmp/producer-gather.jsonl",
+				Usage:       "file the items gathered from the partitions are appended to, one JSON line per query",
+				Destination: &config.gatherOutputFileName,
+			},
+			&cli.BoolFlag{
+				Name:        "single-active-consumer",
+				Usage:       "declare the queue with the single active consumer, as the consumers started with the same flag do",
+				Destination: &config.singleActiveConsumer,
+			},
+			&cli.StringFlag{
+				Name:        "metrics-addr",
+				Usage:       "address to serve the Prometheus metrics on, e.g. :9101. Empty disables the metrics endpoint",
+				Destination: &config.metricsAddr,
+			},
+			&cli.StringFlag{
+				Name:        "trace-exporter",
+				Usage:       "where the OpenTelemetry spans go: otlp, otlp://host:4318, otlps://host:4318, stdout or a file name, disabled if empty",
+				Destination: &config.traceExporter,
+			},
+			&cli.StringFlag{
+				Name:        "log-format",
+				Value:       shared.LogFormatText,
+				Usage:       "log format: text or json",
+				Destination: &config.logFormat,
+			},
+			&cli.StringFlag{
+				Name:        "log-level",
+				Value:       "info",
+				Usage:       "lowest level logged: debug, info, warn or error",
+				Destination: &config.logLevel,
+			},
+			&cli.BoolFlag{
+				Name:        "log-body",
+				Usage:       "log the body of every pushed message",
+				Destination: &config.logBody,
+			},
+			&cli.StringSliceFlag{
+				Name:  "log-redact",
+				Value: cli.NewStringSlice("Value"),
+				Usage: "command fields replaced by " + shared.RedactedValue + " in the logged bodies, repeat it for several fields",
+			},
 		},
 		Action: func(cCtx *cli.Context) error {
-			execute(config)
+			logger, err := shared.NewLogger(os.Stdout, config.logFormat, config.logLevel)
+			if err != nil {
+				return err
+			}
+			config.logRedactFields = cCtx.StringSlice("log-redact")
+			if config.partitions < 0 {
+				return fmt.Errorf("invalid number of partitions %d", config.partitions)
+			}
+			if err := config.load.Validate(); err != nil {
+				return err
+			}
+			if config.duration < 0 || config.loops < 0 {
+				return fmt.Errorf("invalid duration %s or loops %d", config.duration, config.loops)
+			}
+			execute(config, logger)
 			return nil
 		},
 	}
@@ -66,98 +219,249 @@ func main() {
 		log.Fatal(err)
 	}
 }
-func execute(config *ProducerConfig) {
-	logger := log.New(os.Stdout, "", log.LstdFlags)
-	queue := shared.NewClient(config.ampqQueueName, config.ampqUri, logger)
+func execute(config *ProducerConfig, logger *slog.Logger) {
+	shutdownTracing, err := shared.SetupTracing(config.traceExporter, "cmdhandler-producer", logger)
+	if err != nil {
+		logger.Error("Could not set up tracing", "error", err)
+		return
+	}
+	defer func() {
+		shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer shutdownCancel()
+		if err := shutdownTracing(shutdownCtx); err != nil {
+			logger.Error("Error flushing the spans", "error", err)
+		}
+	}()
+	var queueArgs amqp.Table
+	if config.singleActiveConsumer {
+		queueArgs = amqp.Table{shared.SingleActiveConsumerArg: true}
+	}
+	// A single queue, or one per partition
+	queues := []*shared.Client{}
+	if config.partitions == 0 {
+		queues = append(queues, shared.NewClientWithQueueArgs(config.ampqQueueName, queueArgs, config.ampqUri, logger))
+	}
+	for partition := 0; partition < config.partitions; partition++ {
+		queues = append(queues, shared.NewClientWithQueueArgs(shared.PartitionQueueName(config.ampqQueueName, partition), queueArgs, config.ampqUri, logger))
+	}
+	var replies *gatherer
+	if config.partitions > 0 {
+		replies, err = newGatherer(config, logger)
+		if err != nil {
+			logger.Error("Could not open the gather output", "file", config.gatherOutputFileName, "error", err)
+			return
+		}
+		replies.start()
+		defer replies.close()
+	}
+
+	if config.metricsAddr != "" {
+		metricsServer := shared.ServeMetrics(config.metricsAddr, logger)
+		defer func() {
+			_ = metricsServer.Close()
+		}()
+	}
 
 	// Give the connection sometime to set up
-	for !queue.IsReady {
+	for _, queue := range queues {
+		for !queue.IsReady {
+			<-time.After(time.Second)
+		}
+	}
+	// The replies to the queue not declared yet would be dropped
+	for replies != nil && !replies.client.IsReady {
 		<-time.After(time.Second)
 	}
 
-	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(time.Minute*10))
-	defer cancel()
-	defer logger.Println("Shutting down...")
+	defer logger.Info("Shutting down...")
 
+	stats := producer.NewLoadStats()
+	// The load mode pushes too many commands to log every one of them
+	pushedLevel := slog.LevelInfo
+	if config.loadMode() {
+		pushedLevel = slog.LevelDebug
+	}
 	commandsChannel := make(chan shared.Command)
 	var wg sync.WaitGroup
 	// Start submitters pool
 	for i := 0; i < config.numWorkers; i++ {
 		wg.Add(1)
-		go func(id int) {
+		go func(logger *slog.Logger) {
 			defer wg.Done()
 			for command := range commandsChannel {
-				logger.Printf("Worker %d: received task\n", id)
+				// Unique per push, so the consumer drops the copies re-published after a failed confirm
+				messageID := uniuri.NewLen(uniuri.UUIDLen)
+				logger := logger.With("message_id", messageID, "action", command.Action.String(), "namespace", command.Namespace, "key", command.Key)
+				logger.Debug("Received task")
+				commandCtx, span := shared.Tracer().Start(context.Background(), "produce "+command.Action.String(), trace.WithAttributes(
+					attribute.String("cmdhandler.namespace", command.Namespace),
+					attribute.String("cmdhandler.key", command.Key),
+				))
+				targets, err := shared.RoutePartitions(command, len(queues))
+				if err != nil {
+					logger.Error("Command can not be routed", "error", err)
+					stats.Record(0, err)
+					shared.EndSpan(span, err)
+					commandsPushed.WithLabelValues("failed").Inc()
+					continue
+				}
+				// Scatter-gather, every partition replies with its part of the answer
+				gathering := replies != nil && command.Action.Gathered() && command.ReplyTo == ""
+				if gathering {
+					command.ReplyTo = replies.replyQueue
+					command.QueryID = messageID
+					replies.expect(messageID, len(targets))
+				}
 				commandJson, err := json.Marshal(command)
 				if err != nil {
-					logger.Printf("Error encoding JSON: %s\n", err)
+					logger.Error("Error encoding JSON", "error", err)
+				}
+				if config.logBody {
+					logger.Info("Pushing message", "body", shared.RedactBody(commandJson, config.logRedactFields))
+				}
+				pushed := time.Now()
+				for _, target := range targets {
+					// The copies of the broadcast commands are different messages
+					targetMessageID := messageID
+					if len(targets) > 1 {
+						targetMessageID = fmt.Sprintf("%s.%d", messageID, target)
+					}
+					err = errors.Join(err, queues[target].PushMessage(commandCtx, targetMessageID, commandJson))
+				}
+				stats.Record(time.Since(pushed), err)
+				if gathering && err == nil {
+					result := replies.gather(messageID, command, len(targets), config.gatherTimeout)
+					if len(result.Missing) > 0 {
+						logger.Warn("Partitions did not reply in time", "missing", result.Missing)
+					}
+					logger.Info("Gathered the answer", "count", result.Count, "error", result.Error)
 				}
-				if err := queue.Push(commandJson); err != nil {
-					logger.Printf("Push failed: %s\n", err)
+				shared.EndSpan(span, err)
+				if span.SpanContext().HasTraceID() {
+					logger = logger.With("trace_id", span.SpanContext().TraceID().String())
+				}
+				if err != nil {
+					logger.Error("Push failed", "error", err)
+					commandsPushed.WithLabelValues("failed").Inc()
 				} else {
-					logger.Println("Push succeeded!")
+					logger.Log(context.Background(), pushedLevel, "Push succeeded!")
+					commandsPushed.WithLabelValues("ok").Inc()
 				}
 			}
-			logger.Printf("Worker %d: ended\n", id)
-		}(i)
+			logger.Info("Worker ended")
+		}(logger.With("worker", i))
 	}
 
-	repeatableCommands, err := parseConfiguration(config.scenarioFileName, logger)
+	scenario, err := parseConfiguration(config.scenarioFileName, config.scenarioFormat, logger)
 	if err != nil {
+		close(commandsChannel)
 		return
 	}
-
-	for _, repeatableCommand := range repeatableCommands {
-		// Add the Command to the channel 'Times' number of Times
-		for i := 0; i < repeatableCommand.Times; i++ {
-			commandsChannel <- repeatableCommand.Command
-		}
+	seed := config.seed
+	if seed == 0 {
+		seed = scenario.Seed
+	}
+	if seed == 0 {
+		seed = rand.Uint64()
 	}
+	// Log the seed, so the run can be reproduced
+	logger.Info("Running scenario", "file", config.scenarioFileName, "seed", seed,
+		"rate", config.load.Rate, "duration", config.duration, "loops", config.loops)
+
+	feed(config, scenario, seed, commandsChannel, logger)
 	close(commandsChannel)
 
+	drained := make(chan struct{})
 	go func() {
 		wg.Wait()
-		cancel()
+		close(drained)
 	}()
+	select {
+	case <-drained:
+	case <-time.After(drainTimeout):
+		logger.Warn("Workers did not finish pushing in time", "timeout", drainTimeout)
+	}
+	for _, queue := range queues {
+		_ = queue.Close()
+	}
+	logger.Info("Load report", "report", stats.Report())
+}
+
+// loadMode reports whether the commands are paced, time-limited or looped.
+func (c *ProducerConfig) loadMode() bool {
+	return c.load.Rate > 0 || c.duration > 0 || c.loops != 1
+}
 
-	for {
-		select {
-		case <-ctx.Done():
-			_ = queue.Close()
+// feed passes the commands of the scenario to the workers at the rate of the load profile, looping the scenario,
+// until it ran the loops times, the duration elapsed or the producer got interrupted.
+func feed(config *ProducerConfig, scenario *producer.Scenario, seed uint64, commands chan<- shared.Command, logger *slog.Logger) {
+	// The second interrupt kills the producer, the stop restores the default handling
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if config.duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.duration)
+		defer cancel()
+	}
+	limiter := producer.NewLimiter(config.load)
+	for loop := 0; config.loops == 0 || loop < config.loops; loop++ {
+		fed := 0
+		// Every loop has its own random data, the run is still reproduced by the seed
+		for command, err := range scenario.Commands(seed + uint64(loop)) {
+			if err != nil {
+				logger.Error("Error generating the command", "error", err)
+				return
+			}
+			if limiter.Wait(ctx) != nil {
+				return
+			}
+			select {
+			case commands <- command:
+				fed++
+			case <-ctx.Done():
+				return
+			}
+		}
+		if fed == 0 {
+			// Nothing to loop over
 			return
 		}
 	}
-
 }
 
-func parseConfiguration(configurationFilename string, logger *log.Logger) (repeatableCommands []RepeatableCommand, err error) {
-	file, err := os.Open(configurationFilename)
-	if err != nil {
-		logger.Println("Error opening file:", err)
-		return nil, err
+func parseConfiguration(configurationFilename, format string, logger *slog.Logger) (*producer.Scenario, error) {
+	file := os.Stdin
+	if configurationFilename != "-" {
+		var err error
+		file, err = os.Open(configurationFilename)
+		if err != nil {
+			logger.Error("Error opening file", "file", configurationFilename, "error", err)
+			return nil, err
+		}
 	}
 
 	content, err := io.ReadAll(file)
 	if err != nil {
-		logger.Println("Error reading file:", err)
+		logger.Error("Error reading file", "file", configurationFilename, "error", err)
 		return nil, err
 	}
 
-	err = json.Unmarshal(content, &repeatableCommands)
+	if format == "" {
+		format = producer.DetectScenarioFormat(configurationFilename, content)
+	}
+	scenario, err := producer.ParseScenarioFormat(content, format)
 	if err != nil {
-		logger.Println("Error unmarshalling JSON:", err)
+		logger.Error("Error parsing the scenario", "file", configurationFilename, "format", format, "error", err)
 		return nil, err
 	}
+	if file == os.Stdin {
+		return scenario, nil
+	}
 	err = file.Close()
 	if err != nil {
-		logger.Println("Error closing the file:", err)
+		logger.Error("Error closing the file", "file", configurationFilename, "error", err)
 		return nil, err
 	}
 
-	return repeatableCommands, nil
-}
-
-type RepeatableCommand struct {
-	Command shared.Command
-	Times   int
+	return scenario, nil
 }
@@ -0,0 +1,14 @@
+package main
+
+import (
+	"github.com/kgara/cmdhandler/pkg/shared"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var commandsPushed = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: shared.MetricsNamespace,
+	Subsystem: "producer",
+	Name:      "commands_pushed_total",
+	Help:      "Number of commands pushed, by the result: ok or failed.",
+}, []string{"result"})
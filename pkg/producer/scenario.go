@@ -0,0 +1,285 @@
+package producer
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/kgara/cmdhandler/pkg/shared"
+	"iter"
+	"math/rand/v2"
+	"strings"
+	"text/template"
+)
+
+// Name of the loop variable when the step does not set its own
+const defaultLoopVar = "i"
+
+// RepeatableCommand is a step of the scenario, repeated Times times. It is one of:
+//
+//   - Command: the command, its Key, Value, Namespace, Timeout and ReplyTo are templates
+//   - Steps: the loop over the nested steps
+//   - Mix: the random choice of one of the weighted commands on every repetition
+//
+// The repetition number, from 0, is the loop variable named by Var, i by default.
+type RepeatableCommand struct {
+	Command shared.Command
+	Times   int
+	Var     string              `json:",omitempty"`
+	Steps   []RepeatableCommand `json:",omitempty"`
+	Mix     []WeightedCommand   `json:",omitempty"`
+}
+
+// WeightedCommand is picked by the Mix with the probability of its Weight out of the sum of them.
+type WeightedCommand struct {
+	Weight  int
+	Command shared.Command
+}
+
+// Scenario is the list of the steps producing the commands. The scenario file is either the plain JSON array
+// of the steps or the object with the Steps along with the optional Seed of the random data and the Vars
+// available to all the templates.
+//
+// The templates see the Vars and the loop variables, e.g. key-{{.i}}, and the functions:
+//
+//	randString n     random alphanumeric string of length n
+//	randInt min max  random integer from min to max, both inclusive
+//	pick a b ...     random one of the arguments
+//	uuid             random UUID
+//	seq name         next number of the named sequence, from 1
+//
+// The same seed produces the same commands.
+type Scenario struct {
+	Seed  uint64
+	Vars  map[string]string
+	Steps []RepeatableCommand
+
+	// Parsed templates by their text
+	templates map[string]*template.Template
+}
+
+// ParseScenario parses and validates the JSON scenario.
+func ParseScenario(content []byte) (*Scenario, error) {
+	scenario := &Scenario{}
+	if trimmed := bytes.TrimSpace(content); len(trimmed) > 0 && trimmed[0] == '[' {
+		if err := json.Unmarshal(content, &scenario.Steps); err != nil {
+			return nil, err
+		}
+	} else if err := json.Unmarshal(content, scenario); err != nil {
+		return nil, err
+	}
+	if err := scenario.compile(); err != nil {
+		return nil, err
+	}
+	return scenario, nil
+}
+
+// compile validates the steps and parses all their templates.
+func (s *Scenario) compile() error {
+	s.templates = make(map[string]*template.Template)
+	return s.compileSteps(s.Steps, "steps")
+}
+
+func (s *Scenario) compileSteps(steps []RepeatableCommand, path string) error {
+	for i, step := range steps {
+		stepPath := fmt.Sprintf("%s[%d]", path, i)
+		if step.Times < 0 {
+			return fmt.Errorf("%s: negative Times %d", stepPath, step.Times)
+		}
+		switch {
+		case len(step.Steps) > 0 && len(step.Mix) > 0:
+			return fmt.Errorf("%s: both Steps and Mix are set", stepPath)
+		case len(step.Steps) > 0:
+			if err := s.compileSteps(step.Steps, stepPath+".Steps"); err != nil {
+				return err
+			}
+		case len(step.Mix) > 0:
+			for j, weighted := range step.Mix {
+				if weighted.Weight <= 0 {
+					return fmt.Errorf("%s.Mix[%d]: Weight must be positive", stepPath, j)
+				}
+				if err := s.compileCommand(weighted.Command, fmt.Sprintf("%s.Mix[%d]", stepPath, j)); err != nil {
+					return err
+				}
+			}
+		default:
+			if err := s.compileCommand(step.Command, stepPath); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Scenario) compileCommand(command shared.Command, path string) error {
+	for _, text := range []string{command.Key, command.Value, command.Namespace, command.Timeout, command.ReplyTo} {
+		if !strings.Contains(text, "{{") {
+			continue
+		}
+		if _, ok := s.templates[text]; ok {
+			continue
+		}
+		// The functions are bound to the generator, these ones only let the parsing check the names
+		parsed, err := template.New(path).Option("missingkey=error").Funcs(newGenerator(s, 0).funcs()).Parse(text)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		s.templates[text] = parsed
+	}
+	return nil
+}
+
+// Commands returns the commands of the scenario generated from the seed. The commands are generated
+// one at a time as they are taken, so the long scenarios do not take the memory.
+func (s *Scenario) Commands(seed uint64) iter.Seq2[shared.Command, error] {
+	return func(yield func(shared.Command, error) bool) {
+		generator := newGenerator(s, seed)
+		vars := make(map[string]any, len(s.Vars)+1)
+		for name, value := range s.Vars {
+			vars[name] = value
+		}
+		generator.steps(s.Steps, vars, yield)
+	}
+}
+
+// generator keeps the state of a single run through the scenario.
+type generator struct {
+	scenario  *Scenario
+	random    *rand.Rand
+	sequences map[string]int
+	// Templates bound to the functions of the generator, by their text
+	templates map[string]*template.Template
+}
+
+func newGenerator(scenario *Scenario, seed uint64) *generator {
+	return &generator{
+		scenario:  scenario,
+		random:    rand.New(rand.NewPCG(seed, seed^0x9e3779b97f4a7c15)),
+		sequences: make(map[string]int),
+		templates: make(map[string]*template.Template),
+	}
+}
+
+const randomAlphabet = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+func (g *generator) funcs() template.FuncMap {
+	return template.FuncMap{
+		"randString": func(length int) string {
+			var builder strings.Builder
+			for i := 0; i < length; i++ {
+				builder.WriteByte(randomAlphabet[g.random.IntN(len(randomAlphabet))])
+			}
+			return builder.String()
+		},
+		"randInt": func(min, max int) (int, error) {
+			if max < min {
+				return 0, fmt.Errorf("randInt: max %d is less than min %d", max, min)
+			}
+			return min + g.random.IntN(max-min+1), nil
+		},
+		"pick": func(choices ...string) (string, error) {
+			if len(choices) == 0 {
+				return "", errors.New("pick: nothing to pick from")
+			}
+			return choices[g.random.IntN(len(choices))], nil
+		},
+		"uuid": func() string {
+			var uuid [16]byte
+			for i := 0; i < len(uuid); i += 8 {
+				value := g.random.Uint64()
+				for j := 0; j < 8; j++ {
+					uuid[i+j] = byte(value >> (8 * j))
+				}
+			}
+			// Version 4, variant 10
+			uuid[6] = uuid[6]&0x0f | 0x40
+			uuid[8] = uuid[8]&0x3f | 0x80
+			return fmt.Sprintf("%x-%x-%x-%x-%x", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:16])
+		},
+		"seq": func(name string) int {
+			g.sequences[name]++
+			return g.sequences[name]
+		},
+	}
+}
+
+// steps yields the commands of the steps, returning false once the consumer stopped taking them.
+func (g *generator) steps(steps []RepeatableCommand, vars map[string]any, yield func(shared.Command, error) bool) bool {
+	for _, step := range steps {
+		loopVar := step.Var
+		if loopVar == "" {
+			loopVar = defaultLoopVar
+		}
+		outer, shadowed := vars[loopVar]
+		for i := 0; i < step.Times; i++ {
+			vars[loopVar] = i
+			var more bool
+			switch {
+			case len(step.Steps) > 0:
+				more = g.steps(step.Steps, vars, yield)
+			case len(step.Mix) > 0:
+				more = g.command(g.pick(step.Mix), vars, yield)
+			default:
+				more = g.command(step.Command, vars, yield)
+			}
+			if !more {
+				return false
+			}
+		}
+		if shadowed {
+			vars[loopVar] = outer
+		} else {
+			delete(vars, loopVar)
+		}
+	}
+	return true
+}
+
+// pick returns the random command of the mix, by the weights.
+func (g *generator) pick(mix []WeightedCommand) shared.Command {
+	total := 0
+	for _, weighted := range mix {
+		total += weighted.Weight
+	}
+	chosen := g.random.IntN(total)
+	for _, weighted := range mix {
+		if chosen < weighted.Weight {
+			return weighted.Command
+		}
+		chosen -= weighted.Weight
+	}
+	return mix[len(mix)-1].Command
+}
+
+func (g *generator) command(command shared.Command, vars map[string]any, yield func(shared.Command, error) bool) bool {
+	var err error
+	for _, field := range []*string{&command.Key, &command.Value, &command.Namespace, &command.Timeout, &command.ReplyTo} {
+		if *field, err = g.render(*field, vars); err != nil {
+			yield(shared.Command{}, err)
+			return false
+		}
+	}
+	return yield(command, nil)
+}
+
+// render executes the template of the text, the texts without any template are returned as they are.
+func (g *generator) render(text string, vars map[string]any) (string, error) {
+	parsed, ok := g.scenario.templates[text]
+	if !ok {
+		return text, nil
+	}
+	bound, ok := g.templates[text]
+	if !ok {
+		var err error
+		if bound, err = parsed.Clone(); err != nil {
+			return "", err
+		}
+		bound.Funcs(g.funcs())
+		g.templates[text] = bound
+	}
+	var builder strings.Builder
+	if err := bound.Execute(&builder, vars); err != nil {
+		return "", err
+	}
+	return builder.String(), nil
+}
@@ -0,0 +1,103 @@
+package producer
+
+import (
+	"github.com/kgara/cmdhandler/pkg/shared"
+	"github.com/stretchr/testify/assert"
+	"regexp"
+	"testing"
+)
+
+func collect(t *testing.T, scenario *Scenario, seed uint64) []shared.Command {
+	var commands []shared.Command
+	for command, err := range scenario.Commands(seed) {
+		assert.NoError(t, err)
+		commands = append(commands, command)
+	}
+	return commands
+}
+
+func TestParseScenarioPlainArray(t *testing.T) {
+	scenario, err := ParseScenario([]byte(`[
+		{"Command":{"Action":0,"Key":"key1","Value":"value1"},"Times":2},
+		{"Command":{"Action":3},"Times":1}
+	]`))
+	assert.NoError(t, err)
+
+	assert.Equal(t, []shared.Command{
+		{Action: shared.AddItem, Key: "key1", Value: "value1"},
+		{Action: shared.AddItem, Key: "key1", Value: "value1"},
+		{Action: shared.GetAllItems},
+	}, collect(t, scenario, 0))
+}
+
+func TestScenarioTemplatesAndLoops(t *testing.T) {
+	scenario, err := ParseScenario([]byte(`{
+		"Vars": {"prefix": "user"},
+		"Steps": [
+			{"Var": "n", "Times": 2, "Steps": [
+				{"Command":{"Action":0,"Key":"{{.prefix}}-{{.n}}-{{.i}}","Value":"{{seq \"values\"}}"},"Times":2}
+			]},
+			{"Command":{"Action":2,"Key":"{{.prefix}}-{{.i}}"},"Times":1}
+		]
+	}`))
+	assert.NoError(t, err)
+
+	assert.Equal(t, []shared.Command{
+		{Action: shared.AddItem, Key: "user-0-0", Value: "1"},
+		{Action: shared.AddItem, Key: "user-0-1", Value: "2"},
+		{Action: shared.AddItem, Key: "user-1-0", Value: "3"},
+		{Action: shared.AddItem, Key: "user-1-1", Value: "4"},
+		{Action: shared.GetItem, Key: "user-0"},
+	}, collect(t, scenario, 0))
+}
+
+func TestScenarioRandomDataIsSeeded(t *testing.T) {
+	scenario, err := ParseScenario([]byte(`{"Steps": [
+		{"Times": 100, "Mix": [
+			{"Weight": 3, "Command": {"Action":0,"Key":"key-{{randInt 1 10}}","Value":"{{randString 8}}"}},
+			{"Weight": 1, "Command": {"Action":1,"Key":"{{uuid}}","Namespace":"{{pick \"a\" \"b\"}}"}}
+		]}
+	]}`))
+	assert.NoError(t, err)
+
+	first := collect(t, scenario, 42)
+	assert.Len(t, first, 100)
+	assert.Equal(t, first, collect(t, scenario, 42))
+	assert.NotEqual(t, first, collect(t, scenario, 43))
+
+	added := 0
+	uuid := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	for _, command := range first {
+		switch command.Action {
+		case shared.AddItem:
+			added++
+			assert.Regexp(t, `^key-([1-9]|10)$`, command.Key)
+			assert.Regexp(t, `^[A-Za-z0-9]{8}$`, command.Value)
+		case shared.DeleteItem:
+			assert.Regexp(t, uuid, command.Key)
+			assert.Contains(t, []string{"a", "b"}, command.Namespace)
+		}
+	}
+	assert.InDelta(t, 75, added, 15)
+}
+
+func TestParseScenarioInvalid(t *testing.T) {
+	for _, content := range []string{
+		`[{"Command":{"Action":0,"Key":"{{.i"},"Times":1}]`,
+		`[{"Command":{"Action":0,"Key":"{{unknown}}"},"Times":1}]`,
+		`[{"Times":-1}]`,
+		`[{"Times":1,"Mix":[{"Weight":0}]}]`,
+		`[{"Times":1,"Mix":[{"Weight":1}],"Steps":[{"Times":1}]}]`,
+		`{"Steps": 1}`,
+	} {
+		_, err := ParseScenario([]byte(content))
+		assert.Error(t, err, content)
+	}
+
+	// Undefined variables fail on generating
+	scenario, err := ParseScenario([]byte(`[{"Command":{"Action":0,"Key":"{{.j}}"},"Times":1}]`))
+	assert.NoError(t, err)
+	for _, err := range scenario.Commands(0) {
+		assert.Error(t, err)
+	}
+}
@@ -0,0 +1,60 @@
+package shared
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// Log formats accepted by NewLogger
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// RedactedValue replaces the redacted fields of the logged bodies
+const RedactedValue = "[redacted]"
+
+// NewLogger creates the logger writing to w in the format, text or json, dropping the records below the level.
+// The level is one of debug, info, warn or error.
+func NewLogger(w io.Writer, format, level string) (*slog.Logger, error) {
+	var logLevel slog.Level
+	if err := logLevel.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("unknown log level %q, use one of debug, info, warn, error", level)
+	}
+	options := &slog.HandlerOptions{Level: logLevel}
+	switch format {
+	case LogFormatText:
+		return slog.New(slog.NewTextHandler(w, options)), nil
+	case LogFormatJSON:
+		return slog.New(slog.NewJSONHandler(w, options)), nil
+	default:
+		return nil, fmt.Errorf("unknown log format %q, use one of %s, %s", format, LogFormatText, LogFormatJSON)
+	}
+}
+
+// RedactBody returns the message body for logging with the top-level fields of the JSON object replaced
+// by RedactedValue, the field names are matched case-insensitively as encoding/json does.
+// The bodies which are not JSON objects are replaced as a whole, as nothing can be told about their content.
+func RedactBody(body []byte, fields []string) string {
+	if len(fields) == 0 {
+		return string(body)
+	}
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal(body, &object); err != nil {
+		return RedactedValue
+	}
+	redacted, _ := json.Marshal(RedactedValue)
+	for name := range object {
+		for _, field := range fields {
+			if strings.EqualFold(name, field) {
+				object[name] = redacted
+			}
+		}
+	}
+	// Marshalling the raw messages back does not fail
+	data, _ := json.Marshal(object)
+	return string(data)
+}
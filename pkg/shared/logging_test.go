@@ -0,0 +1,29 @@
+package shared
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestNewLogger(t *testing.T) {
+	var output bytes.Buffer
+	logger, err := NewLogger(&output, LogFormatJSON, "warn")
+	assert.NoError(t, err)
+	logger.Info("Dropped")
+	logger.Warn("Push failed", "routing_key", "job_queue")
+	assert.Contains(t, output.String(), `"msg":"Push failed","routing_key":"job_queue"`)
+	assert.NotContains(t, output.String(), "Dropped")
+
+	_, err = NewLogger(&output, "xml", "info")
+	assert.Error(t, err)
+	_, err = NewLogger(&output, LogFormatText, "verbose")
+	assert.Error(t, err)
+}
+
+func TestRedactBody(t *testing.T) {
+	body := []byte(`{"Action":0,"Key":"key1","Value":"secret"}`)
+	assert.Equal(t, `{"Action":0,"Key":"key1","Value":"[redacted]"}`, RedactBody(body, []string{"value"}))
+	assert.Equal(t, string(body), RedactBody(body, nil))
+	assert.Equal(t, RedactedValue, RedactBody([]byte("not json"), []string{"Value"}))
+}
@@ -0,0 +1,70 @@
+package shared
+
+import (
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"log/slog"
+	"net/http"
+)
+
+// MetricsNamespace prefixes the names of all the cmdhandler metrics
+const MetricsNamespace = "cmdhandler"
+
+// AMQP client metrics, labeled by the target, the queue or the exchange the client was created for
+var (
+	amqpReconnects = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Subsystem: "amqp",
+		Name:      "reconnects_total",
+		Help:      "Number of times the connection or the channel was lost and set up again.",
+	}, []string{"target", "kind"})
+	amqpPublishConfirms = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Subsystem: "amqp",
+		Name:      "publish_confirms_total",
+		Help:      "Number of publishings confirmed by the broker, by the result: ack or nack.",
+	}, []string{"target", "result"})
+	amqpPublishFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Subsystem: "amqp",
+		Name:      "publish_failures_total",
+		Help:      "Number of publishings failed before reaching the broker.",
+	}, []string{"target"})
+	amqpConfirmLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: MetricsNamespace,
+		Subsystem: "amqp",
+		Name:      "confirm_latency_seconds",
+		Help:      "Time from publishing to the broker confirmation.",
+		Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 14),
+	}, []string{"target"})
+)
+
+// metricsTarget is the label value of the client.
+func (client *Client) metricsTarget() string {
+	if client.exchangeName != "" {
+		return client.exchangeName
+	}
+	return client.queueName
+}
+
+// MetricsHandler serves the metrics of the default registry in the Prometheus text format.
+func MetricsHandler() http.Handler {
+	return promhttp.Handler()
+}
+
+// ServeMetrics starts serving /metrics on the address in the background.
+// The returned server is to be shut down by the caller.
+func ServeMetrics(addr string, logger *slog.Logger) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", MetricsHandler())
+	server := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		logger.Info("Metrics listening", "addr", addr)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("Metrics server failed", "error", err)
+		}
+	}()
+	return server
+}
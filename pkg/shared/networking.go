@@ -4,13 +4,18 @@ import (
 	"context"
 	"errors"
 	amqp "github.com/rabbitmq/amqp091-go"
-	"log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"log/slog"
 	"time"
 )
 
 type Client struct {
 	queueName       string
-	logger          *log.Logger
+	queueArgs       amqp.Table
+	exchangeName    string
+	exchangeKind    string
+	logger          *slog.Logger
 	connection      *amqp.Connection
 	Channel         *amqp.Channel
 	done            chan bool
@@ -34,29 +39,69 @@ var (
 	errShutdown      = errors.New("client is shutting down")
 )
 
+// SingleActiveConsumerArg is the queue argument making the broker deliver to a single consumer at a time,
+// the next one takes over once it goes away. The queue arguments must match on all the clients declaring it.
+const SingleActiveConsumerArg = "x-single-active-consumer"
+
 // NewClient creates a new consumer state instance, and automatically
 // attempts to connect to the server.
-func NewClient(queueName, addr string, logger *log.Logger) *Client {
+func NewClient(queueName, addr string, logger *slog.Logger) *Client {
+	return NewClientWithQueueArgs(queueName, nil, addr, logger)
+}
+
+// NewClientWithQueueArgs is NewClient declaring the queue with the arguments, e.g. SingleActiveConsumerArg.
+func NewClientWithQueueArgs(queueName string, queueArgs amqp.Table, addr string, logger *slog.Logger) *Client {
 	client := Client{
 		logger:    logger,
 		queueName: queueName,
+		queueArgs: queueArgs,
 		done:      make(chan bool),
 	}
 	go client.handleReconnect(addr)
 	return &client
 }
 
+// NewExchangeClient creates a new client publishing to the exchange of the given kind
+// instead of the queue, and automatically attempts to connect to the server.
+// The exchange is declared durable, the consumers are expected to bind their own queues to it.
+func NewExchangeClient(exchangeName, exchangeKind, addr string, logger *slog.Logger) *Client {
+	client := Client{
+		logger:       logger,
+		exchangeName: exchangeName,
+		exchangeKind: exchangeKind,
+		done:         make(chan bool),
+	}
+	go client.handleReconnect(addr)
+	return &client
+}
+
+// NewSubscriptionClient creates a new client consuming from its own queue bound to the exchange
+// of the given kind, and automatically attempts to connect to the server.
+// Both the exchange and the queue are declared, the queue gets everything published to the exchange from then on
+// and it is deleted once its last consumer goes away.
+func NewSubscriptionClient(exchangeName, exchangeKind, queueName, addr string, logger *slog.Logger) *Client {
+	client := Client{
+		logger:       logger,
+		queueName:    queueName,
+		exchangeName: exchangeName,
+		exchangeKind: exchangeKind,
+		done:         make(chan bool),
+	}
+	go client.handleReconnect(addr)
+	return &client
+}
+
 // handleReconnect will wait for a connection error on
 // notifyConnClose, and then continuously attempt to reconnect.
 func (client *Client) handleReconnect(addr string) {
 	for {
 		client.IsReady = false
-		client.logger.Println("Attempting to connect")
+		client.logger.Info("Attempting to connect", "target", client.metricsTarget())
 
 		conn, err := client.connect(addr)
 
 		if err != nil {
-			client.logger.Println("Failed to connect. Retrying...")
+			client.logger.Warn("Failed to connect. Retrying...", "target", client.metricsTarget(), "error", err)
 
 			select {
 			case <-client.done:
@@ -81,7 +126,7 @@ func (client *Client) connect(addr string) (*amqp.Connection, error) {
 	}
 
 	client.changeConnection(conn)
-	client.logger.Println("Connected!")
+	client.logger.Info("Connected!", "target", client.metricsTarget())
 	return conn, nil
 }
 
@@ -94,13 +139,14 @@ func (client *Client) handleReInit(conn *amqp.Connection) bool {
 		err := client.init(conn)
 
 		if err != nil {
-			client.logger.Println("Failed to initialize channel. Retrying...")
+			client.logger.Warn("Failed to initialize channel. Retrying...", "target", client.metricsTarget(), "error", err)
 
 			select {
 			case <-client.done:
 				return true
 			case <-client.notifyConnClose:
-				client.logger.Println("Connection closed. Reconnecting...")
+				client.logger.Warn("Connection closed. Reconnecting...", "target", client.metricsTarget())
+				amqpReconnects.WithLabelValues(client.metricsTarget(), "connection").Inc()
 				return false
 			case <-time.After(reInitDelay):
 			}
@@ -111,15 +157,17 @@ func (client *Client) handleReInit(conn *amqp.Connection) bool {
 		case <-client.done:
 			return true
 		case <-client.notifyConnClose:
-			client.logger.Println("Connection closed. Reconnecting...")
+			client.logger.Warn("Connection closed. Reconnecting...", "target", client.metricsTarget())
+			amqpReconnects.WithLabelValues(client.metricsTarget(), "connection").Inc()
 			return false
 		case <-client.notifyChanClose:
-			client.logger.Println("Channel closed. Re-running init...")
+			client.logger.Warn("Channel closed. Re-running init...", "target", client.metricsTarget())
+			amqpReconnects.WithLabelValues(client.metricsTarget(), "channel").Inc()
 		}
 	}
 }
 
-// init will initialize channel & declare queue
+// init will initialize channel & declare queue, exchange or both bound together
 func (client *Client) init(conn *amqp.Connection) error {
 	ch, err := conn.Channel()
 
@@ -132,14 +180,32 @@ func (client *Client) init(conn *amqp.Connection) error {
 	if err != nil {
 		return err
 	}
-	_, err = ch.QueueDeclare(
-		client.queueName,
-		false,
-		false,
-		false,
-		false,
-		nil,
-	)
+	if client.exchangeName != "" {
+		err = ch.ExchangeDeclare(
+			client.exchangeName,
+			client.exchangeKind,
+			true,
+			false,
+			false,
+			false,
+			nil,
+		)
+	}
+	// The exchange clients publishing only have no queue of their own
+	if err == nil && (client.exchangeName == "" || client.queueName != "") {
+		_, err = ch.QueueDeclare(
+			client.queueName,
+			false,
+			// The subscriptions do not outlive their consumers
+			client.exchangeName != "",
+			false,
+			false,
+			client.queueArgs,
+		)
+	}
+	if err == nil && client.exchangeName != "" && client.queueName != "" {
+		err = ch.QueueBind(client.queueName, "", client.exchangeName, false, nil)
+	}
 
 	if err != nil {
 		return err
@@ -147,7 +213,7 @@ func (client *Client) init(conn *amqp.Connection) error {
 
 	client.changeChannel(ch)
 	client.IsReady = true
-	client.logger.Println("Setup!")
+	client.logger.Info("Setup!", "target", client.metricsTarget())
 
 	return nil
 }
@@ -202,13 +268,49 @@ func (client *Client) Consume() (<-chan amqp.Delivery, error) {
 // This will block until the server sends a confirm. Errors are
 // only returned if the push action itself fails, see UnsafePush.
 func (client *Client) Push(data []byte) error {
+	return client.PushToWithContext(context.Background(), client.queueName, data)
+}
+
+// PushWithContext is Push continuing the trace of ctx.
+func (client *Client) PushWithContext(ctx context.Context, data []byte) error {
+	return client.PushToWithContext(ctx, client.queueName, data)
+}
+
+// PushTo is Push with an explicit routing key, e.g. to answer
+// on the reply queue of the sender instead of the client queue.
+func (client *Client) PushTo(routingKey string, data []byte) error {
+	return client.PushToWithContext(context.Background(), routingKey, data)
+}
+
+// PushToWithContext is PushTo continuing the trace of ctx.
+func (client *Client) PushToWithContext(ctx context.Context, routingKey string, data []byte) error {
+	return client.push(ctx, routingKey, "", data)
+}
+
+// PushMessage is PushWithContext with the message id set. The id stays the same
+// when the message is re-published after a failed confirm, so the consumers can drop the copies.
+func (client *Client) PushMessage(ctx context.Context, messageID string, data []byte) error {
+	return client.push(ctx, client.queueName, messageID, data)
+}
+
+func (client *Client) push(ctx context.Context, routingKey, messageID string, data []byte) (err error) {
+	ctx, span := Tracer().Start(ctx, "push "+routingKey, trace.WithAttributes(
+		attribute.String("messaging.system", "rabbitmq"),
+		attribute.String("messaging.destination.name", routingKey),
+		attribute.String("messaging.message.id", messageID),
+	))
+	defer func() {
+		EndSpan(span, err)
+	}()
 	if !client.IsReady {
 		return errors.New("failed to push: not connected")
 	}
 	for {
-		err := client.UnsafePush(data)
+		published := time.Now()
+		err := client.unsafePush(ctx, routingKey, messageID, data)
 		if err != nil {
-			client.logger.Println("Push failed. Retrying...")
+			client.logger.Warn("Push failed. Retrying...", "routing_key", routingKey, "message_id", messageID, "error", err)
+			amqpPublishFailures.WithLabelValues(client.metricsTarget()).Inc()
 			select {
 			case <-client.done:
 				return errShutdown
@@ -216,11 +318,17 @@ func (client *Client) Push(data []byte) error {
 			}
 			continue
 		}
+		_, confirmSpan := Tracer().Start(ctx, "confirm wait")
 		confirm := <-client.notifyConfirm
+		confirmSpan.SetAttributes(attribute.Bool("messaging.rabbitmq.ack", confirm.Ack))
+		confirmSpan.End()
+		amqpConfirmLatency.WithLabelValues(client.metricsTarget()).Observe(time.Since(published).Seconds())
 		if confirm.Ack {
-			client.logger.Printf("Push confirmed [%d]!", confirm.DeliveryTag)
+			amqpPublishConfirms.WithLabelValues(client.metricsTarget(), "ack").Inc()
+			client.logger.Debug("Push confirmed", "routing_key", routingKey, "delivery_tag", confirm.DeliveryTag)
 			return nil
 		}
+		amqpPublishConfirms.WithLabelValues(client.metricsTarget(), "nack").Inc()
 	}
 }
 
@@ -229,21 +337,48 @@ func (client *Client) Push(data []byte) error {
 // No guarantees are provided for whether the server will
 // receive the message.
 func (client *Client) UnsafePush(data []byte) error {
+	return client.UnsafePushToWithContext(context.Background(), client.queueName, data)
+}
+
+// UnsafePushTo is UnsafePush with an explicit routing key.
+func (client *Client) UnsafePushTo(routingKey string, data []byte) error {
+	return client.UnsafePushToWithContext(context.Background(), routingKey, data)
+}
+
+// UnsafePushToWithContext is UnsafePushTo continuing the trace of ctx.
+// The publish span context travels in the W3C traceparent header,
+// so the consumer spans join the trace of the sender.
+func (client *Client) UnsafePushToWithContext(ctx context.Context, routingKey string, data []byte) error {
+	return client.unsafePush(ctx, routingKey, "", data)
+}
+
+func (client *Client) unsafePush(ctx context.Context, routingKey, messageID string, data []byte) (err error) {
+	ctx, span := Tracer().Start(ctx, "publish "+routingKey, trace.WithSpanKind(trace.SpanKindProducer), trace.WithAttributes(
+		attribute.String("messaging.system", "rabbitmq"),
+		attribute.String("messaging.destination.name", routingKey),
+		attribute.String("messaging.message.id", messageID),
+		attribute.Int("messaging.message.body.size", len(data)),
+	))
+	defer func() {
+		EndSpan(span, err)
+	}()
 	if !client.IsReady {
 		return errNotConnected
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
 	defer cancel()
 
 	return client.Channel.PublishWithContext(
 		ctx,
-		"",
-		client.queueName,
+		client.exchangeName,
+		routingKey,
 		false,
 		false,
 		amqp.Publishing{
 			ContentType: "text/plain",
+			MessageId:   messageID,
+			Headers:     InjectTraceContext(ctx, nil),
 			Body:        data,
 		},
 	)
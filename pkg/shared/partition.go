@@ -0,0 +1,121 @@
+package shared
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// Item is a key-value pair of the ordered map
+type Item struct {
+	Key   string
+	Value string
+}
+
+// ItemsReply is pushed by every partition to the ReplyTo queue of the scatter-gather query, see Gathered.
+type ItemsReply struct {
+	QueryID   string
+	Partition int
+	Namespace string
+	// Version of the partition map the items were read at
+	Version uint64
+	Items   []Item
+	// Count of the keys of the partition, Count only
+	Count int `json:",omitempty"`
+	// Error is the reason the query failed, e.g. the invalid pattern
+	Error string `json:",omitempty"`
+}
+
+// PartitionOf returns the partition owning the key, out of the given number of them.
+// It is the jump consistent hash of the key, so adding a partition moves only the keys
+// the new partition takes over.
+func PartitionOf(key string, partitions int) int {
+	hash := fnv.New64a()
+	_, _ = hash.Write([]byte(key))
+	k := hash.Sum64()
+	var b, j int64 = -1, 0
+	for j < int64(partitions) {
+		b = j
+		k = k*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((k>>33)+1)))
+	}
+	return int(b)
+}
+
+// PartitionQueueName returns the name of the queue of the partition.
+func PartitionQueueName(queueName string, partition int) string {
+	return queueName + "." + strconv.Itoa(partition)
+}
+
+// Keyed reports if the action addresses a single key, only those are routed to the partition owning the key.
+func (a ActionType) Keyed() bool {
+	switch a {
+	case AddItem, DeleteItem, GetItem, Increment, Decrement, Append, Prepend, GetAndSet, Exists:
+		return true
+	default:
+		return false
+	}
+}
+
+// Gathered reports if the action is the scatter-gather query in the partitioned mode, every partition replies
+// with its part of the answer, see ItemsReply.
+func (a ActionType) Gathered() bool {
+	switch a {
+	case GetAllItems, Count, GetByPrefix, GetByGlob, GetByRegex, GetByValue:
+		return true
+	default:
+		return false
+	}
+}
+
+// Positional reports if the action works on the front or the back of the map. There is no insertion order
+// across the partitions, so those are rejected in the partitioned mode.
+func (a ActionType) Positional() bool {
+	switch a {
+	case PopFront, PopBack, PeekFront, PeekBack, BlockingPopFront:
+		return true
+	default:
+		return false
+	}
+}
+
+// RoutePartitions returns the partitions the command goes to, out of the given number of them: the partition
+// owning the key for the keyed commands and all of them for the rest. The positional commands are rejected
+// when there are several partitions, popping every one of them would take several items.
+func RoutePartitions(command Command, partitions int) ([]int, error) {
+	if command.Action.Keyed() {
+		return []int{PartitionOf(command.Key, partitions)}, nil
+	}
+	if command.Action.Positional() && partitions > 1 {
+		return nil, fmt.Errorf("%s is not supported across %d partitions", command.Action, partitions)
+	}
+	targets := make([]int, partitions)
+	for i := range targets {
+		targets[i] = i
+	}
+	return targets, nil
+}
+
+// MergeItems merges the replies of the partitions into a single listing. The keys are unique across
+// the partitions, the items come in the order of the partitions and in the insertion order within each one,
+// as there is no insertion order across them.
+func MergeItems(replies []ItemsReply) []Item {
+	sorted := make([]ItemsReply, len(replies))
+	copy(sorted, replies)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Partition < sorted[j].Partition })
+	items := make([]Item, 0)
+	for _, reply := range sorted {
+		items = append(items, reply.Items...)
+	}
+	return items
+}
+
+// SumCounts sums the counts of the keys replied by the partitions to the scatter-gather Count.
+func SumCounts(replies []ItemsReply) int {
+	sum := 0
+	for _, reply := range replies {
+		sum += reply.Count
+	}
+	return sum
+}
@@ -0,0 +1,66 @@
+package shared
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestPartitionOfSpreadsKeys(t *testing.T) {
+	counts := make([]int, 4)
+	for i := 0; i < 4000; i++ {
+		partition := PartitionOf(fmt.Sprintf("key%d", i), 4)
+		assert.GreaterOrEqual(t, partition, 0)
+		assert.Less(t, partition, 4)
+		counts[partition]++
+	}
+	for _, count := range counts {
+		assert.InDelta(t, 1000, count, 200)
+	}
+	assert.Equal(t, 0, PartitionOf("key1", 1))
+}
+
+func TestPartitionOfMovesOnlyToTheNewPartition(t *testing.T) {
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key%d", i)
+		before, after := PartitionOf(key, 4), PartitionOf(key, 5)
+		if before != after {
+			assert.Equal(t, 4, after, key)
+		}
+	}
+}
+
+func TestMergeItems(t *testing.T) {
+	items := MergeItems([]ItemsReply{
+		{Partition: 1, Items: []Item{{"key3", "value3"}}},
+		{Partition: 0, Items: []Item{{"key2", "value2"}, {"key1", "value1"}}},
+		{Partition: 2},
+	})
+	assert.Equal(t, []Item{{"key2", "value2"}, {"key1", "value1"}, {"key3", "value3"}}, items)
+	assert.Empty(t, MergeItems(nil))
+	assert.Equal(t, "job_queue.2", PartitionQueueName("job_queue", 2))
+}
+
+func TestRoutePartitions(t *testing.T) {
+	targets, err := RoutePartitions(Command{Action: AddItem, Key: "key1"}, 4)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{PartitionOf("key1", 4)}, targets)
+
+	targets, err = RoutePartitions(Command{Action: Count}, 3)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{0, 1, 2}, targets)
+
+	// Popping every partition would take several items
+	for _, action := range []ActionType{PopFront, PopBack, PeekFront, PeekBack, BlockingPopFront} {
+		_, err = RoutePartitions(Command{Action: action}, 2)
+		assert.Error(t, err, action.String())
+	}
+	targets, err = RoutePartitions(Command{Action: PopFront}, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{0}, targets)
+}
+
+func TestSumCounts(t *testing.T) {
+	assert.Equal(t, 5, SumCounts([]ItemsReply{{Partition: 0, Count: 2}, {Partition: 1}, {Partition: 2, Count: 3}}))
+	assert.Equal(t, 0, SumCounts(nil))
+}
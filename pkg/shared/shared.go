@@ -1,12 +1,24 @@
 package shared
 
-import "fmt"
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
 
 // Command Our client-server command
 type Command struct {
 	Action ActionType
 	Key    string
 	Value  string
+	// Namespace selects the named map the command is executed against, empty for the default one
+	Namespace string `json:",omitempty"`
+	// Timeout is an optional duration string (e.g. "5s") used by the blocking actions and as the watch expiry
+	Timeout string `json:",omitempty"`
+	// ReplyTo is the queue the watch notifications and the scatter-gather replies are pushed to
+	ReplyTo string `json:",omitempty"`
+	// QueryID correlates the scatter-gather replies with the query, see ItemsReply
+	QueryID string `json:",omitempty"`
 }
 
 type ActionType int
@@ -16,8 +28,40 @@ const (
 	DeleteItem
 	GetItem
 	GetAllItems
+	PopFront
+	PopBack
+	PeekFront
+	PeekBack
+	BlockingPopFront
+	CreateMap
+	DropMap
+	ListMaps
+	Increment
+	Decrement
+	Append
+	Prepend
+	GetAndSet
+	GetByPrefix
+	GetByGlob
+	GetByRegex
+	GetByValue
+	Count
+	Exists
+	Watch
+	Unwatch
 )
 
+// Idempotent reports if executing the command once again leaves the map as executing it once, so the command
+// may be retried. The likes of Increment or PopFront are applied twice.
+func (a ActionType) Idempotent() bool {
+	switch a {
+	case PopFront, PopBack, BlockingPopFront, Increment, Decrement, Append, Prepend, GetAndSet:
+		return false
+	default:
+		return true
+	}
+}
+
 func (a ActionType) String() string {
 	switch a {
 	case AddItem:
@@ -28,7 +72,102 @@ func (a ActionType) String() string {
 		return "getItem"
 	case GetAllItems:
 		return "getAllItems"
+	case PopFront:
+		return "popFront"
+	case PopBack:
+		return "popBack"
+	case PeekFront:
+		return "peekFront"
+	case PeekBack:
+		return "peekBack"
+	case BlockingPopFront:
+		return "blockingPopFront"
+	case CreateMap:
+		return "createMap"
+	case DropMap:
+		return "dropMap"
+	case ListMaps:
+		return "listMaps"
+	case Increment:
+		return "increment"
+	case Decrement:
+		return "decrement"
+	case Append:
+		return "append"
+	case Prepend:
+		return "prepend"
+	case GetAndSet:
+		return "getAndSet"
+	case GetByPrefix:
+		return "getByPrefix"
+	case GetByGlob:
+		return "getByGlob"
+	case GetByRegex:
+		return "getByRegex"
+	case GetByValue:
+		return "getByValue"
+	case Count:
+		return "count"
+	case Exists:
+		return "exists"
+	case Watch:
+		return "watch"
+	case Unwatch:
+		return "unwatch"
 	default:
 		return fmt.Sprintf("unknownAction: %d", a)
 	}
 }
+
+// Short names of the actions accepted by ParseActionType along with the full ones
+var actionAliases = map[string]ActionType{
+	"add":    AddItem,
+	"set":    AddItem,
+	"delete": DeleteItem,
+	"del":    DeleteItem,
+	"get":    GetItem,
+	"getall": GetAllItems,
+	"all":    GetAllItems,
+	"create": CreateMap,
+	"drop":   DropMap,
+	"list":   ListMaps,
+	"incr":   Increment,
+	"decr":   Decrement,
+}
+
+// ParseActionType returns the action by its name, either the one returned by String or its short alias,
+// e.g. addItem or add, ignoring the case.
+func ParseActionType(name string) (ActionType, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if action, ok := actionAliases[name]; ok {
+		return action, nil
+	}
+	for action := AddItem; action <= Unwatch; action++ {
+		if strings.ToLower(action.String()) == name {
+			return action, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown action %q", name)
+}
+
+// UnmarshalJSON accepts the action either as its integer code or as its name, see ParseActionType.
+func (a *ActionType) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		var name string
+		if err := json.Unmarshal(data, &name); err != nil {
+			return err
+		}
+		action, err := ParseActionType(name)
+		if err != nil {
+			return err
+		}
+		*a = action
+		return nil
+	}
+	var code int
+	if err := json.Unmarshal(data, &code); err != nil {
+		return fmt.Errorf("action is neither a name nor a code: %s", data)
+	}
+	*a = ActionType(code)
+	return nil
+}
@@ -45,3 +45,40 @@ func TestCommandDeserializationNilValue(t *testing.T) {
 	}
 	assert.Equal(t, expectedCommand, actualCommand)
 }
+
+func TestCommandDeserializationActionName(t *testing.T) {
+	for _, jsonCommand := range []string{
+		`{"Action":"getItem","Key":"key1"}`,
+		`{"Action":"GET","Key":"key1"}`,
+		`{"Action":2,"Key":"key1"}`,
+	} {
+		actualCommand := &Command{}
+		assert.NoError(t, json.Unmarshal([]byte(jsonCommand), actualCommand), jsonCommand)
+		assert.Equal(t, &Command{Action: GetItem, Key: "key1"}, actualCommand)
+	}
+
+	assert.Error(t, json.Unmarshal([]byte(`{"Action":"fly"}`), &Command{}))
+	assert.Error(t, json.Unmarshal([]byte(`{"Action":true}`), &Command{}))
+}
+
+func TestParseActionType(t *testing.T) {
+	for action := AddItem; action <= Unwatch; action++ {
+		parsed, err := ParseActionType(action.String())
+		assert.NoError(t, err)
+		assert.Equal(t, action, parsed)
+	}
+	parsed, err := ParseActionType("add")
+	assert.NoError(t, err)
+	assert.Equal(t, AddItem, parsed)
+	_, err = ParseActionType("unknownAction: 99")
+	assert.Error(t, err)
+}
+
+func TestActionTypeIdempotent(t *testing.T) {
+	assert.True(t, AddItem.Idempotent())
+	assert.True(t, GetAllItems.Idempotent())
+	assert.True(t, DropMap.Idempotent())
+	assert.False(t, Increment.Idempotent())
+	assert.False(t, PopFront.Idempotent())
+	assert.False(t, GetAndSet.Idempotent())
+}
@@ -0,0 +1,177 @@
+package shared
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// TracerName is the instrumentation name of the cmdhandler spans
+const TracerName = "github.com/kgara/cmdhandler"
+
+// Tracer returns the tracer of the global provider, the spans are dropped until SetupTracing is called.
+func Tracer() trace.Tracer {
+	return otel.Tracer(TracerName)
+}
+
+// SetupTracing installs the global tracer provider exporting to the spec and the W3C trace context propagator.
+// The spec is one of:
+//
+//	""                      tracing disabled, the context is still propagated
+//	otlp                    OTLP over HTTP, configured by the OTEL_EXPORTER_OTLP_* variables
+//	otlp://host:4318/path   OTLP over HTTP, the path defaults to /v1/traces
+//	otlps://host:4318/path  OTLP over HTTPS
+//	stdout                  JSON spans on the standard output
+//	file:///path, /path     JSON spans appended to the file, usable offline
+//
+// The returned func flushes the pending spans and is to be called on exit.
+func SetupTracing(spec, serviceName string, logger *slog.Logger) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	if spec == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, closer, err := newSpanExporter(spec)
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(attribute.String("service.name", serviceName)))
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		logger.Error("Tracing failed", "error", err)
+	}))
+	logger.Info("Tracing", "exporter", spec)
+
+	return func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		if closer != nil {
+			err = errors.Join(err, closer.Close())
+		}
+		return err
+	}, nil
+}
+
+// newSpanExporter creates the exporter of the spec, the closer is set for the files only.
+func newSpanExporter(spec string) (sdktrace.SpanExporter, io.Closer, error) {
+	switch spec {
+	case "otlp":
+		exporter, err := otlptracehttp.New(context.Background())
+		return exporter, nil, err
+	case "stdout":
+		exporter, err := stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+		return exporter, nil, err
+	}
+
+	fileName := spec
+	if strings.Contains(spec, "://") {
+		target, err := url.Parse(spec)
+		if err != nil {
+			return nil, nil, fmt.Errorf("trace exporter %q: %w", spec, err)
+		}
+		switch target.Scheme {
+		case "otlp", "otlps":
+			return newOTLPExporter(target)
+		case "file":
+			fileName = target.Path
+		default:
+			return nil, nil, fmt.Errorf("trace exporter %q: unknown scheme %s", spec, target.Scheme)
+		}
+	}
+	if fileName == "" {
+		return nil, nil, fmt.Errorf("trace exporter %q: missing file name", spec)
+	}
+	file, err := os.OpenFile(fileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	exporter, err := stdouttrace.New(stdouttrace.WithWriter(file))
+	if err != nil {
+		_ = file.Close()
+		return nil, nil, err
+	}
+	return exporter, file, nil
+}
+
+func newOTLPExporter(target *url.URL) (sdktrace.SpanExporter, io.Closer, error) {
+	if target.Host == "" {
+		return nil, nil, fmt.Errorf("trace exporter %q: missing host", target)
+	}
+	endpoint := *target
+	endpoint.Scheme = "http"
+	if target.Scheme == "otlps" {
+		endpoint.Scheme = "https"
+	}
+	if endpoint.Path == "" || endpoint.Path == "/" {
+		endpoint.Path = "/v1/traces"
+	}
+	exporter, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(endpoint.String()))
+	return exporter, nil, err
+}
+
+// amqpHeaderCarrier adapts the AMQP headers to the propagators.
+type amqpHeaderCarrier amqp.Table
+
+func (c amqpHeaderCarrier) Get(key string) string {
+	value, _ := c[key].(string)
+	return value
+}
+
+func (c amqpHeaderCarrier) Set(key, value string) {
+	c[key] = value
+}
+
+func (c amqpHeaderCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// InjectTraceContext adds the trace context of ctx to the headers, creating them if nil.
+func InjectTraceContext(ctx context.Context, headers amqp.Table) amqp.Table {
+	if headers == nil {
+		headers = amqp.Table{}
+	}
+	otel.GetTextMapPropagator().Inject(ctx, amqpHeaderCarrier(headers))
+	return headers
+}
+
+// ExtractTraceContext returns ctx with the remote trace context carried by the headers, if any.
+func ExtractTraceContext(ctx context.Context, headers amqp.Table) context.Context {
+	if headers == nil {
+		return ctx
+	}
+	return otel.GetTextMapPropagator().Extract(ctx, amqpHeaderCarrier(headers))
+}
+
+// EndSpan marks the span failed on the error and ends it.
+func EndSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,56 @@
+package shared
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTraceContextPropagation(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "spans.json")
+	shutdown, err := SetupTracing("file://"+fileName, "test", slog.New(slog.NewTextHandler(io.Discard, nil)))
+	assert.NoError(t, err)
+
+	ctx, span := Tracer().Start(context.Background(), "publish job_queue")
+	headers := InjectTraceContext(ctx, nil)
+	span.End()
+	assert.Contains(t, headers, "traceparent")
+
+	_, consumerSpan := Tracer().Start(ExtractTraceContext(context.Background(), headers), "process job_queue")
+	consumerSpan.End()
+	assert.Equal(t, span.SpanContext().TraceID(), consumerSpan.SpanContext().TraceID())
+
+	assert.NoError(t, shutdown(context.Background()))
+	content, err := os.ReadFile(fileName)
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+	assert.Len(t, lines, 2)
+	assert.Contains(t, lines[1], `"Name":"process job_queue"`)
+	// The parent of the consumer span is the remote publish span
+	assert.Contains(t, lines[1], `"Parent":{"TraceID":"`+span.SpanContext().TraceID().String()+`","SpanID":"`+span.SpanContext().SpanID().String()+`"`)
+}
+
+func TestExtractTraceContextWithoutHeaders(t *testing.T) {
+	ctx := ExtractTraceContext(context.Background(), nil)
+	_, span := Tracer().Start(ctx, "process job_queue")
+	defer span.End()
+	assert.False(t, span.SpanContext().IsRemote())
+}
+
+func TestSetupTracingInvalidSpec(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	_, err := SetupTracing("ftp://host/spans", "test", logger)
+	assert.Error(t, err)
+
+	_, err = SetupTracing("otlp://", "test", logger)
+	assert.Error(t, err)
+
+	shutdown, err := SetupTracing("", "test", logger)
+	assert.NoError(t, err)
+	assert.NoError(t, shutdown(context.Background()))
+}